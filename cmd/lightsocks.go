@@ -2,9 +2,8 @@ package main
 
 import (
 	"context"
-	"net"
+	"errors"
 	"os"
-	"time"
 
 	"github.com/kardianos/service"
 	"github.com/sirupsen/logrus"
@@ -12,12 +11,9 @@ import (
 	info "github.com/xmapst/lightsocks"
 	"github.com/xmapst/lightsocks/internal/api"
 	"github.com/xmapst/lightsocks/internal/config"
-	"github.com/xmapst/lightsocks/internal/lightsocks"
+	"github.com/xmapst/lightsocks/internal/listener"
 	"github.com/xmapst/lightsocks/internal/log"
-	"github.com/xmapst/lightsocks/internal/mixed"
-	N "github.com/xmapst/lightsocks/internal/net"
 	"github.com/xmapst/lightsocks/internal/tunnel"
-	"github.com/xmapst/lightsocks/internal/udp"
 )
 
 var (
@@ -57,7 +53,9 @@ func run(_ *cobra.Command, _ []string) {
 }
 
 type program struct {
-	server *N.Listener
+	// ctx 退出时取消, 不再处理新的连接
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func (p *program) Start(service.Service) error {
@@ -66,83 +64,37 @@ func (p *program) Start(service.Service) error {
 	if err != nil {
 		logrus.Fatalln(err)
 	}
-	tunnel.Start(config.App.Outbound)
-	api.Server(config.App.Dashboard)
-	p.server = N.NewServer(config.App.Inbound.Host, config.App.Inbound.Port)
-	var handler N.IConnHandler
-	var tcpIn = tunnel.TCPIn.In
-	if config.RunMode == config.ServerMode {
-		handler = &lightsocks.Server{
-			Config: config.App.Inbound,
-			TcpIn:  tcpIn,
-		}
-	} else {
-		udpServer, err := udp.New(p.server.RawAddress())
-		if err != nil {
-			logrus.Errorln(err)
-			return err
-		}
-		// udp
-		go func() {
-			logrus.Infoln("UDP Server Listening At:", udpServer.LocalAddr())
-			udpServer.ListenAndServe()
-		}()
-		handler = &mixed.Server{
-			Config: config.App.Inbound,
-			TcpIn:  tcpIn,
-			Udp:    udpServer.LocalAddr(),
-		}
-		p.println()
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	tunnel.Start(p.ctx)
+	err = applyConfig(config.App)
+	if err != nil {
+		logrus.Errorln(err)
+		return err
 	}
-	go func() {
-		err = p.server.ListenAndServe(handler)
-		if err != nil {
-			logrus.Fatalln(err)
-		}
-	}()
-	return err
+	// 配置文件变化后只重建有变化的监听, 已建立的连接不受影响
+	config.OnReload(applyConfig)
+	return nil
+}
+
+func applyConfig(c *config.Config) error {
+	return errors.Join(
+		api.ReCreateServer(c.Dashboard),
+		listener.ReCreate(config.Inbounds, c.RunMode),
+		listener.ReCreateRedir(c.Redir),
+		listener.ReCreateTProxy(c.TProxy, c.Outbound),
+	)
 }
 
 func (p *program) Stop(service.Service) error {
 	logrus.Infoln("shutdown server")
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	p.cancel()
+	// 先停止接收新的连接及数据包, 再等待进行中的连接结束
+	config.Shutdown()
+	api.Shutdown()
+	listener.Shutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), config.App.DrainTimeout)
 	defer cancel()
-	if p.server != nil {
-		_ = p.server.Shutdown(ctx)
-	}
+	tunnel.Drain(ctx)
+	logrus.Infoln("server closed")
 	return nil
 }
-
-func (p *program) println() {
-	if config.App.Inbound.Host == "" ||
-		config.App.Inbound.Host == "0.0.0.0" ||
-		config.App.Inbound.Host == "[::]" {
-		addrs, _ := net.InterfaceAddrs()
-		for _, value := range addrs {
-			if ipnet, ok := value.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-				if ipnet.IP.To4() != nil {
-					logrus.Infof(
-						"http://%s:%d socks4://%s:%d socks5://%s:%d",
-						ipnet.IP.String(), config.App.Inbound.Port,
-						ipnet.IP.String(), config.App.Inbound.Port,
-						ipnet.IP.String(), config.App.Inbound.Port,
-					)
-				} else if ipnet.IP.To16() != nil {
-					logrus.Infof(
-						"http://[%s]:%d socks4://[%s]:%d socks5://[%s]:%d",
-						ipnet.IP.String(), config.App.Inbound.Port,
-						ipnet.IP.String(), config.App.Inbound.Port,
-						ipnet.IP.String(), config.App.Inbound.Port,
-					)
-				}
-			}
-		}
-	} else {
-		logrus.Infof(
-			"http://%s:%d socks4://%s:%d socks5://%s:%d",
-			config.App.Inbound.Host, config.App.Inbound.Port,
-			config.App.Inbound.Host, config.App.Inbound.Port,
-			config.App.Inbound.Host, config.App.Inbound.Port,
-		)
-	}
-}
@@ -0,0 +1,25 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xmapst/lightsocks/internal/config"
+)
+
+// getConfigs 当前运行模式及最近一次重新加载的结果
+func getConfigs(c *gin.Context) {
+	c.SecureJSON(http.StatusOK, gin.H{
+		"RunMode": config.RunMode,
+		"Reload":  config.LastReload(),
+	})
+}
+
+// reloadConfigs 立即重新读取配置文件
+func reloadConfigs(c *gin.Context) {
+	// 重新加载可能重建 dashboard 自身, 异步执行避免等待当前请求
+	go func() {
+		_ = config.Reload()
+	}()
+	c.Status(http.StatusAccepted)
+}
@@ -73,10 +73,7 @@ func closeConnection(c *gin.Context) {
 }
 
 func closeAllConnections(c *gin.Context) {
-	snapshot := statistic.DefaultManager.Snapshot()
-	for _, conn := range snapshot.Connections {
-		_ = conn.Close()
-	}
+	statistic.DefaultManager.CloseAll()
 	c.SecureJSON(http.StatusOK, gin.H{
 		"Code": http.StatusOK,
 		"Msg":  "Closed",
@@ -5,6 +5,7 @@ import "net/http"
 var (
 	ErrUnauthorized = newError("Unauthorized")
 	ErrBadRequest   = newError("Body invalid")
+	ErrNotFound     = newError("Resource not found")
 )
 
 // HTTPError is custom HTTP error for API
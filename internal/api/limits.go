@@ -0,0 +1,15 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xmapst/lightsocks/internal/limiter"
+)
+
+// getLimits 各入口限速及流量配额的当前使用量
+func getLimits(c *gin.Context) {
+	c.SecureJSON(http.StatusOK, gin.H{
+		"Limits": limiter.Snapshot(),
+	})
+}
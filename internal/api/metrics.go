@@ -33,9 +33,9 @@ var (
 			Namespace: strings.ToLower(info.Name),
 			Subsystem: "connection",
 			Name:      "download_bytes",
-			Help:      "Total data uploaded in bytes per connection.",
+			Help:      "Total data downloaded in bytes per connection.",
 		},
-		[]string{"id"},
+		[]string{"id", "user", "network"},
 	)
 	connectionUploadGauges = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -44,7 +44,26 @@ var (
 			Name:      "upload_bytes",
 			Help:      "Total data uploaded in bytes per connection.",
 		},
-		[]string{"id"},
+		[]string{"id", "user", "network"},
+	)
+	// UDP 关联的数据包数量
+	connectionDownloadPacketGauges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: strings.ToLower(info.Name),
+			Subsystem: "connection",
+			Name:      "download_packets",
+			Help:      "Total packets downloaded per UDP association.",
+		},
+		[]string{"id", "user", "network"},
+	)
+	connectionUploadPacketGauges = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: strings.ToLower(info.Name),
+			Subsystem: "connection",
+			Name:      "upload_packets",
+			Help:      "Total packets uploaded per UDP association.",
+		},
+		[]string{"id", "user", "network"},
 	)
 )
 
@@ -52,6 +71,8 @@ func collectMetrics() {
 	// Clear any existing metrics since we refetch them all
 	connectionDownloadGauges.Reset()
 	connectionUploadGauges.Reset()
+	connectionDownloadPacketGauges.Reset()
+	connectionUploadPacketGauges.Reset()
 	snapshot := statistic.DefaultManager.Snapshot()
 
 	connectionsGauge.Set(float64(len(snapshot.Connections)))
@@ -59,9 +80,15 @@ func collectMetrics() {
 	totalUploadGauge.Set(float64(snapshot.UploadTotal))
 
 	for _, connection := range snapshot.Connections {
-		client := connection.MetadataX().Client.String()
-		connectionDownloadGauges.WithLabelValues(client).Set(float64(connection.DownloadTotalX()))
-		connectionUploadGauges.WithLabelValues(client).Set(float64(connection.UploadTotalX()))
+		metadata := connection.MetadataX()
+		client, network := metadata.Client.String(), metadata.NetWork.String()
+		// user 为 lightsocks 入口的客户端凭据名称, 没有时为空
+		connectionDownloadGauges.WithLabelValues(client, metadata.User, network).Set(float64(connection.DownloadTotalX()))
+		connectionUploadGauges.WithLabelValues(client, metadata.User, network).Set(float64(connection.UploadTotalX()))
+		if udp, ok := connection.(*statistic.UDPTracker); ok {
+			connectionDownloadPacketGauges.WithLabelValues(client, metadata.User, network).Set(float64(udp.DownloadPackets.Load()))
+			connectionUploadPacketGauges.WithLabelValues(client, metadata.User, network).Set(float64(udp.UploadPackets.Load()))
+		}
 	}
 }
 
@@ -71,6 +98,8 @@ func init() {
 	prometheus.MustRegister(totalUploadGauge)
 	prometheus.MustRegister(connectionDownloadGauges)
 	prometheus.MustRegister(connectionUploadGauges)
+	prometheus.MustRegister(connectionDownloadPacketGauges)
+	prometheus.MustRegister(connectionUploadPacketGauges)
 }
 
 func collectMetricsLoop() {
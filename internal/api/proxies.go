@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xmapst/lightsocks/internal/config"
+	"github.com/xmapst/lightsocks/internal/outbound"
+)
+
+type updateProxyRequest struct {
+	Name string `json:"Name"`
+}
+
+func getProxies(c *gin.Context) {
+	_, _, proxies := config.Snapshot()
+	c.SecureJSON(http.StatusOK, gin.H{
+		"Proxies": proxies,
+	})
+}
+
+func findProxy(name string) (outbound.Proxy, bool) {
+	_, _, proxies := config.Snapshot()
+	proxy, ok := proxies[name]
+	return proxy, ok
+}
+
+func getProxy(c *gin.Context) {
+	proxy, ok := findProxy(c.Param("name"))
+	if !ok {
+		c.SecureJSON(http.StatusNotFound, ErrNotFound)
+		return
+	}
+	c.SecureJSON(http.StatusOK, proxy)
+}
+
+// updateProxy 切换 select 代理组当前使用的成员
+func updateProxy(c *gin.Context) {
+	proxy, ok := findProxy(c.Param("name"))
+	if !ok {
+		c.SecureJSON(http.StatusNotFound, ErrNotFound)
+		return
+	}
+	selector, ok := proxy.(*outbound.SelectorGroup)
+	if !ok {
+		c.SecureJSON(http.StatusBadRequest, newError(outbound.ErrNotSelectable.Error()))
+		return
+	}
+	req := updateProxyRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.SecureJSON(http.StatusBadRequest, ErrBadRequest)
+		return
+	}
+	if err := selector.Set(req.Name); err != nil {
+		c.SecureJSON(http.StatusBadRequest, newError(err.Error()))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// getProxyDelay 通过出口请求url测试延迟
+func getProxyDelay(c *gin.Context) {
+	proxy, ok := findProxy(c.Param("name"))
+	if !ok {
+		c.SecureJSON(http.StatusNotFound, ErrNotFound)
+		return
+	}
+	url := c.Query("url")
+	if url == "" {
+		c.SecureJSON(http.StatusBadRequest, ErrBadRequest)
+		return
+	}
+	timeout, err := strconv.Atoi(c.DefaultQuery("timeout", "5000"))
+	if err != nil {
+		c.SecureJSON(http.StatusBadRequest, ErrBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+	delay, err := proxy.URLTest(ctx, url)
+	if ctx.Err() != nil {
+		c.SecureJSON(http.StatusGatewayTimeout, newError("Timeout"))
+		return
+	}
+	if err != nil || delay == 0 {
+		c.SecureJSON(http.StatusServiceUnavailable, newError("An error occurred in the delay test"))
+		return
+	}
+	c.SecureJSON(http.StatusOK, gin.H{
+		"Delay": delay,
+	})
+}
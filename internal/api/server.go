@@ -2,12 +2,15 @@ package api
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -31,11 +34,24 @@ var (
 			return true
 		},
 	}
+
+	mu          sync.Mutex
+	current     *constant.Server
+	httpServer  *http.Server
+	metricsOnce sync.Once
 )
 
-func Server(server *constant.Server) {
+// ReCreateServer 设置变化时关闭旧的 dashboard 并按新设置重新监听
+func ReCreateServer(server *constant.Server) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil && equal(current, server) {
+		return nil
+	}
+	shutdown()
+	current = server
 	if !server.Enable() {
-		return
+		return nil
 	}
 	router := gin.New()
 	router.Use(
@@ -86,6 +102,13 @@ func Server(server *constant.Server) {
 		api.DELETE("/connections", closeAllConnections)
 		api.DELETE("/connections/:id", closeConnection)
 		api.GET("/dns/query", queryDNS)
+		api.GET("/proxies", getProxies)
+		api.GET("/proxies/:name", getProxy)
+		api.PUT("/proxies/:name", updateProxy)
+		api.GET("/proxies/:name/delay", getProxyDelay)
+		api.GET("/configs", getConfigs)
+		api.PUT("/configs", reloadConfigs)
+		api.GET("/limits", getLimits)
 	}
 	// prometheus
 	router.GET("/metrics", func(c *gin.Context) {
@@ -98,7 +121,9 @@ func Server(server *constant.Server) {
 		)
 		h.ServeHTTP(c.Writer, c.Request)
 	})
-	go collectMetricsLoop()
+	metricsOnce.Do(func() {
+		go collectMetricsLoop()
+	})
 
 	// dashboard静态页面
 	router.Use(info.StaticFile("/"))
@@ -106,18 +131,48 @@ func Server(server *constant.Server) {
 	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", server.Host, server.Port))
 	if err != nil {
 		logrus.Errorln("dashboard listen error:", err)
-		return
+		return err
 	}
 	if server.TLS.Enable {
 		ln = tls.NewListener(ln, server.TLSConf)
 	}
 	logrus.Infoln("dashboard listening At:", ln.Addr())
 	logrus.Infoln()
+	srv := &http.Server{Handler: router}
+	httpServer = srv
 	go func() {
-		if err = http.Serve(ln, router); err != nil {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			logrus.Errorln("dashboard serve error:", err)
 		}
 	}()
+	return nil
+}
+
+// Shutdown 关闭 dashboard
+func Shutdown() {
+	mu.Lock()
+	defer mu.Unlock()
+	shutdown()
+	current = nil
+}
+
+func shutdown() {
+	if httpServer == nil {
+		return
+	}
+	// 日志及流量等长连接不会主动结束, 超时后强制关闭
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		_ = httpServer.Close()
+	}
+	httpServer = nil
+}
+
+func equal(a, b *constant.Server) bool {
+	x, y := *a, *b
+	x.TLSConf, y.TLSConf = nil, nil
+	return reflect.DeepEqual(x, y)
 }
 
 func timeoutResponse(c *gin.Context) {
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"sync"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// Authenticator verifies the credentials presented by an inbound client
+type Authenticator interface {
+	Verify(user string, pass string) bool
+	Users() []string
+}
+
+type inMemoryAuthenticator struct {
+	storage   *sync.Map
+	usernames []string
+}
+
+func (au *inMemoryAuthenticator) Verify(user string, pass string) bool {
+	realPass, ok := au.storage.Load(user)
+	// 固定时间比较, 避免通过响应时间猜测密码
+	return ok && subtle.ConstantTimeCompare([]byte(realPass.(string)), []byte(pass)) == 1
+}
+
+func (au *inMemoryAuthenticator) Users() []string {
+	return au.usernames
+}
+
+// NewAuthenticator returns a static users backend, nil means no auth required
+func NewAuthenticator(users []constant.User) Authenticator {
+	if len(users) == 0 {
+		return nil
+	}
+
+	au := &inMemoryAuthenticator{storage: &sync.Map{}}
+	for _, user := range users {
+		au.storage.Store(user.Username, user.Password)
+	}
+	usernames := make([]string, 0, len(users))
+	au.storage.Range(func(key, value any) bool {
+		usernames = append(usernames, key.(string))
+		return true
+	})
+	au.usernames = usernames
+
+	return au
+}
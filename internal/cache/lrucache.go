@@ -103,6 +103,15 @@ func (c *LruCache) GetWithExpire(key any) (any, time.Time, bool) {
 	return entry.value, time.Unix(entry.expires, 0), true
 }
 
+// Len returns the number of unexpired elements
+func (c *LruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maybeDeleteOldest()
+	return c.lru.Len()
+}
+
 // Exist returns if key exist in cache but not put item to the head of linked list
 func (c *LruCache) Exist(key any) bool {
 	c.mu.Lock()
@@ -0,0 +1,93 @@
+package cipher
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// 支持的加密方式
+const (
+	AES256GCM        = "aes-256-gcm"
+	Chacha20Poly1305 = "chacha20-poly1305"
+	Legacy           = "legacy" // 旧版循环移位算法, 仅用于迁移期间兼容
+)
+
+const (
+	keySize  = 32
+	saltSize = 32
+	info     = "lightsocks-subkey"
+)
+
+var ErrCipherNotSupported = errors.New("cipher not supported")
+
+// Cipher 根据会话盐值生成 AEAD
+type Cipher interface {
+	// SaltSize 会话盐值长度, 为0表示不需要盐值
+	SaltSize() int
+	// NewAEAD 使用盐值派生会话密钥
+	NewAEAD(salt []byte) (cipher.AEAD, error)
+}
+
+// New 根据加密方式和token创建Cipher, 默认为 aes-256-gcm
+func New(method, token string) (Cipher, error) {
+	switch strings.ToLower(method) {
+	case "", AES256GCM:
+		return &aeadCipher{key: []byte(token), new: newAESGCM}, nil
+	case Chacha20Poly1305:
+		return &aeadCipher{key: []byte(token), new: chacha20poly1305.New}, nil
+	case Legacy:
+		return &legacyCipher{key: legacyKey(token)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrCipherNotSupported, method)
+	}
+}
+
+type aeadCipher struct {
+	key []byte
+	new func(key []byte) (cipher.AEAD, error)
+}
+
+func (a *aeadCipher) SaltSize() int {
+	return saltSize
+}
+
+func (a *aeadCipher) NewAEAD(salt []byte) (cipher.AEAD, error) {
+	subKey := make([]byte, keySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, a.key, salt, []byte(info)), subKey)
+	if err != nil {
+		return nil, err
+	}
+	return a.new(subKey)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Increment 小端序递增nonce, 每个数据帧使用一次
+func Increment(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// IsLegacy 是否为旧版循环移位算法
+func IsLegacy(c Cipher) bool {
+	_, ok := c.(*legacyCipher)
+	return ok
+}
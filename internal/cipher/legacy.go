@@ -0,0 +1,45 @@
+package cipher
+
+import (
+	"crypto/cipher"
+)
+
+// legacyCipher 把循环移位算法包装成 AEAD, 没有盐值, nonce 及完整性校验
+type legacyCipher struct {
+	key []byte
+}
+
+func legacyKey(token string) []byte {
+	if token == "" {
+		return nil
+	}
+	return []byte(token)
+}
+
+func (l *legacyCipher) SaltSize() int {
+	return 0
+}
+
+func (l *legacyCipher) NewAEAD(_ []byte) (cipher.AEAD, error) {
+	return &rotateAEAD{key: l.key}, nil
+}
+
+type rotateAEAD struct {
+	key []byte
+}
+
+func (r *rotateAEAD) NonceSize() int {
+	return 0
+}
+
+func (r *rotateAEAD) Overhead() int {
+	return 0
+}
+
+func (r *rotateAEAD) Seal(dst, _, plaintext, _ []byte) []byte {
+	return append(dst, Encrypt(plaintext, r.key)...)
+}
+
+func (r *rotateAEAD) Open(dst, _, ciphertext, _ []byte) ([]byte, error) {
+	return append(dst, Decrypt(ciphertext, r.key)...), nil
+}
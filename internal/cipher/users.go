@@ -0,0 +1,211 @@
+package cipher
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IDSize 握手时盐值之后携带的token标识长度
+const IDSize = 8
+
+const idInfo = "lightsocks-key-id"
+
+var (
+	ErrIDNotSupported = errors.New("cipher does not support key id")
+	ErrIDTokenEmpty   = errors.New("id token is empty")
+	ErrUnknownKey     = errors.New("unknown key")
+	ErrKeyDisabled    = errors.New("key disabled")
+	ErrKeyExpired     = errors.New("key expired")
+)
+
+// SaltGenerator 需要在盐值中携带额外信息的加密方式自行生成盐值
+type SaltGenerator interface {
+	NewSalt() ([]byte, error)
+}
+
+// KeyID token 的标识, 服务端据此直接找到对应的token, 不需要逐个尝试解密
+func KeyID(token string) []byte {
+	sum := sha256.Sum256([]byte(idInfo + token))
+	return sum[:IDSize]
+}
+
+// maskID 以服务端token对盐值的 HMAC 混淆标识, 不知道服务端token时无法还原, 再次调用即可还原
+func maskID(key, id, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	sum := mac.Sum(nil)
+	masked := make([]byte, IDSize)
+	for i := range masked {
+		masked[i] = id[i] ^ sum[i]
+	}
+	return masked
+}
+
+// identified 每个方向的盐值之后携带混淆后的token标识
+type identified struct {
+	Cipher
+	id  []byte
+	key []byte // 服务端token, 混淆标识
+}
+
+// WithID 客户端连接配置了多个凭据的服务端时, 在盐值后携带token标识, idToken 为服务端的token
+func WithID(c Cipher, token, idToken string) (Cipher, error) {
+	if c.SaltSize() == 0 {
+		return nil, ErrIDNotSupported
+	}
+	if idToken == "" {
+		return nil, ErrIDTokenEmpty
+	}
+	return &identified{Cipher: c, id: KeyID(token), key: []byte(idToken)}, nil
+}
+
+func (c *identified) SaltSize() int {
+	return c.Cipher.SaltSize() + IDSize
+}
+
+func (c *identified) NewAEAD(salt []byte) (cipher.AEAD, error) {
+	return c.Cipher.NewAEAD(salt[:c.Cipher.SaltSize()])
+}
+
+func (c *identified) NewSalt() ([]byte, error) {
+	n := c.Cipher.SaltSize()
+	salt := make([]byte, n+IDSize)
+	if _, err := rand.Read(salt[:n]); err != nil {
+		return nil, err
+	}
+	copy(salt[n:], maskID(c.key, c.id, salt[:n]))
+	return salt, nil
+}
+
+// User 服务端的一个客户端凭据
+type User struct {
+	Name     string
+	Token    string
+	Disabled bool
+	Expire   time.Time // 零值表示不过期
+	cipher   *identified
+}
+
+// Valid 停用及过期的凭据返回错误
+func (u *User) Valid() error {
+	if u.Disabled {
+		return fmt.Errorf("%w: %s", ErrKeyDisabled, u.Name)
+	}
+	if !u.Expire.IsZero() && time.Now().After(u.Expire) {
+		return fmt.Errorf("%w: %s", ErrKeyExpired, u.Name)
+	}
+	return nil
+}
+
+// Users 服务端的全部客户端凭据, 使用相同的加密方式
+type Users struct {
+	saltSize int
+	key      []byte           // 服务端token, 还原标识
+	users    map[string]*User // token标识 -> 凭据
+	names    map[string]*User // 名称 -> 凭据
+}
+
+// NewUsers idToken 为服务端的token, 客户端以此混淆token标识
+func NewUsers(method, idToken string, users []User) (*Users, error) {
+	if len(users) > 0 && idToken == "" {
+		return nil, ErrIDTokenEmpty
+	}
+	result := &Users{
+		key:   []byte(idToken),
+		users: make(map[string]*User, len(users)),
+		names: make(map[string]*User, len(users)),
+	}
+	names := make(map[string]bool, len(users))
+	for idx := range users {
+		u := users[idx]
+		if u.Name == "" || u.Token == "" {
+			return nil, fmt.Errorf("key %d name or token is empty", idx)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("key %s duplicate name", u.Name)
+		}
+		names[u.Name] = true
+		c, err := New(method, u.Token)
+		if err != nil {
+			return nil, err
+		}
+		ic, err := WithID(c, u.Token, idToken)
+		if err != nil {
+			return nil, err
+		}
+		u.cipher = ic.(*identified)
+		key := string(u.cipher.id)
+		if _, ok := result.users[key]; ok {
+			return nil, fmt.Errorf("key %s duplicate token", u.Name)
+		}
+		result.users[key] = &u
+		result.names[u.Name] = &u
+		result.saltSize = c.SaltSize()
+	}
+	return result, nil
+}
+
+// lookup 还原标识并找到对应的凭据, 停用及过期的凭据在握手时拒绝
+func (u *Users) lookup(salt, masked []byte) (*User, error) {
+	user, ok := u.users[string(maskID(u.key, masked, salt))]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if err := user.Valid(); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// User 按名称查找凭据, 不存在时返回nil
+func (u *Users) User(name string) *User {
+	if u == nil {
+		return nil
+	}
+	return u.names[name]
+}
+
+// Session 返回单个连接使用的加密方式
+func (u *Users) Session() *Session {
+	return &Session{users: u}
+}
+
+// Session 读取客户端的盐值时确定凭据, 之后两个方向都使用该凭据的token
+type Session struct {
+	users *Users
+	user  *User
+}
+
+func (s *Session) SaltSize() int {
+	return s.users.saltSize + IDSize
+}
+
+func (s *Session) NewAEAD(salt []byte) (cipher.AEAD, error) {
+	if s.user == nil {
+		n := s.users.saltSize
+		user, err := s.users.lookup(salt[:n], salt[n:])
+		if err != nil {
+			return nil, err
+		}
+		s.user = user
+	}
+	return s.user.cipher.NewAEAD(salt)
+}
+
+// NewSalt 服务端只在读取客户端的握手之后写入
+func (s *Session) NewSalt() ([]byte, error) {
+	if s.user == nil {
+		return nil, ErrUnknownKey
+	}
+	return s.user.cipher.NewSalt()
+}
+
+// User 握手之前返回nil
+func (s *Session) User() *User {
+	return s.user
+}
@@ -0,0 +1,271 @@
+package compress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"go.uber.org/atomic"
+)
+
+// 压缩算法, ID 写入每个数据帧, 接收方按ID解压
+const (
+	None   = "none"
+	Snappy = "snappy"
+	Zstd   = "zstd"
+	LZ4    = "lz4"
+)
+
+var ErrCodecNotSupported = errors.New("compression not supported")
+
+// Codec 块压缩算法, dst 长度不小于 MaxEncodedLen 时不分配内存
+type Codec interface {
+	ID() byte
+	Name() string
+	MaxEncodedLen(n int) int
+	// Encode 压缩后不小于原长度时返回nil, 由调用方发送原始数据
+	Encode(dst, src []byte) []byte
+	// Decode 解压后超过limit时返回错误
+	Decode(dst, src []byte, limit int) ([]byte, error)
+}
+
+var (
+	codecs = []Codec{
+		noneCodec{},
+		snappyCodec{},
+		zstdCodec{},
+		lz4Codec{},
+	}
+	// DefaultCodecs 未配置时客户端提议的算法
+	DefaultCodecs = []Codec{codecs[1]}
+)
+
+// ParseCodecs 按名称解析压缩算法列表, 为空时返回nil
+func ParseCodecs(names []string) ([]Codec, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	result := make([]Codec, 0, len(names))
+	for _, name := range names {
+		c := ByName(name)
+		if c == nil {
+			return nil, fmt.Errorf("%w: %s", ErrCodecNotSupported, name)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// ByName 未知的算法返回nil
+func ByName(name string) Codec {
+	for _, c := range codecs {
+		if c.Name() == strings.ToLower(name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// ByID 未知的算法返回nil
+func ByID(id byte) Codec {
+	if int(id) < len(codecs) {
+		return codecs[id]
+	}
+	return nil
+}
+
+// Choose 按对端提议的顺序选择第一个允许的算法, allowed 为空时允许全部算法, 没有时不压缩
+func Choose(proposed []byte, allowed []Codec) Codec {
+	if len(allowed) == 0 {
+		allowed = codecs
+	}
+	for _, id := range proposed {
+		for _, c := range allowed {
+			if c.ID() == id {
+				return c
+			}
+		}
+	}
+	return codecs[0]
+}
+
+type noneCodec struct{}
+
+func (noneCodec) ID() byte                  { return 0 }
+func (noneCodec) Name() string              { return None }
+func (noneCodec) MaxEncodedLen(n int) int   { return n }
+func (noneCodec) Encode(_, _ []byte) []byte { return nil }
+
+func (noneCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	if len(src) > limit {
+		return nil, TooLargeData
+	}
+	return append(dst[:0], src...), nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte                { return 1 }
+func (snappyCodec) Name() string            { return Snappy }
+func (snappyCodec) MaxEncodedLen(n int) int { return MaxEncodedLen(n) }
+
+func (snappyCodec) Encode(dst, src []byte) []byte {
+	out := Encode(dst, src)
+	if len(out) >= len(src) {
+		return nil
+	}
+	return out
+}
+
+func (snappyCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	return Decode(dst, src, limit)
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd 编解码器可并发使用, 首次使用时创建
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+			zstd.WithLowerEncoderMem(true),
+			zstd.WithEncoderCRC(false),
+		)
+		zstdDecoder, _ = zstd.NewReader(nil,
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(1<<20),
+		)
+	})
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) ID() byte     { return 2 }
+func (zstdCodec) Name() string { return Zstd }
+
+// MaxEncodedLen 不可压缩的数据加上帧头及块头
+func (zstdCodec) MaxEncodedLen(n int) int { return n + n/128 + 64 }
+
+func (zstdCodec) Encode(dst, src []byte) []byte {
+	initZstd()
+	out := zstdEncoder.EncodeAll(src, dst[:0])
+	if len(out) >= len(src) {
+		return nil
+	}
+	return out
+}
+
+func (zstdCodec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	initZstd()
+	out, err := zstdDecoder.DecodeAll(src, dst[:0])
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > limit {
+		return nil, TooLargeData
+	}
+	return out, nil
+}
+
+// lz4 的压缩器不能并发使用, 哈希表较大, 通过缓冲池复用
+var lz4Pool = sync.Pool{
+	New: func() any {
+		return new(lz4.Compressor)
+	},
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte                { return 3 }
+func (lz4Codec) Name() string            { return LZ4 }
+func (lz4Codec) MaxEncodedLen(n int) int { return lz4.CompressBlockBound(n) }
+
+func (lz4Codec) Encode(dst, src []byte) []byte {
+	c := lz4Pool.Get().(*lz4.Compressor)
+	defer lz4Pool.Put(c)
+	n, err := c.CompressBlock(src, dst[:cap(dst)])
+	// 不可压缩时返回0
+	if err != nil || n == 0 || n >= len(src) {
+		return nil
+	}
+	return dst[:n]
+}
+
+func (lz4Codec) Decode(dst, src []byte, limit int) ([]byte, error) {
+	if cap(dst) < limit {
+		dst = make([]byte, limit)
+	}
+	n, err := lz4.UncompressBlock(src, dst[:limit])
+	if err != nil {
+		return nil, err
+	}
+	return dst[:n], nil
+}
+
+// Stats 一个连接发送方向的压缩统计
+type Stats struct {
+	codec  *atomic.Pointer[Codec]
+	in     *atomic.Int64 // 压缩前字节数
+	out    *atomic.Int64 // 压缩后字节数
+	active *atomic.Bool  // 压缩率差时暂停压缩
+}
+
+func NewStats(c Codec) *Stats {
+	return &Stats{
+		codec:  atomic.NewPointer(&c),
+		in:     atomic.NewInt64(0),
+		out:    atomic.NewInt64(0),
+		active: atomic.NewBool(c.ID() != 0),
+	}
+}
+
+func (s *Stats) Codec() Codec {
+	return *s.codec.Load()
+}
+
+// SetCodec 协商完成后更换压缩算法, 已有的统计保留
+func (s *Stats) SetCodec(c Codec) {
+	s.codec.Store(&c)
+	s.active.Store(c.ID() != 0)
+}
+
+// Add 记录一个数据帧压缩前后的长度
+func (s *Stats) Add(in, out int) {
+	s.in.Add(int64(in))
+	s.out.Add(int64(out))
+}
+
+func (s *Stats) SetActive(active bool) {
+	s.active.Store(active)
+}
+
+// Ratio 压缩后与压缩前的字节数之比, 没有数据时为1
+func (s *Stats) Ratio() float64 {
+	in := s.in.Load()
+	if in == 0 {
+		return 1
+	}
+	return float64(s.out.Load()) / float64(in)
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"Codec":  s.Codec().Name(),
+		"Ratio":  s.Ratio(),
+		"Active": s.active.Load(),
+	})
+}
+
+// Reporter 提供压缩统计的连接
+type Reporter interface {
+	Compression() *Stats
+}
@@ -2,4 +2,7 @@ package compress
 
 import "errors"
 
-var EmptyData = errors.New("empty data")
+var (
+	EmptyData    = errors.New("empty data")
+	TooLargeData = errors.New("too large data")
+)
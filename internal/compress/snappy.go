@@ -40,3 +40,25 @@ func Unzip(data []byte) ([]byte, error) {
 
 	return out, err
 }
+
+// MaxEncodedLen Encode 需要的最大长度
+func MaxEncodedLen(n int) int {
+	return snappy.MaxEncodedLen(n)
+}
+
+// Encode 按 snappy 块格式压缩, dst 长度不小于 MaxEncodedLen 时直接写入dst, 不分配内存
+func Encode(dst, src []byte) []byte {
+	return snappy.Encode(dst, src)
+}
+
+// Decode 解压 snappy 块格式的数据, 解压后超过limit时返回错误, dst 长度足够时直接写入dst
+func Decode(dst, src []byte, limit int) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, TooLargeData
+	}
+	return snappy.Decode(dst, src)
+}
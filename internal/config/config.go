@@ -6,7 +6,9 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -14,26 +16,56 @@ import (
 	"github.com/robfig/cron/v3"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/constant"
 	"github.com/xmapst/lightsocks/internal/dns"
+	"github.com/xmapst/lightsocks/internal/fakeip"
+	"github.com/xmapst/lightsocks/internal/lightsocks"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/outbound"
+	"github.com/xmapst/lightsocks/internal/protocol"
 	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/rules"
 	"github.com/xmapst/lightsocks/internal/trie"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
-	App       *Config
-	RunMode   string
-	Token     string
+	App      *Config
+	RunMode  string
+	Cipher   cipher.Cipher
+	Inbounds []Inbound
+	Rules    []rules.Rule
+	Proxies  map[string]outbound.Proxy
+	// proxyKeys 当前出口的配置摘要, 见 proxyKey
+	proxyKeys map[string]string
 	logOutput *lumberjack.Logger
+	mu        sync.RWMutex
 	v         = viper.NewWithOptions(viper.KeyDelimiter("::"))
 )
 
-func viperLoadConf() error {
+// loaded 解析完成但尚未生效的配置
+type loaded struct {
+	conf       *Config
+	cipher     cipher.Cipher
+	inbounds   []Inbound
+	rules      []rules.Rule
+	proxies    map[string]outbound.Proxy
+	proxyKeys  map[string]string
+	resolver   *dns.Resolver
+	hosts      *trie.DomainTrie
+	fakeIPPool *fakeip.Pool
+	limits     map[string][]*limiter.Rule
+}
+
+// viperLoadConf 读取并解析配置文件, 不修改当前生效的配置
+func viperLoadConf() (*loaded, error) {
 	err := v.ReadInConfig()
 	if err != nil {
 		logrus.Errorln(err)
-		return err
+		return nil, err
 	}
 	var conf = &Config{
 		RunMode: DirectMode,
@@ -55,6 +87,7 @@ func viperLoadConf() error {
 				MinVersion: tls.VersionTLS13,
 			},
 		},
+		DrainTimeout: defaultDrainTimeout,
 		Log: Log{
 			Level:      "info",
 			MaxBackups: 7,
@@ -66,7 +99,7 @@ func viperLoadConf() error {
 	err = v.Unmarshal(conf)
 	if err != nil {
 		logrus.Errorln(err)
-		return err
+		return nil, err
 	}
 	if conf.Dashboard != nil {
 		conf.Dashboard.LoadTLS()
@@ -74,54 +107,87 @@ func viperLoadConf() error {
 	conf.Inbound.LoadTLS()
 	conf.Outbound.LoadTLS()
 
-	if !conf.Outbound.Enable() && conf.RunMode != ServerMode {
+	if !conf.Outbound.Enable() && len(conf.Outbounds) == 0 && conf.RunMode != ServerMode {
 		conf.RunMode = DirectMode
 	}
-	if !conf.Inbound.Enable() {
-		return errors.New("inbound is not enable")
+	l := &loaded{conf: conf}
+	l.inbounds, err = conf.parseInbounds()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.inbounds) == 0 {
+		return nil, errors.New("inbound is not enable")
 	}
-	if conf.RunMode == ServerMode {
-		Token = conf.Inbound.Token
+	l.limits, err = parseLimits(l.inbounds)
+	if err != nil {
+		return nil, err
 	}
-	if conf.RunMode == ClientMode {
-		Token = conf.Outbound.Token
+	if conf.RunMode == ServerMode && conf.Inbound.Enable() {
+		// 客户端模式下每个lightsocks出口使用自己的加密方式
+		l.cipher, err = cipher.New(conf.Inbound.Cipher, conf.Inbound.Token)
+		if err != nil {
+			return nil, err
+		}
 	}
 	nameServers, err := conf.parseNameServer()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resolver.DefaultResolver = dns.NewResolver(nameServers)
-	resolver.DefaultHosts, err = conf.parseHosts()
+	l.resolver = dns.NewResolver(nameServers)
+	l.hosts, err = conf.parseHosts()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	RunMode = conf.RunMode
-	App = conf
-	return nil
+	l.fakeIPPool, err = conf.parseFakeIPPool()
+	if err != nil {
+		return nil, err
+	}
+	l.proxies, l.proxyKeys, err = conf.parseProxies()
+	if err != nil {
+		return nil, err
+	}
+	l.rules, err = conf.parseRules(l.proxies)
+	if err != nil {
+		closeProxies(l.proxies, currentProxies())
+		return nil, err
+	}
+	return l, nil
+}
+
+// apply 一次性替换规则、出口及DNS解析, 移除或变化的出口在已有连接结束后关闭
+func (l *loaded) apply() {
+	mu.Lock()
+	oldProxies := Proxies
+	inheritSelected(oldProxies, l.proxies)
+	resolver.DefaultResolver = l.resolver
+	resolver.DefaultHosts = l.hosts
+	resolver.DefaultFakeIPPool = l.fakeIPPool
+	RunMode = l.conf.RunMode
+	Rules = l.rules
+	Proxies = l.proxies
+	proxyKeys = l.proxyKeys
+	Cipher = l.cipher
+	Inbounds = l.inbounds
+	App = l.conf
+	mu.Unlock()
+	limiter.Update(l.limits)
+	closeProxies(oldProxies, l.proxies)
 }
 
 func Load(filepath string) error {
 	v.SetConfigFile(filepath)
 	v.SetConfigType("yaml")
-	err := viperLoadConf()
+	l, err := viperLoadConf()
 	if err != nil {
 		return err
 	}
+	l.apply()
 	v.WatchConfig()
 	v.OnConfigChange(func(e fsnotify.Event) {
 		if !e.Has(fsnotify.Write) {
 			return
 		}
-		err = viperLoadConf()
-		if err != nil {
-			logrus.Warnln(err.Error())
-			return
-		}
-		err = App.load()
-		if err != nil {
-			logrus.Warnln(err.Error())
-			return
-		}
+		_ = Reload()
 	})
 
 	err = App.load()
@@ -134,6 +200,12 @@ func Load(filepath string) error {
 			_ = logOutput.Rotate()
 		}
 	})
+	// 定期保存流量配额的使用量
+	_, _ = _cron.AddFunc("@every 1m", func() {
+		if err := limiter.Save(); err != nil {
+			logrus.Warnln("save quota:", err)
+		}
+	})
 	_cron.Start()
 	return nil
 }
@@ -145,6 +217,13 @@ func (c *Config) load() error {
 		level = logrus.InfoLevel
 	}
 	logrus.SetLevel(level)
+	quotaFile := c.QuotaFile
+	if quotaFile == "" {
+		quotaFile = filepath.Join(filepath.Dir(v.ConfigFileUsed()), defaultQuotaFile)
+	}
+	if err = limiter.Load(quotaFile); err != nil {
+		logrus.Warnln("load quota:", err)
+	}
 	if c.Log.Filename != "" {
 		logOutput = &lumberjack.Logger{
 			Filename:   c.Log.Filename,
@@ -159,7 +238,20 @@ func (c *Config) load() error {
 		logOutput = nil
 		logrus.SetOutput(os.Stdout)
 	}
-	return nil
+	err = dns.ReCreateServer(c.DNS.Listen, dns.ServerOption{
+		FilterAAAA: c.DNS.FilterAAAA,
+		MinTTL:     c.DNS.MinTTL,
+	})
+	if err != nil {
+		return err
+	}
+	filter := trie.New()
+	for _, domain := range c.DNS.FakeIP.Filter {
+		if err = filter.Insert(domain, true); err != nil {
+			return fmt.Errorf("FakeIP Filter %s error: %s", domain, err.Error())
+		}
+	}
+	return dns.ReCreateFakeIPServer(c.DNS.FakeIP.Listen, filter)
 }
 
 func hostWithDefaultPort(host string, defPort string) (string, error) {
@@ -179,6 +271,103 @@ func hostWithDefaultPort(host string, defPort string) (string, error) {
 	return net.JoinHostPort(hostname, port), nil
 }
 
+// parseInbounds Inbound 按运行模式作为名为default的入口, 排在 Inbounds 之前
+func (c *Config) parseInbounds() ([]Inbound, error) {
+	var inbounds []Inbound
+	if c.Inbound.Enable() {
+		in := Inbound{
+			Type:   InboundMixed,
+			Server: *c.Inbound,
+		}
+		if c.RunMode == ServerMode {
+			in.Type = InboundLightsocks
+		}
+		if err := validateInbound("Inbound", &in); err != nil {
+			return nil, err
+		}
+		if in.Tag == "" {
+			in.Tag = defaultInboundTag
+		}
+		inbounds = append(inbounds, in)
+	}
+	for idx := range c.Inbounds {
+		in := c.Inbounds[idx]
+		in.Type = strings.ToLower(in.Type)
+		if in.Type == "" {
+			in.Type = InboundMixed
+		}
+		if err := validateInbound(fmt.Sprintf("Inbounds[%d]", idx), &in); err != nil {
+			return nil, err
+		}
+		if in.Tag == "" {
+			in.Tag = fmt.Sprintf("%s-%d", in.Type, in.Port)
+		}
+		if in.Timeout == 0 {
+			in.Timeout = 30 * time.Second
+		}
+		in.TLSConf = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+		}
+		in.LoadTLS()
+		inbounds = append(inbounds, in)
+	}
+	tags := make(map[string]bool)
+	for _, in := range inbounds {
+		if tags[in.Tag] {
+			return nil, fmt.Errorf("Inbounds duplicate tag %s", in.Tag)
+		}
+		tags[in.Tag] = true
+	}
+	return inbounds, nil
+}
+
+// validateInbound 检查入口的协议, 客户端凭据及地址, name 为错误信息中的配置项名称
+func validateInbound(name string, in *Inbound) error {
+	switch in.Type {
+	case InboundMixed, InboundSocks4, InboundSocks5, InboundHttp:
+	case InboundLightsocks:
+		if _, err := cipher.New(in.Cipher, in.Token); err != nil {
+			return fmt.Errorf("%s error: %s", name, err.Error())
+		}
+		if _, err := lightsocks.NewUsers(in.Cipher, in.Token, in.Keys); err != nil {
+			return fmt.Errorf("%s Keys error: %s", name, err.Error())
+		}
+		if _, err := N.NewTransportServer(&in.Server); err != nil {
+			return fmt.Errorf("%s Transport error: %s", name, err.Error())
+		}
+		if _, _, err := net.SplitHostPort(in.Fallback); in.Fallback != "" && err != nil {
+			return fmt.Errorf("%s Fallback error: %s", name, err.Error())
+		}
+		if _, err := protocol.ParsePadding(in.Padding); err != nil {
+			return fmt.Errorf("%s Padding error: %s", name, err.Error())
+		}
+		if _, err := compress.ParseCodecs(in.Compression); err != nil {
+			return fmt.Errorf("%s Compression error: %s", name, err.Error())
+		}
+	default:
+		return fmt.Errorf("%s unsupported type %s", name, in.Type)
+	}
+	if !in.Enable() {
+		return fmt.Errorf("%s port is empty", name)
+	}
+	return nil
+}
+
+// parseLimits 按入口标签解析限速及流量配额
+func parseLimits(inbounds []Inbound) (map[string][]*limiter.Rule, error) {
+	result := make(map[string][]*limiter.Rule)
+	for _, in := range inbounds {
+		list, err := limiter.New(in.Tag, in.Limits)
+		if err != nil {
+			return nil, fmt.Errorf("Inbound %s %s", in.Tag, err.Error())
+		}
+		if len(list) > 0 {
+			result[in.Tag] = list
+		}
+	}
+	return result, nil
+}
+
 func (c *Config) parseNameServer() ([]dns.NameServer, error) {
 	var nameservers []dns.NameServer
 	for idx, server := range c.DNS.NameServers {
@@ -240,7 +429,7 @@ func (c *Config) parseHosts() (*trie.DomainTrie, error) {
 	tree := trie.New()
 	// add default hosts
 	if err := tree.Insert("localhost", net.IP{127, 0, 0, 1}); err != nil {
-		logrus.Errorln("insert localhost to host error: %v", err)
+		logrus.Errorf("insert localhost to host error: %v", err)
 	}
 	for domain, ipStr := range c.DNS.Hosts {
 		ip := net.ParseIP(ipStr)
@@ -251,3 +440,184 @@ func (c *Config) parseHosts() (*trie.DomainTrie, error) {
 	}
 	return tree, nil
 }
+
+// parseFakeIPPool 网段未变化时沿用已有的ip池, 保留已分配的映射
+func (c *Config) parseFakeIPPool() (*fakeip.Pool, error) {
+	if c.DNS.FakeIP.Listen == "" {
+		return nil, nil
+	}
+	ipRange := c.DNS.FakeIP.Range
+	if ipRange == "" {
+		ipRange = defaultFakeIPRange
+	}
+	_, ipnet, err := net.ParseCIDR(ipRange)
+	if err != nil {
+		return nil, fmt.Errorf("FakeIP Range format error: %s", err.Error())
+	}
+	if pool := resolver.DefaultFakeIPPool; pool != nil && pool.IPNet().String() == ipnet.String() {
+		return pool, nil
+	}
+	pool, err := fakeip.New(ipnet, c.DNS.FakeIP.Size)
+	if err != nil {
+		return nil, fmt.Errorf("FakeIP Range error: %s", err.Error())
+	}
+	return pool, nil
+}
+
+func (c *Config) parseRules(proxies map[string]outbound.Proxy) ([]rules.Rule, error) {
+	var parsed []rules.Rule
+	for idx, line := range c.Rules {
+		rule, err := rules.ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("Rules[%d] format error: %s", idx, err.Error())
+		}
+		if _, ok := proxies[rule.Adapter()]; !ok && rule.Adapter() != rules.Proxy {
+			return nil, fmt.Errorf("Rules[%d] %s: %w", idx, rule.Adapter(), outbound.ErrProxyNotFound)
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// parseProxies 配置未变化的出口沿用当前的实例, 保留多路复用的会话池, 代理组每次重新创建
+func (c *Config) parseProxies() (proxies map[string]outbound.Proxy, keys map[string]string, err error) {
+	proxies = map[string]outbound.Proxy{
+		rules.Direct: outbound.NewDirect(rules.Direct, c.Outbound),
+		rules.Reject: outbound.NewReject(rules.Reject),
+	}
+	keys = make(map[string]string)
+	parsed := proxies
+	defer func() {
+		if err != nil {
+			closeProxies(parsed, currentProxies())
+		}
+	}()
+	for idx := range c.Outbounds {
+		o := c.Outbounds[idx]
+		if o.Name == "" {
+			return nil, nil, fmt.Errorf("Outbounds[%d] name is empty", idx)
+		}
+		if _, ok := proxies[o.Name]; ok {
+			return nil, nil, fmt.Errorf("Outbounds[%d] duplicate name %s", idx, o.Name)
+		}
+		keys[o.Name] = proxyKey(o.Type, o.Server, keys[o.Via])
+		if p := reuseProxy(o.Name, keys[o.Name]); p != nil {
+			proxies[o.Name] = p
+			continue
+		}
+		server := &o.Server
+		if server.Timeout == 0 {
+			server.Timeout = 30 * time.Second
+		}
+		server.TLSConf = &tls.Config{
+			MinVersion: tls.VersionTLS13,
+		}
+		server.LoadTLS()
+
+		var via outbound.Proxy
+		via, err = lookupVia(proxies, server.Via)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Outbounds[%d] %s error: %s", idx, o.Name, err.Error())
+		}
+
+		var proxy outbound.Proxy
+		switch strings.ToLower(o.Type) {
+		case "", "lightsocks":
+			proxy, err = outbound.NewLightsocks(o.Name, server, via)
+		case "socks5":
+			proxy = outbound.NewSocks5(o.Name, server, via)
+		case "http":
+			proxy = outbound.NewHttp(o.Name, server, via)
+		case "direct":
+			if via != nil {
+				err = errors.New("direct does not support via")
+				break
+			}
+			proxy = outbound.NewDirect(o.Name, server)
+		default:
+			err = fmt.Errorf("unsupported type %s", o.Type)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Outbounds[%d] %s error: %s", idx, o.Name, err.Error())
+		}
+		proxies[o.Name] = proxy
+	}
+
+	if c.RunMode == ClientMode && c.Outbound.Enable() {
+		if _, ok := proxies[rules.Proxy]; ok {
+			return nil, nil, fmt.Errorf("Outbound conflicts with Outbounds named %s", rules.Proxy)
+		}
+		keys[rules.Proxy] = proxyKey("", *c.Outbound, keys[c.Outbound.Via])
+		proxy := reuseProxy(rules.Proxy, keys[rules.Proxy])
+		if proxy == nil {
+			var via outbound.Proxy
+			via, err = lookupVia(proxies, c.Outbound.Via)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Outbound error: %s", err.Error())
+			}
+			proxy, err = outbound.NewLightsocks(rules.Proxy, c.Outbound, via)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Outbound error: %s", err.Error())
+			}
+		}
+		proxies[rules.Proxy] = proxy
+	}
+
+	for idx, g := range c.Groups {
+		if g.Name == "" {
+			return nil, nil, fmt.Errorf("Groups[%d] name is empty", idx)
+		}
+		if _, ok := proxies[g.Name]; ok {
+			return nil, nil, fmt.Errorf("Groups[%d] duplicate name %s", idx, g.Name)
+		}
+		if len(g.Proxies) == 0 {
+			return nil, nil, fmt.Errorf("Groups[%d] %s has no proxies", idx, g.Name)
+		}
+		var members []outbound.Proxy
+		for _, name := range g.Proxies {
+			p, ok := proxies[name]
+			if !ok {
+				return nil, nil, fmt.Errorf("Groups[%d] %s: %s %w", idx, g.Name, name, outbound.ErrProxyNotFound)
+			}
+			members = append(members, p)
+		}
+
+		var group outbound.Proxy
+		switch strings.ToLower(g.Type) {
+		case "select":
+			group = outbound.NewSelector(g.Name, members)
+		case "url-test":
+			group = outbound.NewURLTest(g.Name, members, outbound.NewHealthCheck(members, g.URL, g.Interval), g.Tolerance)
+		case "fallback":
+			group = outbound.NewFallback(g.Name, members, outbound.NewHealthCheck(members, g.URL, g.Interval))
+		case "load-balance":
+			group = outbound.NewLoadBalance(g.Name, members, outbound.NewHealthCheck(members, g.URL, g.Interval))
+		default:
+			return nil, nil, fmt.Errorf("Groups[%d] %s unsupported type %s", idx, g.Name, g.Type)
+		}
+		proxies[g.Name] = group
+	}
+	return proxies, keys, nil
+}
+
+// lookupVia 链式代理只能引用已定义的出口
+func lookupVia(proxies map[string]outbound.Proxy, name string) (outbound.Proxy, error) {
+	if name == "" {
+		return nil, nil
+	}
+	via, ok := proxies[name]
+	if !ok {
+		return nil, fmt.Errorf("via %s: %w", name, outbound.ErrProxyNotFound)
+	}
+	return via, nil
+}
+
+// closeProxies 关闭不再使用的出口, keep 中沿用的同一实例不关闭
+func closeProxies(proxies, keep map[string]outbound.Proxy) {
+	for name, p := range proxies {
+		if keep[name] == p {
+			continue
+		}
+		_ = p.Close()
+	}
+}
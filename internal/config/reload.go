@@ -0,0 +1,148 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dns"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	"github.com/xmapst/lightsocks/internal/outbound"
+	"github.com/xmapst/lightsocks/internal/rules"
+)
+
+// ReloadStatus 最近一次重新加载的结果
+type ReloadStatus struct {
+	Time    time.Time `json:"Time"`
+	Success bool      `json:"Success"`
+	Error   string    `json:"Error,omitempty"`
+}
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func(c *Config) error
+	lastReload  ReloadStatus
+	closed      bool
+)
+
+// OnReload 注册配置生效后的处理, 例如重建有变化的监听
+func OnReload(fn func(c *Config) error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// Reload 重新读取配置文件, 解析失败时保留当前配置
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if closed {
+		// 已开始关闭, 不再重建监听
+		return nil
+	}
+	err := reload()
+	lastReload = ReloadStatus{
+		Time:    time.Now(),
+		Success: err == nil,
+	}
+	if err != nil {
+		lastReload.Error = err.Error()
+		logrus.Warnln("config reload failed:", err)
+		return err
+	}
+	logrus.Infoln("config reloaded")
+	return nil
+}
+
+func reload() error {
+	l, err := viperLoadConf()
+	if err != nil {
+		return err
+	}
+	l.apply()
+	var errs []error
+	if err = App.load(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, fn := range reloadHooks {
+		if err = fn(App); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown 停止响应配置文件变化, 关闭DNS服务并保存流量配额的使用量, 等待进行中的重新加载完成
+func Shutdown() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	closed = true
+	dns.Shutdown()
+	if err := limiter.Save(); err != nil {
+		logrus.Warnln("save quota:", err)
+	}
+}
+
+// LastReload 返回最近一次重新加载的结果, 未重新加载过时 Time 为零值
+func LastReload() ReloadStatus {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	return lastReload
+}
+
+// Snapshot 返回同一份配置中的运行模式、规则及出口
+func Snapshot() (string, []rules.Rule, map[string]outbound.Proxy) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return RunMode, Rules, Proxies
+}
+
+// inheritSelected 新配置中同名的选择组沿用之前手动选择的出口
+func inheritSelected(old, proxies map[string]outbound.Proxy) {
+	for name, p := range proxies {
+		selector, ok := p.(*outbound.SelectorGroup)
+		if !ok {
+			continue
+		}
+		if prev, ok := old[name].(*outbound.SelectorGroup); ok {
+			_ = selector.Set(prev.Now())
+		}
+	}
+}
+
+// proxyKey 出口的类型, 配置及经由的出口的摘要, 经由的出口变化时同样需要重新创建
+func proxyKey(typ string, server constant.Server, via string) string {
+	server.TLSConf = nil
+	b, err := json.Marshal(struct {
+		Type   string
+		Server constant.Server
+		Via    string
+	}{typ, server, via})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// reuseProxy 同名且配置未变化的出口返回当前的实例, 否则返回nil
+func reuseProxy(name, key string) outbound.Proxy {
+	mu.RLock()
+	defer mu.RUnlock()
+	if key == "" || proxyKeys[name] != key {
+		return nil
+	}
+	return Proxies[name]
+}
+
+// currentProxies 当前生效的出口
+func currentProxies() map[string]outbound.Proxy {
+	mu.RLock()
+	defer mu.RUnlock()
+	return Proxies
+}
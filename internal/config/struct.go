@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/xmapst/lightsocks/internal/constant"
 	"github.com/xmapst/lightsocks/internal/dns"
 )
@@ -22,24 +24,80 @@ var (
 	}
 )
 
+const defaultFakeIPRange = "198.18.0.0/15"
+
 const (
 	DirectMode = "Direct"
 	ClientMode = "Client"
 	ServerMode = "Server"
 )
 
+// 入口协议
+const (
+	InboundMixed      = "mixed"
+	InboundSocks4     = "socks4"
+	InboundSocks5     = "socks5"
+	InboundHttp       = "http"
+	InboundLightsocks = "lightsocks"
+)
+
+const defaultInboundTag = "default"
+
+const defaultDrainTimeout = 10 * time.Second
+
+const defaultQuotaFile = "quota.json"
+
 type Config struct {
-	RunMode   string           `yaml:""` // 模式
-	Inbound   *constant.Server `yaml:""` // 服务端及客户端监听的本地端口
-	Outbound  *constant.Server `yaml:""` // 远端服务器地址
-	Dashboard *constant.Server `yaml:""` // Dashboard
-	DNS       DNS              `yaml:""` // DNS配置
-	Log       Log              `yaml:""` // 日志输出
+	RunMode      string           `yaml:""` // 模式
+	Inbound      *constant.Server `yaml:""` // 服务端及客户端监听的本地端口
+	Inbounds     []Inbound        `yaml:""` // 更多监听入口, 与 Inbound 同时生效
+	Redir        string           `yaml:""` // linux iptables REDIRECT 透明代理监听地址, 为空则不开启
+	TProxy       string           `yaml:""` // linux iptables TPROXY 透明代理监听地址(TCP及UDP), 为空则不开启
+	Outbound     *constant.Server `yaml:""` // 远端服务器地址, 客户端模式下作为名为PROXY的出口
+	Outbounds    []Outbound       `yaml:""` // 命名出口
+	Groups       []Group          `yaml:""` // 代理组
+	Dashboard    *constant.Server `yaml:""` // Dashboard
+	DNS          DNS              `yaml:""` // DNS配置
+	Rules        []string         `yaml:""` // 路由规则
+	Log          Log              `yaml:""` // 日志输出
+	DrainTimeout time.Duration    `yaml:""` // 退出时等待进行中的连接结束的时间, 超时后强制关闭, 默认10s
+	QuotaFile    string           `yaml:""` // 流量配额使用量的保存文件, 默认为配置文件所在目录下的 quota.json
+}
+
+type Inbound struct {
+	Type            string `yaml:""` // 协议: mixed(默认), socks4, socks5, http, lightsocks
+	constant.Server `yaml:",inline" mapstructure:",squash"`
+}
+
+type Outbound struct {
+	Name            string `yaml:""` // 名称, 规则及代理组中引用
+	Type            string `yaml:""` // 类型: lightsocks(默认), socks5, http, direct, 代理组在 Groups 中配置
+	constant.Server `yaml:",inline" mapstructure:",squash"`
+}
+
+type Group struct {
+	Name      string        `yaml:""` // 名称, 规则及其他代理组中引用
+	Type      string        `yaml:""` // 类型: select, url-test, fallback, load-balance
+	Proxies   []string      `yaml:""` // 成员, 只能引用已定义的出口及代理组
+	URL       string        `yaml:""` // 健康检查地址
+	Interval  time.Duration `yaml:""` // 健康检查间隔, 为0则不检查
+	Tolerance uint16        `yaml:""` // url-test 切换的延迟容差(ms)
 }
 
 type DNS struct {
+	Listen      string            `yaml:""` // DNS服务监听地址, 同时提供UDP及TCP, 为空则不开启
+	FilterAAAA  bool              `yaml:""` // DNS服务对AAAA请求返回空应答
+	MinTTL      uint32            `yaml:""` // DNS服务应答的最小TTL(秒)
 	NameServers []string          `yaml:""`
 	Hosts       map[string]string `yaml:""`
+	FakeIP      FakeIP            `yaml:""` // fake-ip 模式
+}
+
+type FakeIP struct {
+	Listen string   `yaml:""` // fake-ip DNS服务监听地址(UDP), 为空则不开启
+	Range  string   `yaml:""` // 虚假ip网段, 默认 198.18.0.0/15
+	Size   int      `yaml:""` // 最多保存的映射数量, 默认与网段大小相同
+	Filter []string `yaml:""` // 返回真实ip的域名, 支持通配符
 }
 
 type Log struct {
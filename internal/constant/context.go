@@ -1,6 +1,7 @@
 package constant
 
 import (
+	"errors"
 	"net"
 )
 
@@ -17,6 +18,8 @@ const (
 	HTTPS
 	SOCKS4
 	SOCKS5
+	REDIR
+	TPROXY
 )
 
 const (
@@ -25,11 +28,20 @@ const (
 	Block
 )
 
+// ErrRejected 规则匹配到拒绝的出口
+var ErrRejected = errors.New("rejected by rule")
+
+// ErrNotSupported 匹配的出口不支持该请求, 如 BIND 只能直连
+var ErrNotSupported = errors.New("not supported by outbound")
+
 // TCPContext is used to store connection address
 type TCPContext struct {
 	SrcConn  net.Conn
 	Metadata *Metadata
 	Line     string // http proxy
-	PreFn    func()
-	PostFn   func()
+	// PreFn 连接目标成功后, 转发前调用, bound 为连接目标使用的本地地址
+	PreFn func(bound net.Addr)
+	// FailFn 连接目标失败或被拒绝时调用, 入口可以返回对应的错误, 之后仍会调用 PostFn
+	FailFn func(err error)
+	PostFn func()
 }
@@ -51,6 +51,10 @@ func (t Type) String() string {
 		return "Socks4"
 	case SOCKS5:
 		return "Socks5"
+	case REDIR:
+		return "Redir"
+	case TPROXY:
+		return "TProxy"
 	default:
 		return "Unknown"
 	}
@@ -66,6 +70,10 @@ func UnmarshalType(s string) Type {
 		return SOCKS4
 	case "socks5":
 		return SOCKS5
+	case "redir":
+		return REDIR
+	case "tproxy":
+		return TPROXY
 	default:
 		return Unknown
 	}
@@ -82,6 +90,17 @@ type Metadata struct {
 	Client  *IP       `json:"Client"`
 	Source  *IP       `json:"Source"`
 	Target  *IP       `json:"Target"`
+	Inbound string    `json:"Inbound"`        // 入口标签, 仅本地使用, 不随元数据传输
+	User    string    `json:"User,omitempty"` // lightsocks 入口的客户端凭据名称
+	DstIP   net.IP    `json:"-"`              // 规则匹配时解析的目标ip
+}
+
+// Identity 日志中显示的入口, 有客户端凭据时为 名称@入口标签
+func (m *Metadata) Identity() string {
+	if m.User == "" {
+		return m.Inbound
+	}
+	return m.User + "@" + m.Inbound
 }
 
 func (m *Metadata) String() string {
@@ -12,12 +12,36 @@ type Server struct {
 	Host    string        `yaml:""` // 地址
 	Port    int64         `yaml:""` // 端口
 	Token   string        `yaml:""` // 加密key
+	Cipher  string        `yaml:""` // 加密方式: aes-256-gcm(默认), chacha20-poly1305, legacy
 	TLS     *TLS          `yaml:""` // 证书
 	Timeout time.Duration `yaml:""` // 连接超时时间
 
+	// 入口特殊配置
+	Tag    string  `yaml:""` // 入口标签, 显示在日志及连接列表中
+	Users  []User  `yaml:""` // 认证用户, 为空则不需要认证
+	Limits []Limit `yaml:""` // 按客户端地址限速及限制流量, 按顺序匹配第一项
+	Keys   []Key   `yaml:""` // lightsocks 入口的多个客户端凭据, Token 用于加密token标识, 客户端需配置 IDToken
+	// lightsocks 入口握手失败的连接原样转发到该地址(host:port), 如本地的网站, 为空时返回伪装的404页面
+	Fallback string `yaml:""`
+	// http 入口转发普通请求时添加的请求头
+	HTTP HTTPProxy `yaml:""`
+
 	// 出口特殊配置
 	Interface   string `yaml:""` // 指定出口网卡
 	RoutingMark int    `yaml:""` // linux 下可指定fwmark
+	Mux         Mux    `yaml:""` // 客户端到服务端的多路复用
+	Username    string `yaml:""` // 上游socks5/http代理的认证用户
+	Password    string `yaml:""` // 上游socks5/http代理的认证密码
+	Via         string `yaml:""` // 经由该名称的出口连接, 用于链式代理
+	IDToken     string `yaml:""` // 服务端的 Token, 服务端配置了 Keys 时需要, 握手时携带以此加密的token标识
+
+	// 客户端到服务端的传输方式, 入口及出口相同
+	Transport Transport `yaml:""`
+	// 发送数据帧的填充方案: random(默认), none, full, 两端可以不同
+	Padding string `yaml:""`
+	// 数据帧的压缩算法: none, snappy, zstd, lz4
+	// 出口为按优先顺序提议的列表, 默认 snappy; 入口为允许的列表, 默认全部允许
+	Compression []string `yaml:""`
 
 	// 证书
 	TLSConf *tls.Config
@@ -52,6 +76,48 @@ func (s *Server) LoadTLS() {
 	return
 }
 
+// Transport 经由只允许HTTP的网络(CDN, 反向代理)时使用 ws 或 h2 传输, 服务端在同一端口同时接受直接连接
+type Transport struct {
+	Type            string `yaml:""` // tcp(默认), ws, h2
+	Path            string `yaml:""` // 请求路径, 默认 /
+	Host            string `yaml:""` // 客户端请求的Host头, 默认为服务端地址
+	EarlyData       int    `yaml:""` // 首包随握手请求发送的最大字节数, 为0则握手完成后再发送
+	EarlyDataHeader string `yaml:""` // ws 携带首包的请求头, 默认 Sec-WebSocket-Protocol
+}
+
+type HTTPProxy struct {
+	Via           string `yaml:""` // 添加 Via 头时使用的代理名称, 为空则不添加
+	XForwardedFor bool   `yaml:""` // 把客户端地址追加到 X-Forwarded-For
+}
+
+type Mux struct {
+	Enable      bool          `yaml:""`
+	MaxStreams  int           `yaml:""` // 单个会话最大并发流, 默认8
+	IdleTimeout time.Duration `yaml:""` // 多余的空闲会话超过该时间后关闭, 为0则不关闭
+}
+
+// Limit 同一地址或网段的客户端共享速率及流量配额
+type Limit struct {
+	Source   string `yaml:""` // 客户端ip或网段, 例如 192.168.1.10, 10.0.0.0/8
+	Upload   string `yaml:""` // 上传速率(每秒), 例如 512KB, 10MB, 为空则不限制
+	Download string `yaml:""` // 下载速率(每秒), 为空则不限制
+	Quota    string `yaml:""` // 每个周期的流量配额(上传及下载合计), 例如 100GB, 为空则不限制
+	Period   string `yaml:""` // 配额周期: daily, monthly(默认)
+}
+
+// Key lightsocks 服务端的一个客户端凭据
+type Key struct {
+	Name     string    `yaml:""` // 客户端名称, 显示在日志及连接列表中
+	Token    string    `yaml:""` // 加密key, 加密方式与入口相同
+	Disabled bool      `yaml:""` // 停用, 不需要删除即可吊销
+	Expire   time.Time `yaml:""` // 过期时间, 例如 2026-12-31(UTC零点) 或 2026-12-31T23:59:59+08:00, 不加引号, 为空则不过期
+}
+
+type User struct {
+	Username string `yaml:""`
+	Password string `yaml:""`
+}
+
 type TLS struct {
 	Enable      bool   `yaml:""`
 	ServerName  string `yaml:""`
@@ -3,11 +3,15 @@ package dialer
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 
 	"github.com/xmapst/lightsocks/internal/resolver"
 )
 
+// ErrResolve 连接前解析目标域名失败
+var ErrResolve = errors.New("resolve failed")
+
 func DialContext(ctx context.Context, network, address string, options ...Option) (net.Conn, error) {
 	switch network {
 	case "tcp4", "tcp6", "udp4", "udp6":
@@ -24,7 +28,7 @@ func DialContext(ctx context.Context, network, address string, options ...Option
 			ip, err = resolver.ResolveIPv6(host)
 		}
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%w: %w", ErrResolve, err)
 		}
 
 		return dialContext(ctx, network, ip, port, options)
@@ -35,6 +39,35 @@ func DialContext(ctx context.Context, network, address string, options ...Option
 	}
 }
 
+func ListenPacket(ctx context.Context, network, address string, options ...Option) (net.PacketConn, error) {
+	opt := &option{
+		interfaceName: DefaultInterface.Load(),
+		routingMark:   int(DefaultRoutingMark.Load()),
+	}
+
+	for _, o := range DefaultOptions {
+		o(opt)
+	}
+
+	for _, o := range options {
+		o(opt)
+	}
+
+	lc := &net.ListenConfig{}
+	if opt.interfaceName != "" {
+		addr, err := bindIfaceToListenConfig(opt.interfaceName, lc, network, address)
+		if err != nil {
+			return nil, err
+		}
+		address = addr
+	}
+	if opt.routingMark != 0 {
+		bindMarkToListenConfig(opt.routingMark, lc, network, address)
+	}
+
+	return lc.ListenPacket(ctx, network, address)
+}
+
 func dialContext(ctx context.Context, network string, destination net.IP, port string, options []Option) (net.Conn, error) {
 	opt := &option{
 		interfaceName: DefaultInterface.Load(),
@@ -103,6 +136,7 @@ func dualStackDialContext(ctx context.Context, network, address string, options
 			ip, result.error = resolver.ResolveIPv4(host)
 		}
 		if result.error != nil {
+			result.error = fmt.Errorf("%w: %w", ErrResolve, result.error)
 			return
 		}
 		result.resolved = true
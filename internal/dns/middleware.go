@@ -0,0 +1,159 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	D "github.com/miekg/dns"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/trie"
+)
+
+type handler func(ctx context.Context, r *D.Msg) (*D.Msg, error)
+type middleware func(next handler) handler
+
+// withHosts 命中 resolver.DefaultHosts 的 A/AAAA 请求直接应答
+func withHosts() middleware {
+	return func(next handler) handler {
+		return func(ctx context.Context, r *D.Msg) (*D.Msg, error) {
+			q := r.Question[0]
+			if !isIPRequest(q) {
+				return next(ctx, r)
+			}
+
+			node := resolver.DefaultHosts.Search(strings.TrimRight(q.Name, "."))
+			if node == nil {
+				return next(ctx, r)
+			}
+			ip := node.Data.(net.IP)
+
+			msg := r.Copy()
+			var rr D.RR
+			if v4 := ip.To4(); v4 != nil && q.Qtype == D.TypeA {
+				rr = &D.A{
+					Hdr: D.RR_Header{Name: q.Name, Rrtype: D.TypeA, Class: D.ClassINET, Ttl: hostsTTL},
+					A:   v4,
+				}
+			} else if v4 == nil && q.Qtype == D.TypeAAAA {
+				rr = &D.AAAA{
+					Hdr:  D.RR_Header{Name: q.Name, Rrtype: D.TypeAAAA, Class: D.ClassINET, Ttl: hostsTTL},
+					AAAA: ip,
+				}
+			} else {
+				return next(ctx, r)
+			}
+			msg.Answer = []D.RR{rr}
+			msg.SetRcode(r, D.RcodeSuccess)
+			msg.Authoritative = true
+			msg.RecursionAvailable = true
+			return msg, nil
+		}
+	}
+}
+
+// withFilterAAAA AAAA 请求返回空应答, 使客户端只使用ipv4
+func withFilterAAAA() middleware {
+	return func(next handler) handler {
+		return func(ctx context.Context, r *D.Msg) (*D.Msg, error) {
+			if r.Question[0].Qtype != D.TypeAAAA {
+				return next(ctx, r)
+			}
+			msg := &D.Msg{}
+			msg.SetRcode(r, D.RcodeSuccess)
+			msg.RecursionAvailable = true
+			return msg, nil
+		}
+	}
+}
+
+// withMinTTL 应答中小于 ttl 的记录按 ttl 返回
+func withMinTTL(ttl uint32) middleware {
+	return func(next handler) handler {
+		return func(ctx context.Context, r *D.Msg) (*D.Msg, error) {
+			msg, err := next(ctx, r)
+			if err != nil {
+				return nil, err
+			}
+			for _, rrs := range [][]D.RR{msg.Answer, msg.Ns, msg.Extra} {
+				for _, rr := range rrs {
+					if h := rr.Header(); h.Rrtype != D.TypeOPT && h.Ttl < ttl {
+						h.Ttl = ttl
+					}
+				}
+			}
+			return msg, nil
+		}
+	}
+}
+
+// withFakeIP A 请求从虚假ip池分配地址, AAAA 请求返回空应答,
+// 命中 filter 的域名返回真实应答
+func withFakeIP(filter *trie.DomainTrie) middleware {
+	return func(next handler) handler {
+		return func(ctx context.Context, r *D.Msg) (*D.Msg, error) {
+			q := r.Question[0]
+			pool := resolver.DefaultFakeIPPool
+			if pool == nil || !isIPRequest(q) {
+				return next(ctx, r)
+			}
+			host := strings.TrimRight(q.Name, ".")
+			if filter != nil && filter.Search(host) != nil {
+				return next(ctx, r)
+			}
+
+			msg := &D.Msg{}
+			msg.SetRcode(r, D.RcodeSuccess)
+			msg.Authoritative = true
+			msg.RecursionAvailable = true
+			if q.Qtype == D.TypeA {
+				msg.Answer = []D.RR{&D.A{
+					Hdr: D.RR_Header{Name: q.Name, Rrtype: D.TypeA, Class: D.ClassINET, Ttl: fakeIPTTL},
+					A:   pool.Lookup(host),
+				}}
+			}
+			return msg, nil
+		}
+	}
+}
+
+// withResolver 由 resolver.DefaultResolver 查询, 带缓存
+func withResolver() handler {
+	return func(ctx context.Context, r *D.Msg) (*D.Msg, error) {
+		if resolver.DefaultResolver == nil {
+			return nil, errors.New("DNS section is disabled")
+		}
+		msg, err := resolver.DefaultResolver.ExchangeContext(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		msg.SetRcode(r, msg.Rcode)
+		msg.Authoritative = true
+		return msg, nil
+	}
+}
+
+func compose(middlewares []middleware, endpoint handler) handler {
+	h := endpoint
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+func newFakeIPHandler(filter *trie.DomainTrie) handler {
+	return compose([]middleware{withHosts(), withFakeIP(filter)}, withResolver())
+}
+
+func newHandler(opt ServerOption) handler {
+	var middlewares []middleware
+	if opt.MinTTL > 0 {
+		middlewares = append(middlewares, withMinTTL(opt.MinTTL))
+	}
+	middlewares = append(middlewares, withHosts())
+	if opt.FilterAAAA {
+		middlewares = append(middlewares, withFilterAAAA())
+	}
+	return compose(middlewares, withResolver())
+}
@@ -0,0 +1,163 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	D "github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/trie"
+)
+
+const (
+	hostsTTL  = 10
+	fakeIPTTL = 1
+)
+
+var (
+	server       = &listener{name: "DNS"}
+	fakeIPServer = &listener{name: "FakeIP DNS"}
+)
+
+type ServerOption struct {
+	FilterAAAA bool   // 过滤AAAA记录
+	MinTTL     uint32 // 最小TTL(秒)
+}
+
+// Server 同时提供UDP及TCP的DNS服务, UDP应答超出客户端缓冲区时截断, 客户端可改用TCP重试
+type Server struct {
+	mu      sync.RWMutex
+	handler handler
+	udp     *D.Server
+	tcp     *D.Server
+}
+
+// ServeDNS implement D.Handler ServeDNS
+func (s *Server) ServeDNS(w D.ResponseWriter, r *D.Msg) {
+	if len(r.Question) == 0 {
+		D.HandleFailed(w, r)
+		return
+	}
+	s.mu.RLock()
+	h := s.handler
+	s.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolver.DefaultDNSTimeout)
+	defer cancel()
+	msg, err := h(ctx, r)
+	if err != nil {
+		logrus.Debugln("[DNS]", w.RemoteAddr(), r.Question[0].String(), err)
+		D.HandleFailed(w, r)
+		return
+	}
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		msg.Truncate(udpSize(r))
+	} else {
+		msg.Compress = true
+	}
+	_ = w.WriteMsg(msg)
+}
+
+func (s *Server) setHandler(h handler) {
+	s.mu.Lock()
+	s.handler = h
+	s.mu.Unlock()
+}
+
+func (s *Server) shutdown() {
+	if s.udp != nil {
+		_ = s.udp.Shutdown()
+	}
+	if s.tcp != nil {
+		_ = s.tcp.Shutdown()
+	}
+}
+
+// udpSize 客户端声明的EDNS0缓冲区大小, 未声明时为512
+func udpSize(r *D.Msg) int {
+	size := D.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	return size
+}
+
+// listener 管理一个DNS服务的监听地址
+type listener struct {
+	name   string
+	mu     sync.Mutex
+	addr   string
+	server *Server
+}
+
+// recreate 地址未变化时只替换处理函数, 否则重新监听, 地址为空时关闭
+func (l *listener) recreate(addr string, h handler, withTCP bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if addr == l.addr && l.server != nil {
+		l.server.setHandler(h)
+		return nil
+	}
+
+	if l.server != nil {
+		l.server.shutdown()
+		l.server = nil
+	}
+	l.addr = ""
+	if addr == "" {
+		return nil
+	}
+
+	s := &Server{handler: h}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	s.udp = &D.Server{PacketConn: pc, Handler: s}
+	if withTCP {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			_ = pc.Close()
+			return err
+		}
+		s.tcp = &D.Server{Listener: ln, Handler: s}
+	}
+	for _, srv := range []*D.Server{s.udp, s.tcp} {
+		if srv == nil {
+			continue
+		}
+		go func(srv *D.Server) {
+			_ = srv.ActivateAndServe()
+		}(srv)
+	}
+	l.addr = addr
+	l.server = s
+	logrus.Infoln(l.name, "Server Listening At:", addr)
+	return nil
+}
+
+// ReCreateServer 地址变化时重新监听, 地址为空时关闭DNS服务
+func ReCreateServer(addr string, opt ServerOption) error {
+	return server.recreate(addr, newHandler(opt), true)
+}
+
+// Shutdown 关闭DNS服务及 fake-ip 的DNS服务
+func Shutdown() {
+	for _, l := range []*listener{server, fakeIPServer} {
+		l.mu.Lock()
+		if l.server != nil {
+			l.server.shutdown()
+			l.server = nil
+		}
+		l.addr = ""
+		l.mu.Unlock()
+	}
+}
+
+// ReCreateFakeIPServer fake-ip 的DNS服务只监听UDP, filter 中的域名返回真实应答
+func ReCreateFakeIPServer(addr string, filter *trie.DomainTrie) error {
+	return fakeIPServer.recreate(addr, newFakeIPHandler(filter), false)
+}
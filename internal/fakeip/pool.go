@@ -0,0 +1,122 @@
+package fakeip
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/xmapst/lightsocks/internal/cache"
+)
+
+var errIPNet = errors.New("ipnet don't have valid ip")
+
+// Pool 从网段中为域名分配虚假ip, 映射保存在有界的LRU缓存中,
+// 每个映射只有一项, 以ip为键, 淘汰时同时删除域名的索引,
+// 地址用尽后循环复用最早分配的ip
+type Pool struct {
+	min    uint32
+	max    uint32
+	offset uint32
+	mu     sync.Mutex
+	cache  *cache.LruCache   // ip -> 域名
+	hosts  map[string]uint32 // 域名 -> ip
+	ipnet  *net.IPNet
+}
+
+// Lookup 返回域名对应的虚假ip, 没有时分配一个
+func (p *Pool) Lookup(host string) net.IP {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, exist := p.hosts[host]; exist {
+		// 刷新映射, 避免被先行淘汰
+		p.cache.Get(ip)
+		return uintToIP(ip)
+	}
+
+	ip := p.get()
+	p.cache.Set(ip, host)
+	p.hosts[host] = ip
+	return uintToIP(ip)
+}
+
+// LookBack 返回虚假ip对应的域名
+func (p *Pool) LookBack(ip net.IP) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if ip = ip.To4(); ip == nil {
+		return "", false
+	}
+	elm, exist := p.cache.Get(ipToUint(ip))
+	if !exist {
+		return "", false
+	}
+	return elm.(string), true
+}
+
+// Exist 是否为该网段内的ip
+func (p *Pool) Exist(ip net.IP) bool {
+	return p.ipnet.Contains(ip)
+}
+
+// IPNet return raw ipnet
+func (p *Pool) IPNet() *net.IPNet {
+	return p.ipnet
+}
+
+func (p *Pool) get() uint32 {
+	p.offset = (p.offset + 1) % (p.max - p.min)
+	ip := p.min + p.offset
+	// 回收该ip之前分配给其他域名的映射
+	p.cache.Delete(ip)
+	return ip
+}
+
+// evict 映射被淘汰或回收时删除域名的索引, 调用时已持有 mu
+func (p *Pool) evict(key, value any) {
+	host := value.(string)
+	if p.hosts[host] == key.(uint32) {
+		delete(p.hosts, host)
+	}
+}
+
+func ipToUint(ip net.IP) uint32 {
+	v := uint32(ip[0]) << 24
+	v += uint32(ip[1]) << 16
+	v += uint32(ip[2]) << 8
+	v += uint32(ip[3])
+	return v
+}
+
+func uintToIP(v uint32) net.IP {
+	return net.IP{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// New 创建虚假ip池, 跳过网段的网络地址及广播地址,
+// size 为最多保存的映射数量, 为0时与网段大小相同
+func New(ipnet *net.IPNet, size int) (*Pool, error) {
+	if ipnet.IP.To4() == nil {
+		return nil, errIPNet
+	}
+	ones, bits := ipnet.Mask.Size()
+	total := 1<<uint(bits-ones) - 2
+	if total <= 0 {
+		return nil, errIPNet
+	}
+	if size <= 0 || size > total {
+		size = total
+	}
+
+	min := ipToUint(ipnet.IP.To4()) + 1
+	p := &Pool{
+		min:   min,
+		max:   min + uint32(total),
+		hosts: make(map[string]uint32, size),
+		ipnet: ipnet,
+	}
+	p.cache = cache.New(cache.WithSize(size), cache.WithEvict(p.evict))
+	return p, nil
+}
@@ -1,4 +1,27 @@
 package http
 
-const ProxyAuthorization = "Proxy-Authorization: Basic "
-const HTTPCONNECT = "CONNECT"
+import "time"
+
+// hopHeaders 逐跳的请求头, 转发时删除, Connection 中列出的请求头同样删除
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+const (
+	// idleTimeout 未配置超时时 keep-alive 连接等待下一个请求的时间
+	idleTimeout = 90 * time.Second
+	// expectTimeout 请求带 Expect: 100-continue 时等待目标返回 100 的时间, 超时后直接发送请求体
+	expectTimeout = time.Second
+	// drainTimeout 写回响应后等待转发请求体结束的时间, 超时后关闭连接
+	drainTimeout = 5 * time.Second
+	// maxDrain 目标提前响应时读取剩余请求体的最大字节数, 超过后关闭连接
+	maxDrain = 256 << 10
+)
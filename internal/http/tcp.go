@@ -2,27 +2,36 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
+	"net/http"
+	"net/textproto"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
 	N "github.com/xmapst/lightsocks/internal/net"
+	"go.uber.org/atomic"
 )
 
+var ErrBadRequest = errors.New("bad request")
+
 type Proxy struct {
-	id     uuid.UUID
-	wg     *sync.WaitGroup
-	conn   net.Conn
-	server *constant.Server
+	id        uuid.UUID
+	wg        *sync.WaitGroup
+	conn      *N.BufferedConn
+	server    *constant.Server
+	tcpIn     chan<- *constant.TCPContext
+	transport *http.Transport
+	Auth      auth.Authenticator
 }
 
 func (p *Proxy) srcAddr() string {
@@ -32,155 +41,171 @@ func (p *Proxy) srcAddr() string {
 func (p *Proxy) New(wg *sync.WaitGroup, conf *constant.Server, uuid uuid.UUID, conn net.Conn) error {
 	p.wg = wg
 	p.id = uuid
-	p.conn = conn
+	p.conn = N.NewBufferedConn(conn)
 	p.server = conf
 	return nil
 }
 
+// Handle 循环读取请求, CONNECT 及协议升级请求接管整个连接,
+// 其它请求按各自的目标地址转发, keep-alive 连接的每个请求可以访问不同的目标
 func (p *Proxy) Handle(tcpIn chan<- *constant.TCPContext) error {
-	lines, err := p.readString("\r\n")
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	if len(lines) < 2 {
-		logrus.Errorln(p.id, p.srcAddr(), "request line error")
-		return errors.New("request line error")
+	p.tcpIn = tcpIn
+	p.transport = &http.Transport{
+		DialContext:           p.dial,
+		DisableCompression:    true,
+		IdleConnTimeout:       idleTimeout,
+		ExpectContinueTimeout: expectTimeout,
 	}
-	err = p.handshake(lines)
-	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
-		return err
-	}
-	return p.processRequest(lines, tcpIn)
-}
+	defer p.transport.CloseIdleConnections()
 
-func (p *Proxy) handshake(lines []string) (err error) {
-	var user, pass string
-	for _, line := range lines {
-		// get username/password
-		if strings.HasPrefix(line, ProxyAuthorization) {
-			line = strings.TrimPrefix(line, ProxyAuthorization)
-			bs, err := base64.StdEncoding.DecodeString(line)
-			if err != nil {
-				logrus.Errorln(p.id, p.srcAddr(), err)
-				continue
-			}
-			if bs == nil {
-				continue
+	trusted := p.Auth == nil
+	for first := true; ; first = false {
+		if !first {
+			timeout := p.server.Timeout
+			if timeout <= 0 {
+				timeout = idleTimeout
 			}
-			_auth := bytes.Split(bs, []byte(":"))
-			if len(_auth) < 2 {
-				continue
+			_ = p.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		req, err := http.ReadRequest(p.conn.Reader())
+		if err != nil {
+			if first {
+				// 由调用方记录日志并关闭连接
+				return err
 			}
-			user, pass = string(_auth[0]), string(bytes.Join(_auth[1:], []byte(":")))
+			break
 		}
-	}
+		_ = p.conn.SetDeadline(time.Time{})
 
-	// TODO: VerifyUser
-	logrus.Debugln(p.id, p.srcAddr(), user, pass)
-	return
-}
-
-func (p *Proxy) processRequest(lines []string, tcpIn chan<- *constant.TCPContext) error {
-	requestLine := strings.Split(lines[0], " ")
-	if len(requestLine) < 3 {
-		logrus.Errorln(p.id, p.srcAddr(), "request line error")
-		return N.NotFoundResponse().Write(p.conn)
-	}
-	method := requestLine[0]
-	requestTarget := requestLine[1]
-	version := requestLine[2]
-	var err error
-	if method == HTTPCONNECT {
-		shp := strings.Split(requestTarget, ":")
-		addr := shp[0]
-		port, _ := strconv.Atoi(shp[1])
-		err = p.handleHTTPConnectMethod(addr, uint16(port), tcpIn)
-	} else {
-		si := strings.Index(requestTarget, "//")
-		restUrl := requestTarget[si+2:]
-		if restUrl == "" {
-			return N.NotFoundResponse().Write(p.conn)
+		if !trusted {
+			if !p.authenticate(req) {
+				_ = authenticateResponse().Write(p.conn)
+				break
+			}
+			trusted = true
 		}
-		port := 80
-		ei := strings.Index(restUrl, "/")
-		url := "/"
-		hostPort := restUrl
-		if ei != -1 {
-			hostPort = restUrl[:ei]
-			url = restUrl[ei:]
+		if req.Method == http.MethodConnect {
+			return p.handleConnect(req)
 		}
-		as := strings.Split(hostPort, ":")
-		addr := as[0]
-		if len(as) == 2 {
-			port, _ = strconv.Atoi(as[1])
+		if req.URL.Host == "" {
+			// 直接访问代理端口的请求
+			logrus.Errorln(p.id, p.srcAddr(), ErrBadRequest, req.RequestURI)
+			_ = responseWith(req, http.StatusBadRequest).Write(p.conn)
+			break
 		}
-		var header string
-		for _, line := range lines[1:] {
-			if strings.HasPrefix(line, ProxyAuthorization) {
-				continue
-			}
-			if strings.HasPrefix(line, "Proxy-") {
-				line = strings.TrimPrefix(line, "Proxy-")
-			}
-			header += fmt.Sprintf("%s\r\n", line)
+		if isUpgrade(req) {
+			return p.handleUpgrade(req)
+		}
+		if !p.handleRequest(req) {
+			break
 		}
-		newline := method + " " + url + " " + version + "\r\n" + header
-		err = p.handleHTTPProxy(addr, uint16(port), newline, tcpIn)
 	}
-	return err
+	p.wg.Done()
+	_ = p.conn.Close()
+	return nil
 }
 
-func (p *Proxy) httpWriteProxyHeader() {
-	_, err := p.conn.Write([]byte("HTTP/1.1 200 OK Connection Established\r\n"))
-	if err != nil {
-		logrus.Warnln(p.id, p.srcAddr(), err)
-		return
+func (p *Proxy) authenticate(req *http.Request) bool {
+	user, pass, _ := parseBasicAuth(req.Header.Get("Proxy-Authorization"))
+	if !p.Auth.Verify(user, pass) {
+		logrus.Errorln(p.id, p.srcAddr(), "proxy authentication required")
+		return false
 	}
+	logrus.Debugln(p.id, p.srcAddr(), user, "authenticated")
+	return true
+}
 
-	_, err = p.conn.Write([]byte(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123))))
-	if err != nil {
-		logrus.Warnln(p.id, p.srcAddr(), err)
+func parseBasicAuth(auth string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
 		return
 	}
-	_, err = p.conn.Write([]byte("Transfer-Encoding: chunked\r\n"))
+	bs, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
 	if err != nil {
-		logrus.Warnln(p.id, p.srcAddr(), err)
 		return
 	}
-	_, err = p.conn.Write([]byte("\r\n"))
-	if err != nil {
-		logrus.Warnln(p.id, p.srcAddr(), err)
-		return
+	return strings.Cut(string(bs), ":")
+}
+
+func authenticateResponse() *http.Response {
+	header := make(http.Header)
+	header.Set("Proxy-Authenticate", `Basic realm="lightsocks"`)
+	header.Set("Connection", "close")
+	header.Set("Date", time.Now().Format(time.RFC1123))
+	return &http.Response{
+		Status:        "407 Proxy Authentication Required",
+		StatusCode:    http.StatusProxyAuthRequired,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Close:         true,
 	}
 }
 
-func (p *Proxy) handleHTTPConnectMethod(addr string, port uint16, tcpIn chan<- *constant.TCPContext) error {
-	targetAddr := fmt.Sprintf("%s:%d", addr, port)
-	client, err := constant.UnmarshalIP(p.srcAddr())
+func responseWith(req *http.Request, statusCode int) *http.Response {
+	header := make(http.Header)
+	header.Set("Date", time.Now().Format(time.RFC1123))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        header,
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Request:       req,
+	}
+}
+
+// handleConnect 连接目标成功后返回 200, 之后的数据原样转发
+func (p *Proxy) handleConnect(req *http.Request) error {
+	metadata, err := p.metadata(p.id, constant.HTTPS, req.URL.Host)
 	if err != nil {
+		_ = responseWith(req, http.StatusBadRequest).Write(p.conn)
 		return err
 	}
-	source, err := constant.UnmarshalIP(p.conn.LocalAddr().String())
+	p.tcpIn <- &constant.TCPContext{
+		SrcConn:  p.conn,
+		Metadata: metadata,
+		PreFn: func(net.Addr) {
+			// 兼容 HTTP/1.0 的客户端, 不使用 Response.Write
+			_, err := fmt.Fprintf(p.conn, "HTTP/%d.%d 200 Connection established\r\n\r\n", req.ProtoMajor, req.ProtoMinor)
+			if err != nil {
+				logrus.Warnln(p.id, p.srcAddr(), err)
+			}
+		},
+		FailFn: func(error) {
+			_ = responseWith(req, http.StatusBadGateway).Write(p.conn)
+		},
+		PostFn: func() {
+			p.wg.Done()
+		},
+	}
+	return nil
+}
+
+// handleUpgrade 协议升级(如websocket)后不再是HTTP, 请求头写入目标后接管整个连接
+func (p *Proxy) handleUpgrade(req *http.Request) error {
+	metadata, err := p.metadata(p.id, constant.HTTP, targetAddr(req))
 	if err != nil {
+		_ = responseWith(req, http.StatusBadRequest).Write(p.conn)
 		return err
 	}
-	target, err := constant.UnmarshalIP(targetAddr)
-	if err != nil {
+	req.Header.Del("Proxy-Authorization")
+	req.Header.Del("Proxy-Connection")
+	p.addForwarded(req)
+	line := new(bytes.Buffer)
+	if err = req.Write(line); err != nil {
 		return err
 	}
-	tcpIn <- &constant.TCPContext{
-		SrcConn: p.conn,
-		Metadata: &constant.Metadata{
-			ID:      p.id,
-			NetWork: constant.TCP,
-			Type:    constant.HTTPS,
-			Client:  client,
-			Source:  source,
-			Target:  target,
-		},
-		PreFn: p.httpWriteProxyHeader,
+	p.tcpIn <- &constant.TCPContext{
+		SrcConn:  p.conn,
+		Metadata: metadata,
+		Line:     line.String(),
 		PostFn: func() {
 			p.wg.Done()
 		},
@@ -188,45 +213,257 @@ func (p *Proxy) handleHTTPConnectMethod(addr string, port uint16, tcpIn chan<- *
 	return nil
 }
 
-// Subsequent request lines are full paths, some servers may have problems
-func (p *Proxy) handleHTTPProxy(addr string, port uint16, line string, tcpIn chan<- *constant.TCPContext) error {
-	targetAddr := fmt.Sprintf("%s:%d", addr, port)
+// handleRequest 转发一个普通请求并写回响应, 返回连接能否继续使用
+func (p *Proxy) handleRequest(req *http.Request) bool {
+	keepAlive := !req.Close
+	if v := req.Header.Get("Proxy-Connection"); v != "" {
+		keepAlive = strings.EqualFold(v, "keep-alive")
+	}
+	var expect *expectBody
+	if strings.EqualFold(req.Header.Get("Expect"), "100-continue") && req.ProtoAtLeast(1, 1) && req.Body != http.NoBody {
+		// 目标返回 100 或等待超时后读取请求体时才通知客户端发送
+		expect = &expectBody{ReadCloser: req.Body, conn: p.conn}
+		req.Body = expect
+	}
+	var body *requestBody
+	if req.Body != nil && req.Body != http.NoBody {
+		// Transport 可能在返回响应后仍在读取请求体, 读取下一个请求前需等待其结束
+		body = newRequestBody(req.Body)
+		req.Body = body
+	}
+	removeHopByHopHeaders(req.Header)
+	p.addForwarded(req)
+	req.RequestURI = ""
+
+	resp, err := p.transport.RoundTrip(req)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), "-->", req.URL.Host, err)
+		resp = responseWith(req, http.StatusBadGateway)
+		// 请求体可能只读取了一部分, 无法确定下一个请求的开始
+		keepAlive = false
+	}
+	if expect != nil && !expect.stop() {
+		// 客户端可能在超时后仍发送请求体, 无法区分下一个请求
+		keepAlive = false
+	}
+	removeHopByHopHeaders(resp.Header)
+	if p.server.HTTP.Via != "" {
+		resp.Header.Add("Via", fmt.Sprintf("%d.%d %s", resp.ProtoMajor, resp.ProtoMinor, p.server.HTTP.Via))
+	}
+	// 响应使用代理与客户端之间的协议版本
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if !req.ProtoAtLeast(1, 1) {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = req.Proto, req.ProtoMajor, req.ProtoMinor
+	}
+	if resp.ContentLength < 0 && !req.ProtoAtLeast(1, 1) {
+		// HTTP/1.0 不支持chunked, 以关闭连接结束响应
+		resp.TransferEncoding = nil
+		keepAlive = false
+	}
+	if keepAlive && !req.ProtoAtLeast(1, 1) {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+	resp.Close = !keepAlive
+	err = resp.Write(p.conn)
+	_ = resp.Body.Close()
+	if err != nil {
+		logrus.Warnln(p.id, p.srcAddr(), err)
+		return false
+	}
+	if keepAlive && body != nil && !body.finish() {
+		// 目标提前响应且剩余的请求体过大, 继续读取会把请求体当作下一个请求
+		return false
+	}
+	return keepAlive
+}
+
+// addForwarded 按入口配置添加 Via 及 X-Forwarded-For
+func (p *Proxy) addForwarded(req *http.Request) {
+	if p.server.HTTP.Via != "" {
+		req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, p.server.HTTP.Via))
+	}
+	if p.server.HTTP.XForwardedFor {
+		host, _, err := net.SplitHostPort(p.srcAddr())
+		if err == nil {
+			if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				host = strings.Join(prior, ", ") + ", " + host
+			}
+			req.Header.Set("X-Forwarded-For", host)
+		}
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		// 避免添加默认的 User-Agent
+		req.Header.Set("User-Agent", "")
+	}
+}
+
+// dial 普通请求每次连接目标时通过管道交给隧道, 按目标地址匹配规则
+func (p *Proxy) dial(_ context.Context, network, addr string) (net.Conn, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := p.metadata(id, constant.HTTP, addr)
+	if err != nil {
+		return nil, err
+	}
+	left, right := net.Pipe()
+	p.tcpIn <- &constant.TCPContext{
+		SrcConn:  right,
+		Metadata: metadata,
+	}
+	return left, nil
+}
+
+func (p *Proxy) metadata(id uuid.UUID, t constant.Type, addr string) (*constant.Metadata, error) {
 	client, err := constant.UnmarshalIP(p.srcAddr())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	source, err := constant.UnmarshalIP(p.conn.LocalAddr().String())
 	if err != nil {
-		return err
+		return nil, err
 	}
-	target, err := constant.UnmarshalIP(targetAddr)
+	target, err := constant.UnmarshalIP(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tcpIn <- &constant.TCPContext{
-		SrcConn: p.conn,
-		Metadata: &constant.Metadata{
-			ID:      p.id,
-			NetWork: constant.TCP,
-			Type:    constant.HTTP,
-			Client:  client,
-			Source:  source,
-			Target:  target,
-		},
-		Line: line,
-		PostFn: func() {
-			p.wg.Done()
-		},
+	return &constant.Metadata{
+		ID:      id,
+		NetWork: constant.TCP,
+		Type:    t,
+		Client:  client,
+		Source:  source,
+		Target:  target,
+		Inbound: p.server.Tag,
+	}, nil
+}
+
+// targetAddr 请求地址未指定端口时按协议补全
+func targetAddr(req *http.Request) string {
+	if req.URL.Port() != "" {
+		return req.URL.Host
+	}
+	port := "80"
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port)
+}
+
+func isUpgrade(req *http.Request) bool {
+	for _, v := range req.Header.Values("Connection") {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(s), "upgrade") {
+				return req.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, v := range header.Values("Connection") {
+		for _, s := range strings.Split(v, ",") {
+			if s = textproto.TrimString(s); s != "" {
+				header.Del(s)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+}
+
+// expectBody 首次读取请求体时向客户端返回 100 Continue
+type expectBody struct {
+	io.ReadCloser
+	conn    net.Conn
+	mu      sync.Mutex
+	sent    bool
+	stopped bool
+}
+
+func (b *expectBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	if !b.sent {
+		if b.stopped {
+			b.mu.Unlock()
+			return 0, io.ErrUnexpectedEOF
+		}
+		b.sent = true
+		if _, err := io.WriteString(b.conn, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			b.mu.Unlock()
+			return 0, err
+		}
+	}
+	b.mu.Unlock()
+	return b.ReadCloser.Read(p)
+}
+
+// Close 未通知客户端时不读取剩余的请求体, 连接随后关闭
+func (b *expectBody) Close() error {
+	b.mu.Lock()
+	sent := b.sent
+	b.mu.Unlock()
+	if !sent {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// stop 收到响应后不再通知客户端, 避免与响应同时写入, 返回是否已通知
+func (b *expectBody) stop() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.stopped = true
+	return b.sent
+}
+
+// requestBody 记录请求体是否已读取完, Transport 关闭请求体后才可以读取下一个请求
+type requestBody struct {
+	io.ReadCloser
+	eof    *atomic.Bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRequestBody(rc io.ReadCloser) *requestBody {
+	return &requestBody{
+		ReadCloser: rc,
+		eof:        atomic.NewBool(false),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof.Store(true)
 	}
+	return n, err
+}
+
+// Close 只通知 Transport 不再读取, 剩余的请求体由 finish 处理
+func (b *requestBody) Close() error {
+	b.once.Do(func() {
+		close(b.closed)
+	})
 	return nil
 }
 
-func (p *Proxy) readString(delim string) ([]string, error) {
-	var buf = make([]byte, 4096)
-	_, err := io.ReadAtLeast(p.conn, buf, 1)
-	if err != nil && err != io.EOF {
-		logrus.Errorln(p.id, p.srcAddr(), err.Error())
-		return nil, err
+// finish 等待 Transport 不再读取请求体, 读取有限的剩余部分, 返回连接能否继续读取下一个请求
+func (b *requestBody) finish() bool {
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-b.closed:
+	case <-timer.C:
+		return false
+	}
+	if b.eof.Load() {
+		return true
 	}
-	return strings.Split(string(buf), delim), nil
+	_, err := io.CopyN(io.Discard, b, maxDrain+1)
+	return err == io.EOF
 }
@@ -0,0 +1,53 @@
+package lightsocks
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/cache"
+)
+
+const (
+	// replayWindow 允许的客户端与服务端时间差
+	replayWindow = 120 * time.Second
+	// replayCacheSize 记录的nonce数量上限, nonce 保留两倍窗口, 即平均每秒约546次握手,
+	// 超出后拒绝新的握手直到最早的nonce过期, 不淘汰仍在窗口内的nonce
+	replayCacheSize = 1 << 17
+)
+
+var (
+	errStaleHeader    = errors.New("stale header timestamp")
+	errReplayedHeader = errors.New("replayed header nonce")
+	errReplayFull     = errors.New("too many handshakes in replay window")
+)
+
+// replayFilter 在时间窗口内拒绝重复的握手nonce
+type replayFilter struct {
+	mu    sync.Mutex
+	cache *cache.LruCache
+}
+
+func newReplayFilter() *replayFilter {
+	return &replayFilter{
+		// 时间戳在 ±replayWindow 内有效, nonce 至少需要保留两倍窗口
+		cache: cache.New(cache.WithAge(int64(2 * replayWindow / time.Second))),
+	}
+}
+
+func (f *replayFilter) Check(timestamp time.Time, nonce []byte) error {
+	if diff := time.Since(timestamp); diff > replayWindow || diff < -replayWindow {
+		return errStaleHeader
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := string(nonce)
+	if _, ok := f.cache.Get(key); ok {
+		return errReplayedHeader
+	}
+	if f.cache.Len() >= replayCacheSize {
+		return errReplayFull
+	}
+	f.cache.Set(key, struct{}{})
+	return nil
+}
@@ -1,82 +1,298 @@
 package lightsocks
 
 import (
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/refraction-networking/utls"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
 	N "github.com/xmapst/lightsocks/internal/net"
 	"github.com/xmapst/lightsocks/internal/protocol"
 	"github.com/xmapst/lightsocks/internal/resolver"
 )
 
+var defaultReplayFilter = newReplayFilter()
+
+var errProbe = errors.New("not a lightsocks handshake")
+
 type Server struct {
 	Config *constant.Server
-	TcpIn  chan<- *constant.TCPContext
+	Cipher cipher.Cipher
+	// Users 不为空时按握手携带的token标识确定客户端凭据, 不使用 Cipher
+	Users *cipher.Users
+	// Transport 不为空时同一端口同时接受 ws 或 h2 传输
+	Transport *N.TransportServer
+	// Padding 发送数据帧的填充方案
+	Padding *protocol.Padding
+	// Compression 允许的压缩算法, 为空时允许全部
+	Compression []compress.Codec
+	TcpIn       chan<- *constant.TCPContext
+}
+
+// NewUsers 解析入口配置的客户端凭据, token 为入口的 Token, 客户端以此加密token标识
+func NewUsers(method, token string, keys []constant.Key) (*cipher.Users, error) {
+	users := make([]cipher.User, 0, len(keys))
+	for _, k := range keys {
+		users = append(users, cipher.User{
+			Name:     k.Name,
+			Token:    k.Token,
+			Disabled: k.Disabled,
+			Expire:   k.Expire,
+		})
+	}
+	return cipher.NewUsers(method, token, users)
 }
 
 func (s *Server) Handler(wg *sync.WaitGroup, conn net.Conn) {
 	wg.Add(1)
-	var err error
-	defer func() {
-		if err != nil {
-			_ = N.NotFoundResponse().Write(conn)
-			wg.Done()
-			_ = conn.Close()
-		}
-	}()
-
+	if s.Config.Timeout > 0 {
+		// 握手超时, 进入转发时清除
+		_ = conn.SetDeadline(time.Now().Add(s.Config.Timeout))
+	}
+	var rec *N.RecordConn
+	if s.Config.Fallback != "" {
+		rec = N.NewRecordConn(conn)
+		conn = rec
+	}
 	if s.Config.TLS.Enable {
 		tlsConn := tls.Server(conn, s.Config.TLSConf)
-		err = tlsConn.Handshake()
+		err := tlsConn.Handshake()
 		if err != nil {
 			logrus.Errorln(conn.RemoteAddr(), err)
+			if rec != nil && !rec.IsHTTP() {
+				// 回落地址接收解密后的明文, 只回落误发到TLS端口的明文HTTP请求
+				rec.Stop()
+			}
+			s.reject(wg, conn, rec)
 			return
 		}
 		conn = tlsConn
+		if rec != nil {
+			// 回落时转发解密后的数据
+			rec.Stop()
+			rec = N.NewRecordConn(conn)
+			conn = rec
+		}
+	}
+	if s.Transport != nil {
+		bufConn := N.NewBufferedConn(conn)
+		if s.Transport.Match(bufConn) {
+			if rec != nil {
+				rec.Stop()
+			}
+			// ws 连接及 h2 的每个流作为独立的连接处理
+			_ = conn.SetDeadline(time.Time{})
+			s.Transport.Serve(bufConn, func(c net.Conn) {
+				wg.Add(1)
+				if s.Config.Timeout > 0 {
+					_ = c.SetDeadline(time.Now().Add(s.Config.Timeout))
+				}
+				if err := s.serve(wg, c, nil); err != nil {
+					s.reject(wg, c, nil)
+				}
+			})
+			wg.Done()
+			return
+		}
+		conn = bufConn
+	}
+	if err := s.serve(wg, conn, rec); err != nil {
+		s.reject(wg, conn, rec)
 	}
+}
 
-	srcConn := N.NewBufferedConn(conn)
-	metadata, err := s.getHeader(srcConn)
+// reject 握手失败, 配置了回落地址时转发已读取的数据及之后的连接, 否则返回伪装页面
+func (s *Server) reject(wg *sync.WaitGroup, conn net.Conn, rec *N.RecordConn) {
+	defer func() {
+		wg.Done()
+		_ = conn.Close()
+	}()
+	if rec == nil || !rec.Recording() {
+		// 已通过认证的客户端及超出记录长度的连接不回落
+		_ = N.NotFoundResponse().Write(conn)
+		return
+	}
+	err := rec.Fallback(s.Config.Fallback, s.Config.Timeout)
 	if err != nil {
-		if err != io.EOF {
-			logrus.Errorln(conn.RemoteAddr(), err)
+		logrus.Errorln(conn.RemoteAddr(), "fallback", err)
+	}
+}
+
+// serve 处理lightsocks握手, 调用前需 wg.Add(1), 返回错误时由调用方关闭连接
+func (s *Server) serve(wg *sync.WaitGroup, conn net.Conn, rec *N.RecordConn) (err error) {
+	ciph := s.Cipher
+	var session *cipher.Session
+	if s.Users != nil {
+		session = s.Users.Session()
+		ciph = session
+	}
+	bufConn := N.NewBufferedConn(conn)
+	if rec != nil {
+		// 探测请求立即回落, 不等待握手超时
+		if err = probe(bufConn, ciph); err != nil {
+			if err != io.EOF {
+				logrus.Errorln(conn.RemoteAddr(), err)
+			}
+			return
 		}
-		return
 	}
-	err = s.checkHost(metadata.Target)
+	srcConn := N.NewSecureTCPConn(bufConn, ciph)
+	srcConn.SetPadding(s.Padding)
+	header, err := s.getHeader(srcConn)
 	if err != nil {
 		if err != io.EOF {
 			logrus.Errorln(conn.RemoteAddr(), err)
 		}
 		return
 	}
+	if rec != nil {
+		rec.Stop()
+	}
+	// 按客户端提议的顺序选择压缩算法并回复, 旧版客户端没有提议时不压缩
+	if err = srcConn.ReplyCodec(compress.Choose(header.Codecs, s.Compression)); err != nil {
+		logrus.Errorln(conn.RemoteAddr(), err)
+		return
+	}
+	var user string
+	untrack := func() {}
+	if session != nil {
+		user = session.User().Name
+		// 凭据停用, 过期或修改后关闭连接
+		untrack = defaultSessions.track(s.Config.Tag, session.User(), conn)
+		defer func() {
+			if err != nil {
+				untrack()
+			}
+		}()
+	}
+	switch header.Cmd {
+	case protocol.CmdMux:
+		_ = conn.SetDeadline(time.Time{})
+		s.serveMux(wg, srcConn, user)
+		untrack()
+		return nil
+	case protocol.CmdConnect:
+	default:
+		err = protocol.ErrInvalidHeader
+		logrus.Errorln(conn.RemoteAddr(), err)
+		return
+	}
+	metadata, err := s.parseMetadata(header.Metadata, conn.RemoteAddr(), user)
+	if err != nil {
+		logrus.Errorln(conn.RemoteAddr(), err)
+		return
+	}
 	s.TcpIn <- &constant.TCPContext{
 		SrcConn:  srcConn,
 		Metadata: metadata,
 		PostFn: func() {
+			untrack()
 			wg.Done()
 		},
 	}
+	return nil
+}
+
+// serveMux 接收多路复用会话中的流, 每个流作为一个独立的连接处理
+func (s *Server) serveMux(wg *sync.WaitGroup, conn *N.SecureTCPConn, user string) {
+	sess := mux.Server(conn, nil)
+	defer func() {
+		_ = sess.Close()
+		wg.Done()
+	}()
+	for {
+		stream, err := sess.AcceptStream()
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go s.handleStream(wg, stream, user)
+	}
+}
+
+func (s *Server) handleStream(wg *sync.WaitGroup, stream *mux.Stream, user string) {
+	payload, err := protocol.ReadStreamHeader(stream)
+	if err == nil {
+		var metadata *constant.Metadata
+		metadata, err = s.parseMetadata(payload, stream.RemoteAddr(), user)
+		if err == nil {
+			s.TcpIn <- &constant.TCPContext{
+				SrcConn:  stream,
+				Metadata: metadata,
+				PostFn: func() {
+					wg.Done()
+				},
+			}
+			return
+		}
+	}
+	if err != io.EOF {
+		logrus.Errorln(stream.RemoteAddr(), err)
+	}
+	_ = stream.Close()
+	wg.Done()
 }
 
-func (s *Server) getHeader(conn net.Conn) (*constant.Metadata, error) {
-	packet, err := protocol.ReadFull([]byte(s.Config.Token), conn)
+// probe 第一段数据不足握手长度或为HTTP请求时不是lightsocks客户端
+func probe(conn *N.BufferedConn, ciph cipher.Cipher) error {
+	head, err := N.Sniff(conn)
+	if err != nil {
+		return err
+	}
+	if len(head) < protocol.MinHandshake(ciph) || N.IsHTTP(head) {
+		return errProbe
+	}
+	return nil
+}
+
+func (s *Server) getHeader(conn *N.SecureTCPConn) (*protocol.Header, error) {
+	packet, err := conn.DecodeRead()
+	if err != nil {
+		return nil, err
+	}
+	if cipher.IsLegacy(s.Cipher) && protocol.IsLegacyHeader(packet.Payload) {
+		// 旧版客户端没有时间戳和nonce, 仅在迁移期间兼容
+		return &protocol.Header{
+			Cmd:      protocol.CmdConnect,
+			Metadata: string(packet.Payload),
+		}, nil
+	}
+	header, err := protocol.DecodeHeader(packet.Payload)
 	if err != nil {
 		return nil, err
 	}
-	metadata, err := constant.UnmarshalMetadata(string(packet.Payload))
+	// 重放或过期的握手与解密失败走同样的伪装响应
+	err = defaultReplayFilter.Check(header.Timestamp, header.Nonce)
 	if err != nil {
 		return nil, err
 	}
-	source, err := constant.UnmarshalIP(conn.RemoteAddr().String())
+	return header, nil
+}
+
+// parseMetadata user 为客户端凭据名称, 单token时为空
+func (s *Server) parseMetadata(payload string, remoteAddr net.Addr, user string) (*constant.Metadata, error) {
+	metadata, err := constant.UnmarshalMetadata(payload)
+	if err != nil {
+		return nil, err
+	}
+	source, err := constant.UnmarshalIP(remoteAddr.String())
 	if err != nil {
 		return nil, err
 	}
 	metadata.Source = source
+	metadata.Inbound = s.Config.Tag
+	metadata.User = user
+	err = s.checkHost(metadata.Target)
+	if err != nil {
+		return nil, err
+	}
 	return metadata, nil
 }
 
@@ -0,0 +1,90 @@
+package lightsocks
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/cipher"
+)
+
+var defaultSessions = newSessions()
+
+// sessions 按入口标签记录使用客户端凭据通过握手的连接, 凭据失效时关闭
+type sessions struct {
+	mu    sync.Mutex
+	conns map[string]map[*session]struct{}
+}
+
+// session 一个通过握手的连接, 凭据过期时由 timer 关闭
+type session struct {
+	conn  net.Conn
+	user  *cipher.User
+	timer *time.Timer
+}
+
+func newSessions() *sessions {
+	return &sessions{conns: make(map[string]map[*session]struct{})}
+}
+
+// track 记录连接直到返回的函数被调用, 凭据过期时关闭连接
+func (s *sessions) track(tag string, user *cipher.User, conn net.Conn) func() {
+	sess := &session{conn: conn, user: user}
+	s.mu.Lock()
+	if s.conns[tag] == nil {
+		s.conns[tag] = make(map[*session]struct{})
+	}
+	s.conns[tag][sess] = struct{}{}
+	sess.expireAt(user.Expire)
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.conns[tag], sess)
+		sess.stop()
+		s.mu.Unlock()
+	}
+}
+
+// Revoke 入口的凭据重新加载后, 关闭凭据已移除, 停用, 过期或修改了token的连接,
+// 其余连接按新的过期时间关闭, users 为nil时关闭该入口的全部连接
+func Revoke(tag string, users *cipher.Users) {
+	defaultSessions.revoke(tag, users)
+}
+
+func (s *sessions) revoke(tag string, users *cipher.Users) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for sess := range s.conns[tag] {
+		user := users.User(sess.user.Name)
+		if user != nil && user.Token == sess.user.Token && user.Valid() == nil {
+			sess.user = user
+			sess.expireAt(user.Expire)
+			continue
+		}
+		delete(s.conns[tag], sess)
+		sess.stop()
+		logrus.Warningln(sess.conn.RemoteAddr(), tag, sess.user.Name, "key revoked, close connection")
+		_ = sess.conn.Close()
+	}
+}
+
+// expireAt 重新设置过期时间, 零值表示不过期, 调用时需持有 sessions.mu
+func (sess *session) expireAt(expire time.Time) {
+	sess.stop()
+	if expire.IsZero() {
+		return
+	}
+	conn, name := sess.conn, sess.user.Name
+	sess.timer = time.AfterFunc(time.Until(expire), func() {
+		logrus.Warningln(conn.RemoteAddr(), name, cipher.ErrKeyExpired, "close connection")
+		_ = conn.Close()
+	})
+}
+
+func (sess *session) stop() {
+	if sess.timer != nil {
+		sess.timer.Stop()
+		sess.timer = nil
+	}
+}
@@ -0,0 +1,54 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket 令牌桶, 每秒补充 rate 个令牌, 最多积攒一秒的令牌
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewBucket(rate int64) *Bucket {
+	return &Bucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait 取出n个令牌, 不足时先透支, 等待补足后返回
+func (b *Bucket) Wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Size 单次读写的最大字节数, 避免一次透支过多
+func (b *Bucket) Size() int {
+	if b.rate < 1024 {
+		return 1024
+	}
+	return int(b.rate)
+}
+
+func (b *Bucket) Rate() int64 {
+	return int64(b.rate)
+}
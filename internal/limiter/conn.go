@@ -0,0 +1,123 @@
+package limiter
+
+import (
+	"io"
+	"net"
+)
+
+// conn 按限制项限速并统计流量, 读为下载, 写为上传
+type conn struct {
+	net.Conn
+	rule *Rule
+}
+
+// Conn 包装到目标的连接, 配额用完时连接被关闭
+func (r *Rule) Conn(c net.Conn) net.Conn {
+	lc := &conn{
+		Conn: c,
+		rule: r,
+	}
+	r.usage.join(lc)
+	return lc
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.rule.down != nil && len(b) > c.rule.down.Size() {
+		b = b[:c.rule.down.Size()]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.rule.down != nil {
+			c.rule.down.Wait(n)
+		}
+		c.rule.add(n)
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		p := b
+		if c.rule.up != nil {
+			if len(p) > c.rule.up.Size() {
+				p = p[:c.rule.up.Size()]
+			}
+			c.rule.up.Wait(len(p))
+		}
+		n, err := c.Conn.Write(p)
+		if n > 0 {
+			written += n
+			c.rule.add(n)
+		}
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom 转发到目标连接的 io.ReaderFrom, 隧道连接可以合并写入, 按读取的字节数限速
+func (c *conn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, &upReader{Reader: r, rule: c.rule})
+}
+
+// WriteTo 转发到目标连接的 io.WriterTo, 按写入的字节数限速
+func (c *conn) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(&downWriter{Writer: w, rule: c.rule}, c.Conn)
+}
+
+func (c *conn) Close() error {
+	c.rule.usage.leave(c)
+	return c.Conn.Close()
+}
+
+// upReader 读取即将写入目标的数据, 与 conn.Write 相同地限速
+type upReader struct {
+	io.Reader
+	rule *Rule
+}
+
+func (u *upReader) Read(b []byte) (int, error) {
+	if u.rule.up != nil && len(b) > u.rule.up.Size() {
+		b = b[:u.rule.up.Size()]
+	}
+	n, err := u.Reader.Read(b)
+	if n > 0 {
+		if u.rule.up != nil {
+			u.rule.up.Wait(n)
+		}
+		u.rule.add(n)
+	}
+	return n, err
+}
+
+// downWriter 写入从目标读取的数据, 与 conn.Read 相同地限速
+type downWriter struct {
+	io.Writer
+	rule *Rule
+}
+
+func (d *downWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		p := b
+		if d.rule.down != nil {
+			if len(p) > d.rule.down.Size() {
+				p = p[:d.rule.down.Size()]
+			}
+			d.rule.down.Wait(len(p))
+		}
+		n, err := d.Writer.Write(p)
+		if n > 0 {
+			written += n
+			d.rule.add(n)
+		}
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,242 @@
+package limiter
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+const (
+	Daily   = "daily"
+	Monthly = "monthly"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+var (
+	mu    sync.RWMutex
+	rules = make(map[string][]*Rule) // 入口标签 -> 限制项
+)
+
+// Rule 一个入口下同一地址或网段的客户端共享的限制
+type Rule struct {
+	Inbound string
+	Source  string
+	ipnet   *net.IPNet
+	up      *Bucket
+	down    *Bucket
+	quota   int64
+	period  string
+	usage   *usage
+}
+
+// Status 限制项的当前状态
+type Status struct {
+	Inbound     string `json:"Inbound"`
+	Source      string `json:"Source"`
+	Upload      int64  `json:"Upload"`
+	Download    int64  `json:"Download"`
+	Quota       int64  `json:"Quota"`
+	Period      string `json:"Period"`
+	Used        int64  `json:"Used"`
+	Connections int    `json:"Connections"`
+	Exceeded    bool   `json:"Exceeded"`
+}
+
+// New 解析入口的限制配置, 流量使用量按 入口标签/地址 保存, 重新加载后沿用
+func New(tag string, limits []constant.Limit) ([]*Rule, error) {
+	var result []*Rule
+	for idx, l := range limits {
+		r, err := newRule(tag, l)
+		if err != nil {
+			return nil, fmt.Errorf("Limits[%d] %s", idx, err.Error())
+		}
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func newRule(tag string, l constant.Limit) (*Rule, error) {
+	ipnet, err := parseSource(l.Source)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{
+		Inbound: tag,
+		Source:  l.Source,
+		ipnet:   ipnet,
+		period:  strings.ToLower(l.Period),
+	}
+	switch r.period {
+	case "":
+		r.period = Monthly
+	case Daily, Monthly:
+	default:
+		return nil, fmt.Errorf("unsupported period %s", l.Period)
+	}
+	if l.Upload != "" {
+		rate, err := ParseBytes(l.Upload)
+		if err != nil {
+			return nil, fmt.Errorf("Upload %s", err.Error())
+		}
+		r.up = NewBucket(rate)
+	}
+	if l.Download != "" {
+		rate, err := ParseBytes(l.Download)
+		if err != nil {
+			return nil, fmt.Errorf("Download %s", err.Error())
+		}
+		r.down = NewBucket(rate)
+	}
+	if l.Quota != "" {
+		r.quota, err = ParseBytes(l.Quota)
+		if err != nil {
+			return nil, fmt.Errorf("Quota %s", err.Error())
+		}
+	}
+	r.usage = getUsage(tag + "/" + l.Source)
+	return r, nil
+}
+
+func parseSource(source string) (*net.IPNet, error) {
+	if !strings.Contains(source, "/") {
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source %s", source)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source %s", source)
+	}
+	return ipnet, nil
+}
+
+// Update 替换全部入口的限制项, 已建立的连接继续使用创建时的限制项
+func Update(newRules map[string][]*Rule) {
+	mu.Lock()
+	rules = newRules
+	mu.Unlock()
+}
+
+// Match 按入口标签及客户端地址查找限制项, 没有限制时返回nil
+func Match(metadata *constant.Metadata) *Rule {
+	if metadata.Client == nil {
+		return nil
+	}
+	ip := net.ParseIP(metadata.Client.Addr)
+	if ip == nil {
+		return nil
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, r := range rules[metadata.Inbound] {
+		if r.ipnet.Contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Snapshot 返回全部限制项的当前状态
+func Snapshot() []Status {
+	mu.RLock()
+	defer mu.RUnlock()
+	tags := make([]string, 0, len(rules))
+	for tag := range rules {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	result := make([]Status, 0)
+	for _, tag := range tags {
+		for _, r := range rules[tag] {
+			result = append(result, r.status())
+		}
+	}
+	return result
+}
+
+func (r *Rule) status() Status {
+	s := Status{
+		Inbound: r.Inbound,
+		Source:  r.Source,
+		Quota:   r.quota,
+		Period:  r.period,
+	}
+	if r.up != nil {
+		s.Upload = r.up.Rate()
+	}
+	if r.down != nil {
+		s.Download = r.down.Rate()
+	}
+	s.Used, s.Connections = r.usage.load(r.periodID())
+	s.Exceeded = r.quota > 0 && s.Used >= r.quota
+	return s
+}
+
+// Exceeded 当前周期的流量已用完
+func (r *Rule) Exceeded() bool {
+	if r.quota <= 0 {
+		return false
+	}
+	used, _ := r.usage.load(r.periodID())
+	return used >= r.quota
+}
+
+// add 记录流量, 配额用完时关闭该限制项下的全部连接
+func (r *Rule) add(n int) {
+	used := r.usage.add(r.periodID(), int64(n))
+	if r.quota <= 0 || used < r.quota {
+		return
+	}
+	if closed := r.usage.closeAll(); closed > 0 {
+		logrus.Warningln(r.Inbound, r.Source, ErrQuotaExceeded, "close", closed, "connections")
+	}
+}
+
+func (r *Rule) periodID() string {
+	if r.period == Daily {
+		return time.Now().Format("2006-01-02")
+	}
+	return time.Now().Format("2006-01")
+}
+
+// ParseBytes 解析字节数, 支持 B, K(B), M(B), G(B), T(B) 单位, 按1024换算
+func ParseBytes(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(strings.TrimSuffix(str, "IB"), "B")
+	unit := int64(1)
+	if str != "" {
+		switch str[len(str)-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		case 'T':
+			unit = 1 << 40
+		}
+		if unit > 1 {
+			str = str[:len(str)-1]
+		}
+	}
+	num, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	return int64(num * float64(unit)), nil
+}
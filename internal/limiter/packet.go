@@ -0,0 +1,56 @@
+package limiter
+
+import "go.uber.org/atomic"
+
+// Packet 按限制项限速并统计 UDP 关联的流量, 为nil时不限制
+type Packet struct {
+	rule    *Rule
+	closeFn func()
+	closed  *atomic.Bool
+}
+
+// Packet 包装 UDP 关联, 配额用完时调用 closeFn 关闭关联
+func (r *Rule) Packet(closeFn func()) *Packet {
+	if r == nil {
+		return nil
+	}
+	p := &Packet{
+		rule:    r,
+		closeFn: closeFn,
+		closed:  atomic.NewBool(false),
+	}
+	r.usage.join(p)
+	return p
+}
+
+// Upload 发送一个数据包前调用, 超出速率时等待
+func (p *Packet) Upload(n int) {
+	if p == nil {
+		return
+	}
+	if p.rule.up != nil {
+		p.rule.up.Wait(n)
+	}
+	p.rule.add(n)
+}
+
+// Download 收到一个数据包后调用, 超出速率时等待
+func (p *Packet) Download(n int) {
+	if p == nil {
+		return
+	}
+	if p.rule.down != nil {
+		p.rule.down.Wait(n)
+	}
+	p.rule.add(n)
+}
+
+// Close 只在第一次调用时关闭关联, closeFn 中可以再次调用 Close
+func (p *Packet) Close() error {
+	if p == nil || !p.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	p.rule.usage.leave(p)
+	p.closeFn()
+	return nil
+}
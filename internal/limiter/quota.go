@@ -0,0 +1,156 @@
+package limiter
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// usage 一个限制项在当前周期内的流量, 重新加载配置后保留
+type usage struct {
+	mu     sync.Mutex
+	period string
+	used   int64
+	conns  map[io.Closer]struct{}
+}
+
+// record 保存到文件的流量使用量
+type record struct {
+	Period string `json:"Period"`
+	Used   int64  `json:"Used"`
+}
+
+var (
+	storeMu   sync.Mutex
+	storePath string
+	usages    = make(map[string]*usage)
+)
+
+func getUsage(key string) *usage {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	u, ok := usages[key]
+	if !ok {
+		u = &usage{}
+		usages[key] = u
+	}
+	return u
+}
+
+// roll 进入新的周期时清零, 调用前需持有锁
+func (u *usage) roll(period string) {
+	if u.period != period {
+		u.period = period
+		u.used = 0
+	}
+}
+
+func (u *usage) add(period string, n int64) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(period)
+	u.used += n
+	return u.used
+}
+
+func (u *usage) load(period string) (int64, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.roll(period)
+	return u.used, len(u.conns)
+}
+
+func (u *usage) join(c io.Closer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conns == nil {
+		u.conns = make(map[io.Closer]struct{})
+	}
+	u.conns[c] = struct{}{}
+}
+
+func (u *usage) leave(c io.Closer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.conns, c)
+}
+
+func (u *usage) closeAll() int {
+	u.mu.Lock()
+	conns := make([]io.Closer, 0, len(u.conns))
+	for c := range u.conns {
+		conns = append(conns, c)
+	}
+	u.mu.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	return len(conns)
+}
+
+// Load 首次调用时读取保存的流量使用量, 之后修改路径只改变 Save 写入的文件
+func Load(path string) error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if path == storePath {
+		return nil
+	}
+	first := storePath == ""
+	storePath = path
+	if !first {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	saved := make(map[string]record)
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for key, s := range saved {
+		u, ok := usages[key]
+		if !ok {
+			u = &usage{}
+			usages[key] = u
+		}
+		u.mu.Lock()
+		if u.period == "" || u.period == s.Period {
+			u.period = s.Period
+			u.used += s.Used
+		}
+		u.mu.Unlock()
+	}
+	return nil
+}
+
+// Save 将流量使用量写入 Load 指定的文件
+func Save() error {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if storePath == "" || len(usages) == 0 {
+		return nil
+	}
+	saved := make(map[string]record, len(usages))
+	for key, u := range usages {
+		u.mu.Lock()
+		saved[key] = record{Period: u.period, Used: u.used}
+		u.mu.Unlock()
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再替换, 避免写入过程中退出导致文件损坏
+	tmp := storePath + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, storePath)
+}
@@ -0,0 +1,222 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"github.com/xmapst/lightsocks/internal/config"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/lightsocks"
+	"github.com/xmapst/lightsocks/internal/mixed"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+	"github.com/xmapst/lightsocks/internal/udp"
+)
+
+// inbound 一个正在运行的入口
+type inbound struct {
+	conf   config.Inbound
+	mode   string // 创建时的运行模式, 决定UDP是否经由出口转发
+	server *N.Listener
+	udp    *udp.Server
+}
+
+var (
+	mu       sync.Mutex
+	inbounds = make(map[string]*inbound)
+)
+
+// ReCreate 按标签对比当前入口, 只重建有变化的监听, 未变化的监听及已建立的连接保持不变
+func ReCreate(confs []config.Inbound, mode string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	wanted := make(map[string]config.Inbound, len(confs))
+	for _, c := range confs {
+		wanted[c.Tag] = c
+	}
+	// 先关闭移除及变化的入口, 释放端口
+	var closed []string
+	for tag, in := range inbounds {
+		c, ok := wanted[tag]
+		if ok && in.mode == mode && equal(in.conf, c) {
+			continue
+		}
+		in.close()
+		delete(inbounds, tag)
+		closed = append(closed, tag)
+		logrus.Infoln(tag, "inbound closed")
+	}
+
+	var errs []error
+	for _, c := range confs {
+		if _, ok := inbounds[c.Tag]; ok {
+			continue
+		}
+		in, err := newInbound(c, mode)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("inbound %s: %w", c.Tag, err))
+			continue
+		}
+		inbounds[c.Tag] = in
+	}
+	for _, tag := range closed {
+		if _, ok := inbounds[tag]; !ok {
+			// 移除或重建失败的入口不再接受已建立连接使用的凭据
+			lightsocks.Revoke(tag, nil)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown 停止全部入口及UDP转发, 已建立的连接由 tunnel.Drain 等待结束
+func Shutdown() {
+	mu.Lock()
+	defer mu.Unlock()
+	for tag, in := range inbounds {
+		in.close()
+		delete(inbounds, tag)
+	}
+	closeTransparent()
+}
+
+func equal(a, b config.Inbound) bool {
+	// TLSConf 由 TLS 生成, 比较 TLS 即可; 限速及配额不影响监听
+	a.TLSConf, b.TLSConf = nil, nil
+	a.Limits, b.Limits = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func newInbound(c config.Inbound, mode string) (*inbound, error) {
+	in := &inbound{
+		conf: c,
+		mode: mode,
+	}
+	// 指向 inbound 内的副本, 不受之后重新加载的影响
+	conf := &in.conf
+	in.server = N.NewServer(conf.Host, conf.Port)
+	handler, err := in.newHandler(conf, tunnel.TCPIn.In)
+	if err != nil {
+		return nil, err
+	}
+	if err = in.server.Listen(); err != nil {
+		in.close()
+		return nil, err
+	}
+	go in.server.Serve(handler)
+	printAddress(conf)
+	return in, nil
+}
+
+// newHandler 按入口协议创建连接处理器, socks5 及 mixed 同时在相同地址监听UDP
+func (in *inbound) newHandler(conf *config.Inbound, tcpIn chan<- *constant.TCPContext) (N.IConnHandler, error) {
+	if conf.Type == config.InboundLightsocks {
+		server := &lightsocks.Server{
+			Config: &conf.Server,
+			TcpIn:  tcpIn,
+		}
+		var err error
+		if len(conf.Keys) > 0 {
+			server.Users, err = lightsocks.NewUsers(conf.Cipher, conf.Token, conf.Keys)
+		} else {
+			server.Cipher, err = cipher.New(conf.Cipher, conf.Token)
+		}
+		if err != nil {
+			return nil, err
+		}
+		server.Transport, err = N.NewTransportServer(&conf.Server)
+		if err != nil {
+			return nil, err
+		}
+		server.Padding, err = protocol.ParsePadding(conf.Padding)
+		if err != nil {
+			return nil, err
+		}
+		server.Compression, err = compress.ParseCodecs(conf.Compression)
+		if err != nil {
+			return nil, err
+		}
+		if server.Transport != nil && conf.TLSConf != nil {
+			// 浏览器指纹的客户端会同时提供 h2 及 http/1.1, 按传输方式协商
+			tlsConf := conf.TLSConf.Clone()
+			tlsConf.NextProtos = server.Transport.NextProtos()
+			conf.TLSConf = tlsConf
+		}
+		// 关闭已建立连接中凭据被移除, 停用, 过期或修改的连接
+		lightsocks.Revoke(conf.Tag, server.Users)
+		return server, nil
+	}
+	handler := &mixed.Server{
+		Config: &conf.Server,
+		TcpIn:  tcpIn,
+		Bind:   tunnel.Bind,
+		Auth:   auth.NewAuthenticator(conf.Users),
+	}
+	switch conf.Type {
+	case config.InboundSocks4:
+		handler.Allow = []constant.Type{constant.SOCKS4}
+	case config.InboundSocks5:
+		handler.Allow = []constant.Type{constant.SOCKS5}
+	case config.InboundHttp:
+		handler.Allow = []constant.Type{constant.HTTP}
+	}
+	if conf.Type == config.InboundMixed || conf.Type == config.InboundSocks5 {
+		// UDP ASSOCIATE 时在控制连接的本地地址上分配端口
+		// 与TCP相同按规则选择出口, 匹配 REJECT 时丢弃, DIRECT 时直连
+		udpServer := udp.New(conf.Tag, tunnel.DialUDP)
+		// 直连的数据包同样需要出口网卡及fwmark, 避免再次被透明代理捕获
+		udpServer.Options = func() []dialer.Option {
+			server := config.App.Outbound
+			return []dialer.Option{
+				dialer.WithInterface(server.Interface),
+				dialer.WithRoutingMark(server.RoutingMark),
+			}
+		}
+		in.udp = udpServer
+		handler.Udp = udpServer
+	}
+	return handler, nil
+}
+
+func (in *inbound) close() {
+	if in.udp != nil {
+		_ = in.udp.Close()
+	}
+	in.server.Close()
+}
+
+func printAddress(in *config.Inbound) {
+	schemes := []string{"http", "socks4", "socks5"}
+	if in.Type != config.InboundMixed {
+		schemes = []string{in.Type}
+	}
+	hosts := []string{in.Host}
+	if in.Host == "" || in.Host == "0.0.0.0" || in.Host == "[::]" {
+		hosts = nil
+		addrs, _ := net.InterfaceAddrs()
+		for _, value := range addrs {
+			if ipnet, ok := value.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+				hosts = append(hosts, ipnet.IP.String())
+			}
+		}
+	}
+	port := strconv.FormatInt(in.Port, 10)
+	for _, host := range hosts {
+		var urls []string
+		for _, scheme := range schemes {
+			urls = append(urls, scheme+"://"+net.JoinHostPort(host, port))
+		}
+		logrus.Infoln(in.Tag, strings.Join(urls, " "))
+	}
+}
@@ -0,0 +1,95 @@
+package listener
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/redir"
+	"github.com/xmapst/lightsocks/internal/tproxy"
+	"github.com/xmapst/lightsocks/internal/tunnel"
+)
+
+var (
+	redirListener  *redir.Listener
+	tproxyListener *tproxy.Listener
+	tproxyUDP      *tproxy.UDPListener
+	// 创建 tproxyUDP 时直连使用的出口网卡及fwmark
+	tproxyInterface string
+	tproxyMark      int
+)
+
+// ReCreateRedir 地址变化时重建 REDIRECT 透明代理, 为空则关闭
+func ReCreateRedir(addr string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if redirListener != nil {
+		if redirListener.Address() == addr {
+			return nil
+		}
+		_ = redirListener.Close()
+		redirListener = nil
+	}
+	if addr == "" {
+		return nil
+	}
+	l, err := redir.New(addr, tunnel.TCPIn.In)
+	if err != nil {
+		return err
+	}
+	redirListener = l
+	logrus.Infoln("Redir Server Listening At:", l.Address())
+	return nil
+}
+
+// ReCreateTProxy 地址或直连出口设置变化时重建 TPROXY 透明代理, 为空则关闭
+func ReCreateTProxy(addr string, direct *constant.Server) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if tproxyListener != nil {
+		if tproxyListener.Address() == addr &&
+			tproxyInterface == direct.Interface &&
+			tproxyMark == direct.RoutingMark {
+			return nil
+		}
+		closeTProxy()
+	}
+	if addr == "" {
+		return nil
+	}
+	l, err := tproxy.New(addr, tunnel.TCPIn.In)
+	if err != nil {
+		return err
+	}
+	// 直连的数据包同样需要fwmark, 避免再次被 TPROXY 规则捕获
+	ul, err := tproxy.NewUDP(addr, tunnel.DialUDP,
+		dialer.WithInterface(direct.Interface),
+		dialer.WithRoutingMark(direct.RoutingMark),
+	)
+	if err != nil {
+		_ = l.Close()
+		return err
+	}
+	tproxyListener, tproxyUDP = l, ul
+	tproxyInterface, tproxyMark = direct.Interface, direct.RoutingMark
+	logrus.Infoln("TProxy Server Listening At:", l.Address())
+	return nil
+}
+
+func closeTProxy() {
+	if tproxyListener != nil {
+		_ = tproxyListener.Close()
+		tproxyListener = nil
+	}
+	if tproxyUDP != nil {
+		_ = tproxyUDP.Close()
+		tproxyUDP = nil
+	}
+}
+
+func closeTransparent() {
+	if redirListener != nil {
+		_ = redirListener.Close()
+		redirListener = nil
+	}
+	closeTProxy()
+}
@@ -5,10 +5,12 @@ import (
 	"sync"
 
 	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
 	"github.com/xmapst/lightsocks/internal/http"
 	"github.com/xmapst/lightsocks/internal/socks4"
 	"github.com/xmapst/lightsocks/internal/socks5"
+	"github.com/xmapst/lightsocks/internal/udp"
 )
 
 type Proxy interface {
@@ -16,14 +18,14 @@ type Proxy interface {
 	Handle(tcpIn chan<- *constant.TCPContext) error
 }
 
-func (s *Server) socks4() Proxy {
-	return &socks4.Proxy{}
+func (s *Server) socks4(authenticator auth.Authenticator) Proxy {
+	return &socks4.Proxy{Auth: authenticator}
 }
 
-func (s *Server) socks5(udpAddr string) Proxy {
-	return &socks5.Proxy{Udp: udpAddr}
+func (s *Server) socks5(udpServer *udp.Server, bind socks5.BindFn, authenticator auth.Authenticator) Proxy {
+	return &socks5.Proxy{Udp: udpServer, Bind: bind, Auth: authenticator}
 }
 
-func (s *Server) http() Proxy {
-	return &http.Proxy{}
+func (s *Server) http(authenticator auth.Authenticator) Proxy {
+	return &http.Proxy{Auth: authenticator}
 }
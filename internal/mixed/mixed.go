@@ -1,22 +1,45 @@
 package mixed
 
 import (
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/refraction-networking/utls"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
 	N "github.com/xmapst/lightsocks/internal/net"
 	"github.com/xmapst/lightsocks/internal/socks4"
 	"github.com/xmapst/lightsocks/internal/socks5"
+	"github.com/xmapst/lightsocks/internal/udp"
 )
 
+var ErrNotAllowed = errors.New("protocol not allowed")
+
 type Server struct {
 	Config *constant.Server
 	TcpIn  chan<- *constant.TCPContext
-	Udp    string
+	Udp    *udp.Server
+	Bind   socks5.BindFn
+	Auth   auth.Authenticator
+	// Allow 允许的协议, 为空则全部允许
+	Allow []constant.Type
+}
+
+func (s *Server) allowed(t constant.Type) bool {
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, v := range s.Allow {
+		if v == t {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) Handler(wg *sync.WaitGroup, conn net.Conn) {
@@ -30,6 +53,19 @@ func (s *Server) Handler(wg *sync.WaitGroup, conn net.Conn) {
 	}()
 
 	id, _ := uuid.NewV4()
+	if s.Config.Timeout > 0 {
+		// 握手超时, 进入转发时清除
+		_ = conn.SetDeadline(time.Now().Add(s.Config.Timeout))
+	}
+	if s.Config.TLS.Enable {
+		tlsConn := tls.Server(conn, s.Config.TLSConf)
+		err = tlsConn.Handshake()
+		if err != nil {
+			logrus.Errorln(id, conn.RemoteAddr(), err)
+			return
+		}
+		conn = tlsConn
+	}
 	bufConn := N.NewBufferedConn(conn)
 	head, err := bufConn.Peek(1)
 	if err != nil {
@@ -39,13 +75,19 @@ func (s *Server) Handler(wg *sync.WaitGroup, conn net.Conn) {
 		return
 	}
 	var proxy Proxy
+	var _type constant.Type
 	switch head[0] {
 	case socks4.Version:
-		proxy = s.socks4()
+		proxy, _type = s.socks4(s.Auth), constant.SOCKS4
 	case socks5.Version:
-		proxy = s.socks5(s.Udp)
+		proxy, _type = s.socks5(s.Udp, s.Bind, s.Auth), constant.SOCKS5
 	default:
-		proxy = s.http()
+		proxy, _type = s.http(s.Auth), constant.HTTP
+	}
+	if !s.allowed(_type) {
+		err = ErrNotAllowed
+		logrus.Errorln(id, conn.RemoteAddr(), _type, err)
+		return
 	}
 	err = proxy.New(wg, s.Config, id, bufConn)
 	if err != nil {
@@ -0,0 +1,77 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const version = 1
+
+// 帧命令
+const (
+	cmdSYN byte = iota // 新建流
+	cmdFIN             // 关闭流
+	cmdPSH             // 数据
+	cmdNOP             // 心跳
+	cmdUPD             // 窗口更新
+)
+
+// Frame format:
+//
+// * 0     1     2          4            8
+// * +-----+-----+----------+------------+
+// * | ver | cmd |  length  | stream id  |
+// * +-----+-----+----------+------------+
+// * |             data bytes            |
+// * +-----------------------------------+
+const (
+	headerSize = 8
+	updSize    = 4
+)
+
+var (
+	frameEndian = binary.BigEndian
+
+	ErrInvalidProtocol = errors.New("invalid mux protocol")
+	ErrSessionClosed   = errors.New("mux session closed")
+	ErrStreamClosed    = errors.New("mux stream closed")
+	ErrWindowOverflow  = errors.New("mux stream window overflow")
+	ErrTimeout         = &timeoutError{}
+)
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+type Config struct {
+	// KeepAliveInterval 心跳间隔
+	KeepAliveInterval time.Duration
+	// KeepAliveTimeout 超过该时间没有收到任何数据则关闭会话
+	KeepAliveTimeout time.Duration
+	// MaxFrameSize 单个数据帧最大长度
+	MaxFrameSize int
+	// MaxStreamWindow 单个流的接收窗口
+	MaxStreamWindow int
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+		MaxFrameSize:      32 << 10,
+		MaxStreamWindow:   256 << 10,
+	}
+}
+
+func encodeFrame(cmd byte, sid uint32, data []byte) []byte {
+	buf := make([]byte, headerSize+len(data))
+	buf[0] = version
+	buf[1] = cmd
+	frameEndian.PutUint16(buf[2:], uint16(len(data)))
+	frameEndian.PutUint32(buf[4:], sid)
+	copy(buf[headerSize:], data)
+	return buf
+}
@@ -0,0 +1,237 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConfig 较小的窗口及帧长度, 少量数据即可耗尽窗口
+func testConfig() *Config {
+	config := DefaultConfig()
+	config.MaxFrameSize = 8
+	config.MaxStreamWindow = 16
+	return config
+}
+
+// pipe 通过 net.Pipe 连接的客户端及服务端会话
+func pipe(t *testing.T, config *Config) (*Session, *Session) {
+	c1, c2 := net.Pipe()
+	client, server := Client(c1, config), Server(c2, config)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// openPair 客户端新建流, 返回两端的流
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	local, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local, remote
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	config := testConfig()
+	client, server := pipe(t, config)
+	local, remote := openPair(t, client, server)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2)
+	// 对端未读取时最多发送一个窗口的数据
+	_ = local.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := local.Write(data)
+	if !errors.Is(err, ErrTimeout) || n != config.MaxStreamWindow {
+		t.Fatalf("write %d bytes, %v, want %d bytes, timeout", n, err, config.MaxStreamWindow)
+	}
+
+	// 读取后对端发送窗口更新, 剩余数据可以继续发送
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(remote, buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	_ = local.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err = local.Write(data[n:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(remote, buf[n:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("read %q, want %q", buf, data)
+	}
+}
+
+func TestWindowOverflow(t *testing.T) {
+	config := testConfig()
+	client, server := pipe(t, config)
+	local, _ := openPair(t, client, server)
+
+	// 不遵守流控的对端导致会话关闭
+	for i := 0; i <= config.MaxStreamWindow/config.MaxFrameSize; i++ {
+		if err := client.writeFrame(cmdPSH, local.ID(), make([]byte, config.MaxFrameSize)); err != nil {
+			break
+		}
+	}
+	waitFor(t, server.IsClosed)
+}
+
+func TestFIN(t *testing.T) {
+	for _, name := range []string{"client", "server"} {
+		t.Run(name, func(t *testing.T) {
+			client, server := pipe(t, nil)
+			local, remote := openPair(t, client, server)
+			if name == "server" {
+				local, remote = remote, local
+			}
+			if _, err := local.Write([]byte("hello")); err != nil {
+				t.Fatal(err)
+			}
+			if err := local.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// 关闭前发送的数据仍可读取, 之后读到 EOF
+			b, err := io.ReadAll(remote)
+			if err != nil || string(b) != "hello" {
+				t.Fatalf("read %q, %v", b, err)
+			}
+			if _, err = remote.Write([]byte("world")); err != io.ErrClosedPipe {
+				t.Fatalf("write after fin: %v", err)
+			}
+			if _, err = local.Read(make([]byte, 1)); err != ErrStreamClosed {
+				t.Fatalf("read after close: %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pipe(t, nil)
+	local, remote := openPair(t, client, server)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var readErr error
+	go func() {
+		defer wg.Done()
+		_, readErr = remote.Read(make([]byte, 1))
+	}()
+	// 底层连接断开后两端的会话都关闭, 阻塞的读取返回
+	_ = client.conn.Close()
+	wg.Wait()
+	if readErr != io.EOF {
+		t.Fatalf("read: %v", readErr)
+	}
+	waitFor(t, server.IsClosed)
+	waitFor(t, client.IsClosed)
+
+	if _, err := local.Write([]byte("x")); err != ErrSessionClosed {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := client.OpenStream(); err != ErrSessionClosed {
+		t.Fatalf("open: %v", err)
+	}
+	if _, err := server.AcceptStream(); err != ErrSessionClosed {
+		t.Fatalf("accept: %v", err)
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	client, server := pipe(t, nil)
+	local, remote := openPair(t, client, server)
+
+	for i := 0; i < acceptBacklog; i++ {
+		if _, err := client.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 等待接收的流已满时拒绝新的流, 已建立的流不受影响
+	rejected, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read rejected stream: %v", err)
+	}
+	if _, err = local.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = io.ReadFull(remote, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+}
+
+func TestPool(t *testing.T) {
+	var mu sync.Mutex
+	var servers []*Session
+	pool := NewPool(2, 0, func() (*Session, error) {
+		client, server := pipe(t, nil)
+		mu.Lock()
+		servers = append(servers, server)
+		mu.Unlock()
+		return client, nil
+	})
+	t.Cleanup(pool.Close)
+	dialed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(servers)
+	}
+
+	// 超过单个会话的并发流数量时新建会话
+	for i := 0; i < 3; i++ {
+		if _, err := pool.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := dialed(); n != 2 {
+		t.Fatalf("dialed %d sessions, want 2", n)
+	}
+
+	// 已断开的会话被移出, 不再分配新的流
+	mu.Lock()
+	dead := servers[0]
+	mu.Unlock()
+	_ = dead.Close()
+	waitFor(t, func() bool {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return pool.sessions[0].IsClosed()
+	})
+	stream, err := pool.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.sess.IsClosed() {
+		t.Fatal("stream opened on a closed session")
+	}
+	pool.mu.Lock()
+	n := len(pool.sessions)
+	pool.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("pool keeps %d sessions, want 1", n)
+	}
+}
@@ -0,0 +1,104 @@
+package mux
+
+import (
+	"sync"
+	"time"
+)
+
+// Pool 客户端长连接会话池, 新建流时优先复用负载最低的会话
+type Pool struct {
+	dial        func() (*Session, error)
+	maxStreams  int
+	idleTimeout time.Duration
+
+	dialMu   sync.Mutex
+	mu       sync.Mutex
+	sessions []*Session
+}
+
+// NewPool maxStreams 为单个会话的最大并发流数量,
+// 空闲超过 idleTimeout 的多余会话会被关闭, 至少保留一个会话
+func NewPool(maxStreams int, idleTimeout time.Duration, dial func() (*Session, error)) *Pool {
+	if maxStreams <= 0 {
+		maxStreams = 8
+	}
+	return &Pool{
+		dial:        dial,
+		maxStreams:  maxStreams,
+		idleTimeout: idleTimeout,
+	}
+}
+
+func (p *Pool) OpenStream() (*Stream, error) {
+	sess := p.pick()
+	if sess == nil {
+		var err error
+		sess, err = p.dialSession()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sess.OpenStream()
+}
+
+// dialSession 同一时间只新建一个会话, 等待期间其他会话可能已经可用
+func (p *Pool) dialSession() (*Session, error) {
+	p.dialMu.Lock()
+	defer p.dialMu.Unlock()
+	if sess := p.pick(); sess != nil {
+		return sess, nil
+	}
+	sess, err := p.dial()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.sessions = append(p.sessions, sess)
+	p.mu.Unlock()
+	return sess, nil
+}
+
+// pick 清理已关闭及多余的空闲会话, 返回可用的会话
+func (p *Pool) pick() *Session {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *Session
+	var alive []*Session
+	for _, sess := range p.sessions {
+		if sess.IsClosed() {
+			continue
+		}
+		if p.idleTimeout > 0 && len(alive) > 0 && sess.IdleTime() > p.idleTimeout {
+			_ = sess.Close()
+			continue
+		}
+		alive = append(alive, sess)
+		num := sess.NumStreams()
+		if num < p.maxStreams && (best == nil || num < best.NumStreams()) {
+			best = sess
+		}
+	}
+	p.sessions = alive
+	return best
+}
+
+// Close 关闭所有会话
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, sess := range p.sessions {
+		_ = sess.Close()
+	}
+	p.sessions = nil
+}
+
+// Drain 移出所有会话, 已有的流结束后会话自动关闭
+func (p *Pool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, sess := range p.sessions {
+		sess.Drain()
+	}
+	p.sessions = nil
+}
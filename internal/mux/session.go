@@ -0,0 +1,247 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// acceptBacklog 等待 AcceptStream 的流数量上限, 超出后拒绝对端新建的流
+const acceptBacklog = 1024
+
+// Session 在一条连接上承载多个流
+type Session struct {
+	conn     net.Conn
+	config   *Config
+	nextID   *atomic.Uint32
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	acceptCh chan *Stream
+
+	lastRecv  *atomic.Time
+	idleSince *atomic.Time // 没有活动流的起始时间
+	draining  *atomic.Bool // 不再新建流, 最后一个流结束后关闭
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// Client 创建客户端会话, 客户端负责新建流
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server 创建服务端会话, 服务端接收流
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 0)
+}
+
+func newSession(conn net.Conn, config *Config, nextID uint32) *Session {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	s := &Session{
+		conn:      conn,
+		config:    config,
+		nextID:    atomic.NewUint32(nextID),
+		streams:   make(map[uint32]*Stream),
+		acceptCh:  make(chan *Stream, acceptBacklog),
+		lastRecv:  atomic.NewTime(time.Now()),
+		idleSince: atomic.NewTime(time.Now()),
+		draining:  atomic.NewBool(false),
+		die:       make(chan struct{}),
+	}
+	go s.recvLoop()
+	go s.keepalive()
+	return s
+}
+
+// OpenStream 新建一个流
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() || s.draining.Load() {
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID.Add(2)
+	stream := newStream(id, s)
+	s.mu.Lock()
+	s.streams[id] = stream
+	s.mu.Unlock()
+	if err := s.writeFrame(cmdSYN, id, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream 等待对端新建的流
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *Session) Close() error {
+	var err error = ErrSessionClosed
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// Drain 不再新建流, 已有的流结束后关闭会话
+func (s *Session) Drain() {
+	s.draining.Store(true)
+	if s.NumStreams() == 0 {
+		_ = s.Close()
+	}
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams 当前活动流数量
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IdleTime 没有活动流的持续时间
+func (s *Session) IdleTime() time.Duration {
+	if s.NumStreams() > 0 {
+		return 0
+	}
+	return time.Since(s.idleSince.Load())
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	idle := len(s.streams) == 0
+	if idle {
+		s.idleSince.Store(time.Now())
+	}
+	s.mu.Unlock()
+	if idle && s.draining.Load() {
+		_ = s.Close()
+	}
+}
+
+func (s *Session) writeFrame(cmd byte, sid uint32, data []byte) error {
+	buf := encodeFrame(cmd, sid, data)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	_, err := s.conn.Write(buf)
+	if err != nil {
+		_ = s.Close()
+	}
+	return err
+}
+
+func (s *Session) recvLoop() {
+	defer func() {
+		_ = s.Close()
+	}()
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return
+		}
+		s.lastRecv.Store(time.Now())
+		if header[0] != version {
+			return
+		}
+		cmd := header[1]
+		length := frameEndian.Uint16(header[2:])
+		sid := frameEndian.Uint32(header[4:])
+		var data []byte
+		if length > 0 {
+			data = make([]byte, length)
+			if _, err := io.ReadFull(s.conn, data); err != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		stream := s.streams[sid]
+		s.mu.Unlock()
+		switch cmd {
+		case cmdNOP:
+		case cmdSYN:
+			if stream != nil {
+				continue
+			}
+			stream = newStream(sid, s)
+			s.mu.Lock()
+			s.streams[sid] = stream
+			s.mu.Unlock()
+			select {
+			case s.acceptCh <- stream:
+			default:
+				// 不等待接收, 避免阻塞其他流的数据及心跳
+				s.removeStream(sid)
+				_ = s.writeFrame(cmdFIN, sid, nil)
+			}
+		case cmdFIN:
+			if stream != nil {
+				stream.remoteClose()
+			}
+		case cmdPSH:
+			if stream != nil && stream.pushBytes(data) != nil {
+				// 对端没有遵守流控
+				return
+			}
+		case cmdUPD:
+			if len(data) != updSize {
+				return
+			}
+			if stream != nil {
+				stream.update(int(frameEndian.Uint32(data)))
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	ping := time.NewTicker(s.config.KeepAliveInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ping.C:
+			if time.Since(s.lastRecv.Load()) > s.config.KeepAliveTimeout {
+				_ = s.Close()
+				return
+			}
+			_ = s.writeFrame(cmdNOP, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
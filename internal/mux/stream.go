@@ -0,0 +1,264 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/compress"
+	"go.uber.org/atomic"
+)
+
+// Stream 会话中的一个流, 实现了 net.Conn
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu       sync.Mutex
+	buffers  [][]byte
+	buffered int // 已接收未读取的字节数
+	consumed int // 已读取但未通知对端的字节数
+	inflight int // 已发送但对端未确认的字节数
+
+	readEvent  chan struct{}
+	writeEvent chan struct{}
+
+	readDeadline  *atomic.Time
+	writeDeadline *atomic.Time
+
+	fin     chan struct{} // 对端已关闭
+	finOnce sync.Once
+	die     chan struct{} // 本端已关闭
+	dieOnce sync.Once
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:            id,
+		sess:          sess,
+		readEvent:     make(chan struct{}, 1),
+		writeEvent:    make(chan struct{}, 1),
+		readDeadline:  atomic.NewTime(time.Time{}),
+		writeDeadline: atomic.NewTime(time.Time{}),
+		fin:           make(chan struct{}),
+		die:           make(chan struct{}),
+	}
+}
+
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+func (s *Stream) tryRead(b []byte) (int, bool) {
+	s.mu.Lock()
+	if len(s.buffers) == 0 {
+		s.mu.Unlock()
+		return 0, false
+	}
+	n := copy(b, s.buffers[0])
+	s.buffers[0] = s.buffers[0][n:]
+	if len(s.buffers[0]) == 0 {
+		s.buffers[0] = nil
+		s.buffers = s.buffers[1:]
+	}
+	s.buffered -= n
+	s.consumed += n
+	var consumed int
+	if s.consumed >= s.sess.config.MaxStreamWindow/2 {
+		consumed, s.consumed = s.consumed, 0
+	}
+	s.mu.Unlock()
+
+	if consumed > 0 {
+		// 通知对端窗口已释放
+		upd := make([]byte, updSize)
+		frameEndian.PutUint32(upd, uint32(consumed))
+		_ = s.sess.writeFrame(cmdUPD, s.id, upd)
+	}
+	return n, true
+}
+
+func (s *Stream) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if n, ok := s.tryRead(b); ok {
+			return n, nil
+		}
+		timer, deadline := deadlineTimer(s.readDeadline)
+		select {
+		case <-s.readEvent:
+		case <-s.fin:
+			if n, ok := s.tryRead(b); ok {
+				stopTimer(timer)
+				return n, nil
+			}
+			stopTimer(timer)
+			return 0, io.EOF
+		case <-s.sess.die:
+			if n, ok := s.tryRead(b); ok {
+				stopTimer(timer)
+				return n, nil
+			}
+			stopTimer(timer)
+			return 0, io.EOF
+		case <-s.die:
+			stopTimer(timer)
+			return 0, ErrStreamClosed
+		case <-deadline:
+			return 0, ErrTimeout
+		}
+		stopTimer(timer)
+	}
+}
+
+func (s *Stream) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		s.mu.Lock()
+		window := s.sess.config.MaxStreamWindow - s.inflight
+		s.mu.Unlock()
+		if window <= 0 {
+			// 等待对端释放窗口
+			timer, deadline := deadlineTimer(s.writeDeadline)
+			select {
+			case <-s.writeEvent:
+				stopTimer(timer)
+				continue
+			case <-s.fin:
+				stopTimer(timer)
+				return written, io.ErrClosedPipe
+			case <-s.sess.die:
+				stopTimer(timer)
+				return written, ErrSessionClosed
+			case <-s.die:
+				stopTimer(timer)
+				return written, ErrStreamClosed
+			case <-deadline:
+				return written, ErrTimeout
+			}
+		}
+		select {
+		case <-s.fin:
+			return written, io.ErrClosedPipe
+		case <-s.die:
+			return written, ErrStreamClosed
+		default:
+		}
+
+		n := len(b)
+		if n > window {
+			n = window
+		}
+		if n > s.sess.config.MaxFrameSize {
+			n = s.sess.config.MaxFrameSize
+		}
+		if err := s.sess.writeFrame(cmdPSH, s.id, b[:n]); err != nil {
+			return written, err
+		}
+		s.mu.Lock()
+		s.inflight += n
+		s.mu.Unlock()
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (s *Stream) Close() error {
+	var err error = ErrStreamClosed
+	s.dieOnce.Do(func() {
+		close(s.die)
+		err = s.sess.writeFrame(cmdFIN, s.id, nil)
+		s.sess.removeStream(s.id)
+	})
+	return err
+}
+
+func (s *Stream) LocalAddr() net.Addr {
+	return s.sess.LocalAddr()
+}
+
+func (s *Stream) RemoteAddr() net.Addr {
+	return s.sess.RemoteAddr()
+}
+
+// Compression 会话底层连接的压缩统计, 会话内的流共享
+func (s *Stream) Compression() *compress.Stats {
+	if r, ok := s.sess.conn.(compress.Reporter); ok {
+		return r.Compression()
+	}
+	return nil
+}
+
+func (s *Stream) SetDeadline(t time.Time) error {
+	_ = s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	s.readDeadline.Store(t)
+	notify(s.readEvent)
+	return nil
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	s.writeDeadline.Store(t)
+	notify(s.writeEvent)
+	return nil
+}
+
+// pushBytes 收到对端数据
+func (s *Stream) pushBytes(data []byte) error {
+	s.mu.Lock()
+	if s.buffered+len(data) > s.sess.config.MaxStreamWindow {
+		s.mu.Unlock()
+		return ErrWindowOverflow
+	}
+	s.buffers = append(s.buffers, data)
+	s.buffered += len(data)
+	s.mu.Unlock()
+	notify(s.readEvent)
+	return nil
+}
+
+// update 对端已读取consumed字节, 释放发送窗口
+func (s *Stream) update(consumed int) {
+	s.mu.Lock()
+	s.inflight -= consumed
+	if s.inflight < 0 {
+		s.inflight = 0
+	}
+	s.mu.Unlock()
+	notify(s.writeEvent)
+}
+
+func (s *Stream) remoteClose() {
+	s.finOnce.Do(func() {
+		close(s.fin)
+	})
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func deadlineTimer(v *atomic.Time) (*time.Timer, <-chan time.Time) {
+	d := v.Load()
+	if d.IsZero() {
+		return nil, nil
+	}
+	timer := time.NewTimer(time.Until(d))
+	return timer, timer.C
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
@@ -42,3 +42,11 @@ func (c *BufferedConn) UnreadByte() error {
 func (c *BufferedConn) Buffered() int {
 	return c.r.Buffered()
 }
+
+// Sniff 等待第一段数据, 返回已到达的数据而不等待更多, 不移动读取位置
+func Sniff(c *BufferedConn) ([]byte, error) {
+	if _, err := c.Peek(1); err != nil {
+		return nil, err
+	}
+	return c.Peek(c.Buffered())
+}
@@ -0,0 +1,103 @@
+package net
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// RecordConn 记录握手期间读取的数据, 握手失败时原样转发到回落地址
+type RecordConn struct {
+	net.Conn
+	mu      sync.Mutex
+	buf     []byte
+	stopped bool
+}
+
+func NewRecordConn(c net.Conn) *RecordConn {
+	return &RecordConn{Conn: c}
+}
+
+func (c *RecordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.stopped {
+			if len(c.buf)+n > bufSize {
+				// 握手数据不会超过该长度, 超出后不再回落
+				c.stopped, c.buf = true, nil
+			} else {
+				c.buf = append(c.buf, b[:n]...)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// Stop 握手成功后停止记录
+func (c *RecordConn) Stop() {
+	c.mu.Lock()
+	c.stopped, c.buf = true, nil
+	c.mu.Unlock()
+}
+
+// IsHTTP 已记录的数据为明文HTTP请求
+func (c *RecordConn) IsHTTP() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return IsHTTP(c.buf)
+}
+
+// Recording 仍在记录时才能回落
+func (c *RecordConn) Recording() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.stopped
+}
+
+// Fallback 连接回落地址, 先写入已读取的数据, 之后双向转发直到任一方关闭
+func (c *RecordConn) Fallback(addr string, timeout time.Duration) error {
+	c.mu.Lock()
+	data := c.buf
+	c.stopped, c.buf = true, nil
+	c.mu.Unlock()
+	dest, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dest.Close()
+	}()
+	_ = c.Conn.SetDeadline(time.Time{})
+	if _, err = dest.Write(data); err != nil {
+		return err
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(c.Conn, dest)
+		_ = c.Conn.SetReadDeadline(time.Now())
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(dest, c.Conn)
+		_ = dest.SetReadDeadline(time.Now())
+	}()
+	wg.Wait()
+	return nil
+}
+
+// newFallbackProxy 传输层收到的普通HTTP请求转发到回落地址
+func newFallbackProxy(addr string) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: addr})
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, _ error) {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy
+}
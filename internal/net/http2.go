@@ -0,0 +1,117 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"golang.org/x/net/http2"
+)
+
+type h2Transport struct {
+	conf    constant.Transport
+	timeout time.Duration
+}
+
+func (t *h2Transport) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if t.conf.EarlyData > 0 {
+		return newEarlyConn(conn, t.conf.EarlyData, func(early []byte) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+			defer cancel()
+			return t.dial(ctx, conn, early)
+		}), nil
+	}
+	return t.dial(ctx, conn, nil)
+}
+
+// dial 每个连接单独建立h2会话, 请求体及响应体组成双向的流
+func (t *h2Transport) dial(ctx context.Context, conn net.Conn, early []byte) (net.Conn, error) {
+	cc, err := (&http2.Transport{}).NewClientConn(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	var body io.Reader = pr
+	if len(early) > 0 {
+		body = io.MultiReader(bytes.NewReader(early), pr)
+	}
+	req := &http.Request{
+		Method:        http.MethodPost,
+		URL:           &url.URL{Scheme: "https", Host: t.conf.Host, Path: t.conf.Path},
+		Host:          t.conf.Host,
+		Header:        http.Header{"Content-Type": {"application/octet-stream"}},
+		Body:          io.NopCloser(body),
+		ContentLength: -1,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+	}
+	// 请求的context会作用于整个流, 握手超时只作用于等待响应头
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		_ = pw.Close()
+		_ = cc.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		_ = pw.Close()
+		_ = cc.Close()
+		return nil, ErrTransportStatus
+	}
+	return newStreamConn(resp.Body, pw, func() {
+		_ = pw.Close()
+		_ = resp.Body.Close()
+		_ = cc.Close()
+	}, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+// flushWriter 服务端每次写入后立即发送
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	if err == nil {
+		w.f.Flush()
+	}
+	return n, err
+}
+
+// serveH2Stream 服务端处理h2流, 流关闭前不能返回
+func serveH2Stream(w http.ResponseWriter, r *http.Request, local, remote net.Addr, handle func(net.Conn)) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	done := make(chan struct{})
+	var once sync.Once
+	conn := newStreamConn(r.Body, &flushWriter{w: w, f: flusher}, func() {
+		once.Do(func() {
+			close(done)
+		})
+	}, local, remote)
+	handle(conn)
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		// 等待写入结束, 处理函数返回后不能再写入
+		_ = conn.Close()
+		<-done
+	}
+}
@@ -7,18 +7,25 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/cipher"
 	"github.com/xmapst/lightsocks/internal/constant"
-	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/limiter"
 )
 
 type Relay struct {
 	Src      net.Conn
 	Dest     net.Conn
 	Metadata *constant.Metadata
-	Token    []byte
+	Cipher   cipher.Cipher
+	// Limit 客户端的限速及流量配额, 为nil则不限制
+	Limit *limiter.Rule
 }
 
 func (r *Relay) Start(s int) {
+	if r.Limit != nil && r.Dest != nil {
+		// 读写目标的数据即为客户端的下载及上传
+		r.Dest = r.Limit.Conn(r.Dest)
+	}
 	switch s {
 	case constant.Proxy:
 		r.proxy()
@@ -30,22 +37,20 @@ func (r *Relay) Start(s int) {
 }
 
 func (r *Relay) block() {
-	start := time.Now()
-	logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "access")
-	defer func(src, dest net.Conn) {
-		_ = dest.Close()
-		_ = src.Close()
-		logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "finish", time.Since(start))
-	}(r.Src, r.Dest)
+	logrus.Infoln(r.Metadata.ID, r.Metadata.Identity(), "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "block")
+	if r.Dest != nil {
+		_ = r.Dest.Close()
+	}
+	_ = r.Src.Close()
 }
 
 func (r *Relay) direct() {
 	start := time.Now()
-	logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "access")
+	logrus.Infoln(r.Metadata.ID, r.Metadata.Identity(), "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "access")
 	defer func(src, dest net.Conn) {
 		_ = dest.Close()
 		_ = src.Close()
-		logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "finish", time.Since(start))
+		logrus.Infoln(r.Metadata.ID, r.Metadata.Identity(), "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "finish", time.Since(start))
 	}(r.Src, r.Dest)
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
@@ -64,37 +69,25 @@ func (r *Relay) direct() {
 
 func (r *Relay) proxy() {
 	start := time.Now()
-	logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "access")
+	logrus.Infoln(r.Metadata.ID, r.Metadata.Identity(), "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "access")
 	defer func(src, dest net.Conn) {
 		_ = dest.Close()
 		_ = src.Close()
-		logrus.Infoln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "finish", time.Since(start))
+		logrus.Infoln(r.Metadata.ID, r.Metadata.Identity(), "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, "finish", time.Since(start))
 	}(r.Src, r.Dest)
+	secConn := NewSecureTCPConn(r.Src, r.Cipher)
 	wg := new(sync.WaitGroup)
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		// dest --> encode --> src
-		conn := &SecureTCPConn{
-			ReadWriteCloser: r.Dest,
-		}
-		_ = conn.EncodeCopy(r.Token, r.Src)
+		_ = secConn.EncodeCopy(r.Dest)
 		_ = r.Src.SetReadDeadline(time.Now())
 	}()
 	go func() {
 		defer wg.Done()
 		// src --> decode --> dest
-		for {
-			pack, err := protocol.ReadFull(r.Token, r.Src)
-			if err != nil {
-				break
-			}
-			logrus.Debugln(r.Metadata.ID, "-->", r.Metadata.Client, "-->", r.Metadata.Source, "-->", r.Metadata.Target, pack.RandNu)
-			_, err = r.Dest.Write(pack.Payload)
-			if err != nil {
-				break
-			}
-		}
+		_, _ = secConn.WriteTo(r.Dest)
 		_ = r.Dest.SetReadDeadline(time.Now())
 	}()
 	wg.Wait()
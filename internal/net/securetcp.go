@@ -2,8 +2,11 @@ package net
 
 import (
 	"io"
+	"net"
 	"sync"
 
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/protocol"
 )
 
@@ -25,40 +28,182 @@ func bufferPoolPut(b []byte) {
 	bpool.Put(b)
 }
 
-// SecureTCPConn 加密传输的 TCP Socket
+// SecureTCPConn 加密传输的 TCP Socket, 读写时自动解密加密
 type SecureTCPConn struct {
-	io.ReadWriteCloser
+	net.Conn
+	writer *protocol.Writer
+	reader *protocol.Reader
+	remain []byte // 已解密但未读取的数据
 }
 
-// EncodeWrite 把放在bs里的数据加密后立即全部写入输出流
-func (secureSocket *SecureTCPConn) EncodeWrite(token, bs []byte) (int, error) {
-	// 加密
-	data, err := protocol.Encode(token, bs)
-	if err != nil {
-		return 0, err
+func NewSecureTCPConn(c net.Conn, ciph cipher.Cipher) *SecureTCPConn {
+	if sc, ok := c.(*SecureTCPConn); ok {
+		return sc
+	}
+	return &SecureTCPConn{
+		Conn:   c,
+		writer: protocol.NewWriter(c, ciph),
+		reader: protocol.NewReader(c, ciph),
 	}
-	return secureSocket.Write(data)
 }
 
-func (secureSocket *SecureTCPConn) EncodeCopy(token []byte, dst io.ReadWriteCloser) error {
-	buf := bufferPoolGet()
-	defer bufferPoolPut(buf)
+// SetPadding 设置发送数据帧的填充方案
+func (secureSocket *SecureTCPConn) SetPadding(p *protocol.Padding) {
+	secureSocket.writer.SetPadding(p)
+}
+
+// SetCodec 设置发送数据帧的压缩算法, 首次写入前调用
+func (secureSocket *SecureTCPConn) SetCodec(c compress.Codec) {
+	secureSocket.writer.SetCodec(c)
+}
+
+// ReplyCodec 服务端回复选择的压缩算法, 之后双方只使用该算法
+func (secureSocket *SecureTCPConn) ReplyCodec(c compress.Codec) error {
+	secureSocket.reader.SetAllowed(c)
+	return secureSocket.writer.WriteCodec(c)
+}
+
+// ExpectCodec 客户端提议压缩算法, 收到服务端的回复前发送方向不压缩
+func (secureSocket *SecureTCPConn) ExpectCodec(proposed []compress.Codec) {
+	secureSocket.writer.SetCodec(nil)
+	secureSocket.reader.ExpectCodec(proposed, secureSocket.writer.Adopt)
+}
+
+// Compression 发送方向的压缩统计, 实现 compress.Reporter
+func (secureSocket *SecureTCPConn) Compression() *compress.Stats {
+	return secureSocket.writer.Stats()
+}
+
+// EncodeWrite 把放在bs里的数据加密后立即全部写入输出流
+func (secureSocket *SecureTCPConn) EncodeWrite(bs []byte) (int, error) {
+	return secureSocket.writer.WritePacket(bs)
+}
+
+// DecodeRead 从输入流读取一个完整的数据包并解密
+func (secureSocket *SecureTCPConn) DecodeRead() (*protocol.Packet, error) {
+	return secureSocket.reader.ReadPacket()
+}
+
+// readResult 预读的明文
+type readResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// EncodeCopy 从src读取明文, 加密后写入输出流
+func (secureSocket *SecureTCPConn) EncodeCopy(src io.Reader) error {
+	_, err := secureSocket.ReadFrom(src)
+	return err
+}
+
+// ReadFrom 实现 io.ReaderFrom, 读取与写入并行, 写入期间读取到的数据合并后一次写入,
+// 数据帧不再对应内层协议的每次写入
+func (secureSocket *SecureTCPConn) ReadFrom(src io.Reader) (int64, error) {
+	var written int64
+	results := make(chan readResult, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			buf := bufferPoolGet()
+			n, err := src.Read(buf)
+			select {
+			case results <- readResult{buf: buf, n: n, err: err}:
+			case <-done:
+				bufferPoolPut(buf)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var next *readResult
 	for {
-		readCount, errRead := secureSocket.Read(buf)
-		if errRead != nil {
-			if errRead != io.EOF {
-				return errRead
-			} else {
-				return nil
+		var cur readResult
+		if next != nil {
+			cur, next = *next, nil
+		} else {
+			cur = <-results
+		}
+	merge:
+		for cur.err == nil {
+			select {
+			case r := <-results:
+				if cur.n+r.n > len(cur.buf) {
+					next = &r
+					break merge
+				}
+				copy(cur.buf[cur.n:], r.buf[:r.n])
+				cur.n += r.n
+				cur.err = r.err
+				bufferPoolPut(r.buf)
+			default:
+				break merge
 			}
 		}
-		if readCount > 0 {
-			_, errWrite := (&SecureTCPConn{
-				ReadWriteCloser: dst,
-			}).EncodeWrite(token, buf[0:readCount])
+		if cur.n > 0 {
+			_, errWrite := secureSocket.EncodeWrite(cur.buf[:cur.n])
 			if errWrite != nil {
-				return errWrite
+				bufferPoolPut(cur.buf)
+				return written, errWrite
 			}
+			written += int64(cur.n)
 		}
+		bufferPoolPut(cur.buf)
+		if cur.err != nil {
+			if cur.err != io.EOF {
+				return written, cur.err
+			}
+			return written, nil
+		}
+	}
+}
+
+// WriteTo 实现 io.WriterTo, 解密后的数据直接写入w, 不经过 io.Copy 的缓冲区
+func (secureSocket *SecureTCPConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if len(secureSocket.remain) > 0 {
+		n, err := w.Write(secureSocket.remain)
+		written += int64(n)
+		secureSocket.remain = nil
+		if err != nil {
+			return written, err
+		}
+	}
+	for {
+		pack, err := secureSocket.DecodeRead()
+		if err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+		n, err := w.Write(pack.Payload)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func (secureSocket *SecureTCPConn) Read(b []byte) (int, error) {
+	if len(secureSocket.remain) == 0 {
+		pack, err := secureSocket.DecodeRead()
+		if err != nil {
+			return 0, err
+		}
+		secureSocket.remain = pack.Payload
+	}
+	n := copy(b, secureSocket.remain)
+	secureSocket.remain = secureSocket.remain[n:]
+	return n, nil
+}
+
+func (secureSocket *SecureTCPConn) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
 	}
+	return secureSocket.EncodeWrite(b)
 }
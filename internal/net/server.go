@@ -3,15 +3,17 @@ package net
 import (
 	"bytes"
 	"context"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/pires/go-proxyproto"
 	"github.com/sirupsen/logrus"
+	"go.uber.org/atomic"
 )
 
 type IConnHandler interface {
@@ -21,29 +23,29 @@ type IConnHandler interface {
 type Listener struct {
 	tcp     net.Listener
 	wg      *sync.WaitGroup
+	closed  *atomic.Bool
 	Addr    string
 	Port    int64
 	handler IConnHandler
 }
 
 func (l *Listener) RawAddress() string {
-	return fmt.Sprintf("%s:%d", l.Addr, l.Port)
+	return net.JoinHostPort(l.Addr, strconv.FormatInt(l.Port, 10))
 }
 
 func (l *Listener) Address() string {
 	return l.tcp.Addr().String()
 }
 
+// close 只关闭一次, 之后 Serve 的 Accept 返回错误并退出
 func (l *Listener) close() {
-	if l.tcp != nil {
+	if l.tcp != nil && l.closed.CompareAndSwap(false, true) {
 		_ = l.tcp.Close()
-		return
 	}
-	return
 }
 
 func (l *Listener) State() bool {
-	return l.tcp != nil
+	return l.tcp != nil && !l.closed.Load()
 }
 
 func (l *Listener) Shutdown(ctx context.Context) error {
@@ -53,10 +55,7 @@ func (l *Listener) Shutdown(ctx context.Context) error {
 		defer close(c)
 		l.wg.Wait()
 	}()
-	defer func() {
-		logrus.Infoln("server closed")
-		l.tcp = nil
-	}()
+	defer logrus.Infoln("server closed")
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -67,13 +66,23 @@ func (l *Listener) Shutdown(ctx context.Context) error {
 
 func NewServer(addr string, port int64) *Listener {
 	return &Listener{
-		wg:   new(sync.WaitGroup),
-		Addr: addr,
-		Port: port,
+		wg:     new(sync.WaitGroup),
+		closed: atomic.NewBool(false),
+		Addr:   addr,
+		Port:   port,
 	}
 }
 
 func (l *Listener) ListenAndServe(handler IConnHandler) (err error) {
+	if err = l.Listen(); err != nil {
+		return err
+	}
+	l.Serve(handler)
+	return nil
+}
+
+// Listen 绑定监听地址, 与 Serve 分开以便重新加载时同步返回绑定错误
+func (l *Listener) Listen() (err error) {
 	tcpAddr, err := net.ResolveTCPAddr("tcp", l.RawAddress())
 	if err != nil {
 		logrus.Errorln(err)
@@ -85,17 +94,28 @@ func (l *Listener) ListenAndServe(handler IConnHandler) (err error) {
 		return err
 	}
 	logrus.Infoln("TCP Server Listening At:", l.tcp.Addr())
+	return nil
+}
+
+func (l *Listener) Serve(handler IConnHandler) {
 	ln := &proxyproto.Listener{Listener: l.tcp}
 	for {
-		var conn net.Conn
-		conn, err = ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
+			if l.closed.Load() || errors.Is(err, net.ErrClosed) {
+				return
+			}
 			continue
 		}
 		go handler.Handler(l.wg, conn)
 	}
 }
 
+// Close 停止接收新连接, 已建立的连接不受影响
+func (l *Listener) Close() {
+	l.close()
+}
+
 const NotFound = `<!DOCTYPE html>
 <html>
 <head>
@@ -130,14 +150,13 @@ func NotFoundResponse() *http.Response {
 	header.Set("date", time.Now().Format(time.RFC1123))
 	header.Set("Cache-Control", "no-cache, must-revalidate")
 	header.Set("Connection", "keep-alive")
-	header.Set("Expect", time.Now().Format(time.RFC1123))
 	header.Set("Pragma", "no-cache")
 
 	content := []byte(NotFound)
 	res := &http.Response{
-		Status:        "Not Found",
+		Status:        "404 Not Found",
 		StatusCode:    http.StatusNotFound,
-		Proto:         "HTTP/3",
+		Proto:         "HTTP/1.1",
 		ProtoMajor:    1,
 		ProtoMinor:    1,
 		Header:        header,
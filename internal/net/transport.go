@@ -0,0 +1,334 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"golang.org/x/net/http2"
+)
+
+// 客户端到服务端的传输方式
+const (
+	TransportTCP = "tcp"
+	TransportWS  = "ws"
+	TransportH2  = "h2"
+)
+
+const defaultEarlyDataHeader = "Sec-WebSocket-Protocol"
+
+var ErrTransportStatus = errors.New("unexpected transport response status")
+
+// Transport 在已建立的连接(含TLS)上完成传输层握手, 返回承载lightsocks协议的连接
+type Transport interface {
+	Client(ctx context.Context, conn net.Conn) (net.Conn, error)
+}
+
+// NewTransport tcp 时返回nil, 直接使用已建立的连接
+func NewTransport(server *constant.Server) (Transport, error) {
+	conf := transportConf(server)
+	switch conf.Type {
+	case TransportTCP:
+		return nil, nil
+	case TransportWS:
+		return &wsTransport{conf: conf, timeout: server.Timeout}, nil
+	case TransportH2:
+		return &h2Transport{conf: conf, timeout: server.Timeout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", server.Transport.Type)
+	}
+}
+
+// transportConf 填充默认值
+func transportConf(server *constant.Server) constant.Transport {
+	conf := server.Transport
+	conf.Type = strings.ToLower(conf.Type)
+	if conf.Type == "" {
+		conf.Type = TransportTCP
+	}
+	if conf.Path == "" {
+		conf.Path = "/"
+	}
+	if conf.Host == "" {
+		conf.Host = net.JoinHostPort(server.Host, fmt.Sprint(server.Port))
+	}
+	if conf.EarlyDataHeader == "" {
+		conf.EarlyDataHeader = defaultEarlyDataHeader
+	}
+	return conf
+}
+
+// TransportServer 服务端在同一端口接受 ws 或 h2 传输, 其余HTTP请求转发到回落地址或返回伪装页面
+type TransportServer struct {
+	conf     constant.Transport
+	timeout  time.Duration
+	h2       *http2.Server
+	fallback http.Handler
+}
+
+// NewTransportServer tcp 时返回nil
+func NewTransportServer(server *constant.Server) (*TransportServer, error) {
+	conf := transportConf(server)
+	switch conf.Type {
+	case TransportTCP:
+		return nil, nil
+	case TransportWS, TransportH2:
+	default:
+		return nil, fmt.Errorf("unsupported transport %s", server.Transport.Type)
+	}
+	s := &TransportServer{
+		conf:    conf,
+		timeout: server.Timeout,
+		h2: &http2.Server{
+			IdleTimeout: server.Timeout,
+		},
+	}
+	if server.Fallback != "" {
+		s.fallback = newFallbackProxy(server.Fallback)
+	}
+	return s, nil
+}
+
+// NextProtos TLS握手时协商的应用层协议
+func (s *TransportServer) NextProtos() []string {
+	if s.conf.Type == TransportH2 {
+		return []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+var httpMethods = [][]byte{
+	[]byte("GET "), []byte("POST"), []byte("HEAD"), []byte("PUT "), []byte("DELE"),
+	[]byte("OPTI"), []byte("PATC"), []byte("CONN"), []byte("TRAC"), []byte("PRI "),
+}
+
+// Match 连接以HTTP请求开始, lightsocks握手为随机字节
+func (s *TransportServer) Match(conn *BufferedConn) bool {
+	head, err := Sniff(conn)
+	if err != nil {
+		return false
+	}
+	return IsHTTP(head)
+}
+
+// IsHTTP b 以HTTP请求方法或h2的连接前言开始
+func IsHTTP(b []byte) bool {
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve 处理HTTP连接, 每个 ws 连接或 h2 流交由 handle 处理, 连接结束后返回
+func (s *TransportServer) Serve(conn *BufferedConn, handle func(net.Conn)) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveHTTP(w, r, conn, handle)
+	})
+	head, _ := conn.Peek(4)
+	if string(head) == "PRI " {
+		s.h2.ServeConn(conn, &http2.ServeConnOpts{Handler: handler})
+		return
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.timeout,
+		IdleTimeout:       s.timeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateHijacked || state == http.StateClosed {
+				once.Do(func() {
+					close(done)
+				})
+			}
+		},
+	}
+	_ = srv.Serve(&connListener{conn: conn})
+	<-done
+}
+
+func (s *TransportServer) serveHTTP(w http.ResponseWriter, r *http.Request, conn net.Conn, handle func(net.Conn)) {
+	if r.URL.Path == s.conf.Path {
+		switch {
+		case s.conf.Type == TransportWS && r.ProtoMajor == 1 && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			wsConn, err := upgradeWS(w, r, &s.conf)
+			if err == nil {
+				handle(wsConn)
+			}
+			return
+		case s.conf.Type == TransportH2 && r.ProtoMajor == 2 && r.Method == http.MethodPost:
+			serveH2Stream(w, r, conn.LocalAddr(), conn.RemoteAddr(), handle)
+			return
+		}
+	}
+	if s.fallback != nil {
+		s.fallback.ServeHTTP(w, r)
+		return
+	}
+	// 浏览器等普通请求返回伪装页面
+	res := NotFoundResponse()
+	for k, v := range res.Header {
+		if k != "Connection" {
+			w.Header()[k] = v
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+// connListener 只返回一个连接的监听, 用于在已建立的连接上运行 http.Server
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn == nil {
+		return nil, io.EOF
+	}
+	return conn, nil
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// earlyConn 首次写入时才完成传输层握手, 首包随握手请求发送
+type earlyConn struct {
+	net.Conn // 握手前的底层连接
+	size     int
+	dial     func(early []byte) (net.Conn, error)
+	once     sync.Once
+	ready    chan struct{}
+	conn     net.Conn
+	err      error
+}
+
+func newEarlyConn(conn net.Conn, size int, dial func(early []byte) (net.Conn, error)) *earlyConn {
+	return &earlyConn{
+		Conn:  conn,
+		size:  size,
+		dial:  dial,
+		ready: make(chan struct{}),
+	}
+}
+
+func (c *earlyConn) Write(b []byte) (int, error) {
+	n := -1
+	c.once.Do(func() {
+		n = len(b)
+		if n > c.size {
+			n = c.size
+		}
+		c.conn, c.err = c.dial(b[:n])
+		close(c.ready)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	if n < 0 {
+		return c.conn.Write(b)
+	}
+	if n == len(b) {
+		return n, nil
+	}
+	m, err := c.conn.Write(b[n:])
+	return n + m, err
+}
+
+func (c *earlyConn) Read(b []byte) (int, error) {
+	<-c.ready
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.conn.Read(b)
+}
+
+func (c *earlyConn) Close() error {
+	c.once.Do(func() {
+		c.err = net.ErrClosed
+		close(c.ready)
+	})
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	return c.Conn.Close()
+}
+
+// current 握手完成后返回传输层的连接, 否则返回底层连接
+func (c *earlyConn) current() net.Conn {
+	select {
+	case <-c.ready:
+		if c.conn != nil {
+			return c.conn
+		}
+	default:
+	}
+	return c.Conn
+}
+
+func (c *earlyConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *earlyConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *earlyConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
+
+// streamConn 把 ws 消息或 h2 流包装为 net.Conn, 读写超时由 net.Pipe 提供,
+// 超时后连接仍可继续使用
+type streamConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func newStreamConn(r io.Reader, w io.Writer, closeFn func(), local, remote net.Addr) net.Conn {
+	conn, pipe := net.Pipe()
+	go func() {
+		_, _ = io.Copy(pipe, r)
+		_ = pipe.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(w, pipe)
+		_ = pipe.Close()
+		closeFn()
+	}()
+	return &streamConn{
+		Conn:   conn,
+		local:  local,
+		remote: remote,
+	}
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,136 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+type wsTransport struct {
+	conf    constant.Transport
+	timeout time.Duration
+}
+
+func (t *wsTransport) Client(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if t.conf.EarlyData > 0 {
+		return newEarlyConn(conn, t.conf.EarlyData, func(early []byte) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+			defer cancel()
+			return t.dial(ctx, conn, early)
+		}), nil
+	}
+	return t.dial(ctx, conn, nil)
+}
+
+func (t *wsTransport) dial(ctx context.Context, conn net.Conn, early []byte) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		NetDialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		ReadBufferSize:  bufSize,
+		WriteBufferSize: bufSize,
+	}
+	header := http.Header{}
+	header.Set("Host", t.conf.Host)
+	if len(early) > 0 {
+		header.Set(t.conf.EarlyDataHeader, base64.RawURLEncoding.EncodeToString(early))
+	}
+	// TLS 已由出口完成, 这里只进行HTTP升级
+	u := url.URL{Scheme: "ws", Host: t.conf.Host, Path: t.conf.Path}
+	ws, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return newWSConn(ws), nil
+}
+
+// wsStream 以二进制消息读写 websocket
+type wsStream struct {
+	ws     *websocket.Conn
+	reader io.Reader
+	mu     sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn, early ...byte) net.Conn {
+	s := &wsStream{ws: ws}
+	var r io.Reader = s
+	if len(early) > 0 {
+		r = io.MultiReader(bytes.NewReader(early), s)
+	}
+	return newStreamConn(r, s, func() {
+		_ = ws.Close()
+	}, ws.LocalAddr(), ws.RemoteAddr())
+}
+
+func (s *wsStream) Read(b []byte) (int, error) {
+	for {
+		if s.reader == nil {
+			_, r, err := s.ws.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.reader = r
+		}
+		n, err := s.reader.Read(b)
+		if err == io.EOF {
+			s.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// upgradeWS 服务端完成升级, 请求头中携带的首包作为连接最先读到的数据
+func upgradeWS(w http.ResponseWriter, r *http.Request, conf *constant.Transport) (net.Conn, error) {
+	var early []byte
+	var respHeader http.Header
+	name := conf.EarlyDataHeader
+	if name == "" {
+		name = defaultEarlyDataHeader
+	}
+	if value := r.Header.Get(name); value != "" {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err == nil {
+			early = data
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(defaultEarlyDataHeader) {
+				// 浏览器等客户端要求响应相同的子协议
+				respHeader = http.Header{defaultEarlyDataHeader: {value}}
+			}
+		}
+	}
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  bufSize,
+		WriteBufferSize: bufSize,
+		CheckOrigin: func(*http.Request) bool {
+			return true
+		},
+	}
+	ws, err := upgrader.Upgrade(w, r, respHeader)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(ws, early...), nil
+}
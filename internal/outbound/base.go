@@ -0,0 +1,241 @@
+package outbound
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"go.uber.org/atomic"
+)
+
+type Type int
+
+const (
+	Direct Type = iota
+	Reject
+	Lightsocks
+	Socks5
+	Http
+	Selector
+	URLTest
+	Fallback
+	LoadBalance
+)
+
+func (t Type) String() string {
+	switch t {
+	case Direct:
+		return "Direct"
+	case Reject:
+		return "Reject"
+	case Lightsocks:
+		return "Lightsocks"
+	case Socks5:
+		return "Socks5"
+	case Http:
+		return "Http"
+	case Selector:
+		return "Selector"
+	case URLTest:
+		return "URLTest"
+	case Fallback:
+		return "Fallback"
+	case LoadBalance:
+		return "LoadBalance"
+	default:
+		return "Unknown"
+	}
+}
+
+func (t Type) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+var (
+	ErrReject          = errors.New("rejected by outbound")
+	ErrUDPNotSupported = errors.New("udp not supported")
+	ErrProxyNotFound   = errors.New("proxy not found")
+	ErrNotSelectable   = errors.New("proxy is not selectable")
+)
+
+// Proxy 出口, 可以是具体的连接方式也可以是代理组
+type Proxy interface {
+	Name() string
+	Type() Type
+	// DialContext 建立到目标地址的连接, 返回的连接直接读写明文数据
+	DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error)
+	// DialUDP 建立承载 protocol.WriteUDPPacket 数据包的转发通道
+	DialUDP(metadata *constant.Metadata) (net.Conn, error)
+	Alive() bool
+	LastDelay() uint16
+	// URLTest 通过该出口请求url并记录延迟(ms)
+	URLTest(ctx context.Context, url string) (uint16, error)
+	Close() error
+	MarshalJSON() ([]byte, error)
+}
+
+// Group 代理组, 每个连接按策略选出一个成员
+type Group interface {
+	Proxy
+	Now() string
+	Members() []Proxy
+	Pick(metadata *constant.Metadata) Proxy
+}
+
+// Resolve 逐层解析代理组, 返回实际使用的出口及经过的链路
+func Resolve(p Proxy, metadata *constant.Metadata) (Proxy, []string) {
+	chains := []string{p.Name()}
+	for {
+		g, ok := p.(Group)
+		if !ok {
+			return p, chains
+		}
+		p = g.Pick(metadata)
+		chains = append(chains, p.Name())
+	}
+}
+
+type base struct {
+	name  string
+	tp    Type
+	alive *atomic.Bool
+	delay *atomic.Uint32
+}
+
+func newBase(name string, tp Type) *base {
+	return &base{
+		name:  name,
+		tp:    tp,
+		alive: atomic.NewBool(true),
+		delay: atomic.NewUint32(0),
+	}
+}
+
+func (b *base) Name() string {
+	return b.name
+}
+
+func (b *base) Type() Type {
+	return b.tp
+}
+
+func (b *base) Alive() bool {
+	return b.alive.Load()
+}
+
+func (b *base) LastDelay() uint16 {
+	return uint16(b.delay.Load())
+}
+
+func (b *base) DialUDP(*constant.Metadata) (net.Conn, error) {
+	return nil, ErrUDPNotSupported
+}
+
+func (b *base) Close() error {
+	return nil
+}
+
+func (b *base) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.info())
+}
+
+func (b *base) info() map[string]any {
+	return map[string]any{
+		"Name":  b.name,
+		"Type":  b.tp,
+		"Alive": b.Alive(),
+		"Delay": b.LastDelay(),
+	}
+}
+
+// record 记录健康检查结果
+func (b *base) record(delay uint16, err error) {
+	if err != nil {
+		b.alive.Store(false)
+		b.delay.Store(0)
+		return
+	}
+	b.alive.Store(true)
+	b.delay.Store(uint32(delay))
+}
+
+// urlTest 通过出口p发起一次HEAD请求, 返回耗时
+func urlTest(ctx context.Context, p Proxy, rawURL string) (uint16, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portNum, err := strconv.ParseInt(port, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	metadata, err := newMetadata(&constant.IP{Addr: u.Hostname(), Port: portNum})
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	conn, err := p.DialContext(ctx, metadata)
+	if err != nil {
+		return 0, err
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	transport := &http.Transport{
+		DialContext: func(context.Context, string, string) (net.Conn, error) {
+			return conn, nil
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+	client := http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return uint16(time.Since(start) / time.Millisecond), nil
+}
+
+// newMetadata 出口自身发起连接(健康检查, 多路复用会话)时使用的连接信息
+func newMetadata(target *constant.IP) (*constant.Metadata, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	return &constant.Metadata{
+		ID:      id,
+		NetWork: constant.TCP,
+		Type:    constant.HTTP,
+		Client:  &constant.IP{Addr: "127.0.0.1"},
+		Source:  &constant.IP{Addr: "127.0.0.1"},
+		Target:  target,
+	}, nil
+}
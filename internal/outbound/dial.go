@@ -0,0 +1,89 @@
+package outbound
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/refraction-networking/utls"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	N "github.com/xmapst/lightsocks/internal/net"
+)
+
+// hop 出口到下一跳(远端服务器或上游代理)的连接方式,
+// via 不为空时经由via连接, 用于链式代理
+type hop struct {
+	server *constant.Server
+	via    Proxy
+	// transport 为nil时直接在连接上传输
+	transport N.Transport
+}
+
+// dialServer 连接server, 开启TLS时完成握手, 配置了传输方式时完成传输层握手
+func (h *hop) dialServer(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	target := &constant.IP{Addr: h.server.Host, Port: h.server.Port}
+	var conn net.Conn
+	var err error
+	if h.via == nil {
+		conn, err = dialTCP(ctx, target.String(), h.server)
+	} else {
+		m := *metadata
+		m.Target = target
+		m.DstIP = nil
+		conn, err = h.via.DialContext(ctx, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if h.server.TLS == nil || !h.server.TLS.Enable {
+		return h.wrapTransport(ctx, conn)
+	}
+	helloID := tls.ClientHelloID{}
+	switch h.server.TLS.Fingerprint {
+	case "firefox":
+		helloID = tls.HelloFirefox_Auto
+	case "chrome":
+		helloID = tls.HelloChrome_Auto
+	case "ios":
+		helloID = tls.HelloIOS_Auto
+	default:
+		helloID = tls.HelloFirefox_Auto
+	}
+	tlsConn := tls.UClient(conn, h.server.TLSConf, helloID)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return h.wrapTransport(ctx, tlsConn)
+}
+
+func (h *hop) wrapTransport(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if h.transport == nil {
+		return conn, nil
+	}
+	return h.transport.Client(ctx, conn)
+}
+
+// dialTCP 按server的出口配置连接地址
+func dialTCP(ctx context.Context, address string, server *constant.Server) (net.Conn, error) {
+	conn, err := dialer.DialContext(
+		ctx, "tcp", address,
+		dialer.WithTimeout(server.Timeout), dialer.WithInterface(server.Interface),
+		dialer.WithRoutingMark(server.RoutingMark),
+	)
+	if err != nil {
+		return nil, err
+	}
+	// 激活4层会话保持
+	tcpKeepAlive(conn)
+	return conn, nil
+}
+
+func tcpKeepAlive(c net.Conn) {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		_ = tcp.SetKeepAlive(true)
+		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+	}
+}
@@ -0,0 +1,51 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// DirectOutbound 直接连接目标地址
+type DirectOutbound struct {
+	*base
+	server *constant.Server
+}
+
+// NewDirect server 提供连接超时, 出口网卡及fwmark
+func NewDirect(name string, server *constant.Server) *DirectOutbound {
+	return &DirectOutbound{
+		base:   newBase(name, Direct),
+		server: server,
+	}
+}
+
+func (d *DirectOutbound) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	return dialTCP(ctx, metadata.Target.String(), d.server)
+}
+
+func (d *DirectOutbound) URLTest(ctx context.Context, url string) (uint16, error) {
+	delay, err := urlTest(ctx, d, url)
+	d.record(delay, err)
+	return delay, err
+}
+
+// RejectOutbound 拒绝所有连接
+type RejectOutbound struct {
+	*base
+}
+
+func NewReject(name string) *RejectOutbound {
+	return &RejectOutbound{
+		base: newBase(name, Reject),
+	}
+}
+
+func (r *RejectOutbound) DialContext(context.Context, *constant.Metadata) (net.Conn, error) {
+	return nil, ErrReject
+}
+
+func (r *RejectOutbound) URLTest(context.Context, string) (uint16, error) {
+	return 0, ErrReject
+}
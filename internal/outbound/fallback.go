@@ -0,0 +1,43 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// FallbackGroup 按顺序选择第一个可用成员
+type FallbackGroup struct {
+	*groupBase
+}
+
+func NewFallback(name string, proxies []Proxy, hc *HealthCheck) *FallbackGroup {
+	return &FallbackGroup{
+		groupBase: newGroupBase(name, Fallback, proxies, hc),
+	}
+}
+
+func (f *FallbackGroup) Now() string {
+	return f.Pick(nil).Name()
+}
+
+func (f *FallbackGroup) Pick(*constant.Metadata) Proxy {
+	return f.alive()[0]
+}
+
+func (f *FallbackGroup) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroup(ctx, f, metadata)
+}
+
+func (f *FallbackGroup) DialUDP(metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroupUDP(f, metadata)
+}
+
+func (f *FallbackGroup) URLTest(ctx context.Context, url string) (uint16, error) {
+	return testGroup(ctx, f, url)
+}
+
+func (f *FallbackGroup) MarshalJSON() ([]byte, error) {
+	return f.marshal(f.Now())
+}
@@ -0,0 +1,169 @@
+package outbound
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+const (
+	defaultTestURL     = "http://www.gstatic.com/generate_204"
+	defaultTestTimeout = 5 * time.Second
+)
+
+// HealthCheck 定时通过每个成员请求url, 记录可用性及延迟
+type HealthCheck struct {
+	url      string
+	interval time.Duration
+	proxies  []Proxy
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewHealthCheck interval 为0时不做定时检查
+func NewHealthCheck(proxies []Proxy, url string, interval time.Duration) *HealthCheck {
+	if url == "" {
+		url = defaultTestURL
+	}
+	return &HealthCheck{
+		url:      url,
+		interval: interval,
+		proxies:  proxies,
+		done:     make(chan struct{}),
+	}
+}
+
+func (hc *HealthCheck) process() {
+	if hc.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+	hc.check()
+	for {
+		select {
+		case <-ticker.C:
+			hc.check()
+		case <-hc.done:
+			return
+		}
+	}
+}
+
+// check 并发检查所有成员
+func (hc *HealthCheck) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTestTimeout)
+	defer cancel()
+	wg := new(sync.WaitGroup)
+	for _, p := range hc.proxies {
+		wg.Add(1)
+		go func(p Proxy) {
+			defer wg.Done()
+			delay, err := p.URLTest(ctx, hc.url)
+			if err != nil {
+				logrus.Debugln("health check", p.Name(), "failed:", err)
+				return
+			}
+			logrus.Debugln("health check", p.Name(), delay, "ms")
+		}(p)
+	}
+	wg.Wait()
+}
+
+func (hc *HealthCheck) close() {
+	hc.once.Do(func() {
+		close(hc.done)
+	})
+}
+
+type groupBase struct {
+	*base
+	proxies     []Proxy
+	healthCheck *HealthCheck
+}
+
+func newGroupBase(name string, tp Type, proxies []Proxy, hc *HealthCheck) *groupBase {
+	g := &groupBase{
+		base:        newBase(name, tp),
+		proxies:     proxies,
+		healthCheck: hc,
+	}
+	if hc != nil {
+		go hc.process()
+	}
+	return g
+}
+
+func (g *groupBase) Members() []Proxy {
+	return g.proxies
+}
+
+// Alive 任意成员可用即可用
+func (g *groupBase) Alive() bool {
+	for _, p := range g.proxies {
+		if p.Alive() {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *groupBase) Close() error {
+	if g.healthCheck != nil {
+		g.healthCheck.close()
+	}
+	return nil
+}
+
+// alive 可用的成员, 全部不可用时返回所有成员
+func (g *groupBase) alive() []Proxy {
+	var proxies []Proxy
+	for _, p := range g.proxies {
+		if p.Alive() {
+			proxies = append(proxies, p)
+		}
+	}
+	if len(proxies) == 0 {
+		return g.proxies
+	}
+	return proxies
+}
+
+func (g *groupBase) marshal(now string) ([]byte, error) {
+	var all []string
+	info := g.info()
+	for _, p := range g.proxies {
+		all = append(all, p.Name())
+		if p.Name() == now {
+			info["Delay"] = p.LastDelay()
+		}
+	}
+	info["Alive"] = g.Alive()
+	info["Now"] = now
+	info["All"] = all
+	return json.Marshal(info)
+}
+
+// dialGroup 组通过当前选中的成员连接
+func dialGroup(ctx context.Context, g Group, metadata *constant.Metadata) (net.Conn, error) {
+	return g.Pick(metadata).DialContext(ctx, metadata)
+}
+
+func dialGroupUDP(g Group, metadata *constant.Metadata) (net.Conn, error) {
+	return g.Pick(metadata).DialUDP(metadata)
+}
+
+// testGroup 组的延迟为当前选中成员的延迟
+func testGroup(ctx context.Context, g Group, url string) (uint16, error) {
+	for _, p := range g.Members() {
+		if p.Name() == g.Now() {
+			return p.URLTest(ctx, url)
+		}
+	}
+	return 0, ErrProxyNotFound
+}
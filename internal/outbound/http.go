@@ -0,0 +1,79 @@
+package outbound
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	N "github.com/xmapst/lightsocks/internal/net"
+)
+
+// HttpOutbound 经由上游http代理的CONNECT方法连接, server.Username 不为空时使用Basic认证
+type HttpOutbound struct {
+	*base
+	hop
+}
+
+// NewHttp via 不为空时经由via连接上游代理
+func NewHttp(name string, server *constant.Server, via Proxy) *HttpOutbound {
+	return &HttpOutbound{
+		base: newBase(name, Http),
+		hop:  hop{server: server, via: via},
+	}
+}
+
+func (h *HttpOutbound) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	conn, err := h.dialServer(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	bufConn := N.NewBufferedConn(conn)
+	if err = h.connect(bufConn, metadata.Target.String()); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s: %w", h.server.Host, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	// 代理可能在响应头之后立即转发目标的数据, 需保留已缓冲的部分
+	return bufConn, nil
+}
+
+func (h *HttpOutbound) URLTest(ctx context.Context, url string) (uint16, error) {
+	delay, err := urlTest(ctx, h, url)
+	h.record(delay, err)
+	return delay, err
+}
+
+func (h *HttpOutbound) connect(conn *N.BufferedConn, target string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Host: target},
+		Host:   target,
+		Header: http.Header{
+			"Proxy-Connection": []string{"Keep-Alive"},
+		},
+	}
+	if h.server.Username != "" {
+		auth := h.server.Username + ":" + h.server.Password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// 成功的CONNECT响应需忽略 Content-Length 及 Transfer-Encoding, 不能读取body
+	resp, err := http.ReadResponse(conn.Reader(), req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("http connect failed, status %s", resp.Status)
+	}
+	return nil
+}
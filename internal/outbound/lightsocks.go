@@ -0,0 +1,154 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/mux"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/protocol"
+)
+
+// LightsocksOutbound 经由远端lightsocks服务器转发
+type LightsocksOutbound struct {
+	*base
+	hop
+	cipher  cipher.Cipher
+	padding *protocol.Padding
+	// codecs 握手时按优先顺序提议的压缩算法
+	codecs []compress.Codec
+	// pool 多路复用会话池, 未开启时为nil
+	pool *mux.Pool
+}
+
+// NewLightsocks via 不为空时经由via连接远端服务器
+func NewLightsocks(name string, server *constant.Server, via Proxy) (*LightsocksOutbound, error) {
+	ciph, err := cipher.New(server.Cipher, server.Token)
+	if err != nil {
+		return nil, err
+	}
+	if server.IDToken != "" {
+		ciph, err = cipher.WithID(ciph, server.Token, server.IDToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport, err := N.NewTransport(server)
+	if err != nil {
+		return nil, err
+	}
+	padding, err := protocol.ParsePadding(server.Padding)
+	if err != nil {
+		return nil, err
+	}
+	codecs, err := compress.ParseCodecs(server.Compression)
+	if err != nil {
+		return nil, err
+	}
+	if codecs == nil {
+		codecs = compress.DefaultCodecs
+	}
+	l := &LightsocksOutbound{
+		base:    newBase(name, Lightsocks),
+		hop:     hop{server: server, via: via, transport: transport},
+		cipher:  ciph,
+		padding: padding,
+		codecs:  codecs,
+	}
+	// 旧版服务端不支持多路复用
+	if server.Mux.Enable && !cipher.IsLegacy(ciph) {
+		l.pool = mux.NewPool(server.Mux.MaxStreams, server.Mux.IdleTimeout, l.dialMuxSession)
+	}
+	return l, nil
+}
+
+func (l *LightsocksOutbound) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	if l.pool != nil {
+		// 多路复用的流只需要写入被代理地址信息
+		stream, err := l.pool.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		err = protocol.WriteStreamHeader(stream, metadata.String())
+		if err != nil {
+			_ = stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+	return l.dialWithHeader(ctx, protocol.CmdConnect, metadata)
+}
+
+// DialUDP UDP转发通道与TCP相同, 由服务端根据 Metadata.NetWork 区分
+func (l *LightsocksOutbound) DialUDP(metadata *constant.Metadata) (net.Conn, error) {
+	return l.DialContext(context.Background(), metadata)
+}
+
+func (l *LightsocksOutbound) URLTest(ctx context.Context, url string) (uint16, error) {
+	delay, err := urlTest(ctx, l, url)
+	l.record(delay, err)
+	return delay, err
+}
+
+// Close 已建立的多路复用流不受影响, 结束后会话自动关闭
+func (l *LightsocksOutbound) Close() error {
+	if l.pool != nil {
+		l.pool.Drain()
+	}
+	return nil
+}
+
+// dialWithHeader 连接远端服务器, 加密后写入握手头
+func (l *LightsocksOutbound) dialWithHeader(ctx context.Context, cmd byte, metadata *constant.Metadata) (*N.SecureTCPConn, error) {
+	conn, err := l.dialServer(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	secConn := N.NewSecureTCPConn(conn, l.cipher)
+	if cipher.IsLegacy(l.cipher) {
+		// 旧版服务端的握手只有 metadata 字符串, 没有时间戳, 命令及压缩协商
+		_, err = secConn.Write([]byte(metadata.String()))
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return secConn, nil
+	}
+	secConn.SetPadding(l.padding)
+	// 发送方向使用服务端从提议中选择的算法
+	secConn.ExpectCodec(l.codecs)
+	var payload string
+	if cmd == protocol.CmdConnect {
+		payload = metadata.String()
+	}
+	header, err := protocol.NewHeader(cmd, payload)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	for _, c := range l.codecs {
+		header.Codecs = append(header.Codecs, c.ID())
+	}
+	_, err = secConn.Write(header.Encode())
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return secConn, nil
+}
+
+// dialMuxSession 连接远端服务器并建立多路复用会话
+func (l *LightsocksOutbound) dialMuxSession() (*mux.Session, error) {
+	metadata, err := newMetadata(&constant.IP{Addr: l.server.Host, Port: l.server.Port})
+	if err != nil {
+		return nil, err
+	}
+	secConn, err := l.dialWithHeader(context.Background(), protocol.CmdMux, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return mux.Client(secConn, nil), nil
+}
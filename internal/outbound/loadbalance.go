@@ -0,0 +1,51 @@
+package outbound
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// LoadBalanceGroup 按目标地址哈希分配到可用成员, 同一目标总是使用同一成员
+type LoadBalanceGroup struct {
+	*groupBase
+}
+
+func NewLoadBalance(name string, proxies []Proxy, hc *HealthCheck) *LoadBalanceGroup {
+	return &LoadBalanceGroup{
+		groupBase: newGroupBase(name, LoadBalance, proxies, hc),
+	}
+}
+
+func (l *LoadBalanceGroup) Now() string {
+	return ""
+}
+
+func (l *LoadBalanceGroup) Pick(metadata *constant.Metadata) Proxy {
+	proxies := l.alive()
+	if metadata == nil || metadata.Target == nil {
+		return proxies[0]
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(metadata.Target.Addr))
+	return proxies[h.Sum32()%uint32(len(proxies))]
+}
+
+func (l *LoadBalanceGroup) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroup(ctx, l, metadata)
+}
+
+func (l *LoadBalanceGroup) DialUDP(metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroupUDP(l, metadata)
+}
+
+// URLTest 负载均衡组没有当前成员, 测试第一个可用成员
+func (l *LoadBalanceGroup) URLTest(ctx context.Context, url string) (uint16, error) {
+	return l.Pick(nil).URLTest(ctx, url)
+}
+
+func (l *LoadBalanceGroup) MarshalJSON() ([]byte, error) {
+	return l.marshal(l.Now())
+}
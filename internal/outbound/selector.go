@@ -0,0 +1,63 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"go.uber.org/atomic"
+)
+
+// SelectorGroup 手动选择成员, 默认第一个
+type SelectorGroup struct {
+	*groupBase
+	selected *atomic.String
+}
+
+func NewSelector(name string, proxies []Proxy) *SelectorGroup {
+	return &SelectorGroup{
+		groupBase: newGroupBase(name, Selector, proxies, nil),
+		selected:  atomic.NewString(proxies[0].Name()),
+	}
+}
+
+func (s *SelectorGroup) Now() string {
+	return s.selected.Load()
+}
+
+// Set 切换到名为name的成员
+func (s *SelectorGroup) Set(name string) error {
+	for _, p := range s.proxies {
+		if p.Name() == name {
+			s.selected.Store(name)
+			return nil
+		}
+	}
+	return ErrProxyNotFound
+}
+
+func (s *SelectorGroup) Pick(*constant.Metadata) Proxy {
+	now := s.Now()
+	for _, p := range s.proxies {
+		if p.Name() == now {
+			return p
+		}
+	}
+	return s.proxies[0]
+}
+
+func (s *SelectorGroup) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroup(ctx, s, metadata)
+}
+
+func (s *SelectorGroup) DialUDP(metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroupUDP(s, metadata)
+}
+
+func (s *SelectorGroup) URLTest(ctx context.Context, url string) (uint16, error) {
+	return testGroup(ctx, s, url)
+}
+
+func (s *SelectorGroup) MarshalJSON() ([]byte, error) {
+	return s.marshal(s.Now())
+}
@@ -0,0 +1,114 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/socks5"
+)
+
+var (
+	errSocks5Auth   = errors.New("socks5 authentication failed")
+	errSocks5Method = errors.New("socks5 no acceptable auth method")
+)
+
+// Socks5Outbound 经由上游socks5代理连接, server.Username 不为空时使用用户名密码认证
+type Socks5Outbound struct {
+	*base
+	hop
+}
+
+// NewSocks5 via 不为空时经由via连接上游代理
+func NewSocks5(name string, server *constant.Server, via Proxy) *Socks5Outbound {
+	return &Socks5Outbound{
+		base: newBase(name, Socks5),
+		hop:  hop{server: server, via: via},
+	}
+}
+
+func (s *Socks5Outbound) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	conn, err := s.dialServer(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = s.handshake(conn, metadata.Target.String()); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%s: %w", s.server.Host, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (s *Socks5Outbound) URLTest(ctx context.Context, url string) (uint16, error) {
+	delay, err := urlTest(ctx, s, url)
+	s.record(delay, err)
+	return delay, err
+}
+
+// handshake 协商认证方式并发送CONNECT请求
+func (s *Socks5Outbound) handshake(conn net.Conn, target string) error {
+	method := socks5.AuthNone
+	if s.server.Username != "" {
+		method = socks5.AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5.Version, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if buf[0] != socks5.Version || buf[1] != method {
+		return errSocks5Method
+	}
+
+	if method == socks5.AuthPassword {
+		// RFC 1929
+		user, pass := s.server.Username, s.server.Password
+		req := make([]byte, 0, 3+len(user)+len(pass))
+		req = append(req, 0x01, byte(len(user)))
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if buf[1] != 0x00 {
+			return errSocks5Auth
+		}
+	}
+
+	addr, err := protocol.EncodeAddr(target)
+	if err != nil {
+		return err
+	}
+	req := append([]byte{socks5.Version, socks5.CmdConnect, 0x00}, addr...)
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	// VER REP RSV, 随后为绑定地址
+	reply := make([]byte, 3)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5.Version {
+		return errSocks5Method
+	}
+	if reply[1] != 0x00 {
+		return fmt.Errorf("socks5 connect failed, reply %d", reply[1])
+	}
+	_, err = protocol.ReadAddr(conn)
+	return err
+}
@@ -0,0 +1,70 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"go.uber.org/atomic"
+)
+
+// URLTestGroup 自动选择延迟最低的可用成员
+type URLTestGroup struct {
+	*groupBase
+	// tolerance 新的最快成员比当前成员快超过该值(ms)才切换, 避免频繁抖动
+	tolerance uint16
+	fastest   *atomic.String
+}
+
+func NewURLTest(name string, proxies []Proxy, hc *HealthCheck, tolerance uint16) *URLTestGroup {
+	return &URLTestGroup{
+		groupBase: newGroupBase(name, URLTest, proxies, hc),
+		tolerance: tolerance,
+		fastest:   atomic.NewString(proxies[0].Name()),
+	}
+}
+
+func (u *URLTestGroup) Now() string {
+	return u.Pick(nil).Name()
+}
+
+func (u *URLTestGroup) Pick(*constant.Metadata) Proxy {
+	var current, fastest Proxy
+	for _, p := range u.alive() {
+		if p.Name() == u.fastest.Load() {
+			current = p
+		}
+		if fastest == nil || delayOf(p) < delayOf(fastest) {
+			fastest = p
+		}
+	}
+	if current != nil && current.Alive() && delayOf(current) <= delayOf(fastest)+uint32(u.tolerance) {
+		return current
+	}
+	u.fastest.Store(fastest.Name())
+	return fastest
+}
+
+func (u *URLTestGroup) DialContext(ctx context.Context, metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroup(ctx, u, metadata)
+}
+
+func (u *URLTestGroup) DialUDP(metadata *constant.Metadata) (net.Conn, error) {
+	return dialGroupUDP(u, metadata)
+}
+
+func (u *URLTestGroup) URLTest(ctx context.Context, url string) (uint16, error) {
+	return testGroup(ctx, u, url)
+}
+
+func (u *URLTestGroup) MarshalJSON() ([]byte, error) {
+	return u.marshal(u.Now())
+}
+
+// delayOf 未测试过的成员延迟为0, 视为最慢
+func delayOf(p Proxy) uint32 {
+	if d := p.LastDelay(); d != 0 {
+		return uint32(d)
+	}
+	return 0xffff
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import "sync"
+
+// poolBufSize 可以容纳一次写入拆分后的全部数据帧, 以及一个完整的帧体
+const poolBufSize = 128 << 10
+
+var bufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, poolBufSize)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	bufPool.Put(b)
+}
+
+// grow 保证dst还能追加n个字节, 容量不足时重新分配
+func grow(dst []byte, n int) []byte {
+	if cap(dst)-len(dst) >= n {
+		return dst
+	}
+	buf := make([]byte, len(dst), 2*cap(dst)+n)
+	copy(buf, dst)
+	return buf
+}
@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	timestampLen = 8
+	NonceLen     = 16
+	cmdLen       = 1
+	codecsLen    = 1
+	handshakeLen = timestampLen + NonceLen + cmdLen + codecsLen
+	streamLen    = 2
+)
+
+// 握手命令
+const (
+	CmdConnect byte = 1 // 单连接单流
+	CmdMux     byte = 2 // 多路复用会话
+)
+
+var ErrInvalidHeader = errors.New("invalid header")
+
+// Header 客户端握手时发送的第一个数据帧
+//
+// * +-----------+---------+-----+---+----------+----------------+
+// * | timestamp |  nonce  | cmd | n |  codecs  |    metadata    |
+// * +-----------+---------+-----+---+----------+----------------+
+// * |     8     |   16    |  1  | 1 |    n     |    variable    |
+// * +-----------+---------+-----+---+----------+----------------+
+//
+// codecs 为客户端按优先顺序提议的压缩算法ID, 服务端选择其中一个用于发送
+type Header struct {
+	Timestamp time.Time
+	Nonce     []byte
+	Cmd       byte
+	Codecs    []byte
+	Metadata  string
+}
+
+func NewHeader(cmd byte, metadata string) (*Header, error) {
+	nonce := make([]byte, NonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &Header{
+		Timestamp: time.Now(),
+		Nonce:     nonce,
+		Cmd:       cmd,
+		Metadata:  metadata,
+	}, nil
+}
+
+func (h *Header) Encode() []byte {
+	buf := make([]byte, handshakeLen+len(h.Codecs)+len(h.Metadata))
+	packetEndian.PutUint64(buf, uint64(h.Timestamp.Unix()))
+	copy(buf[timestampLen:], h.Nonce)
+	buf[timestampLen+NonceLen] = h.Cmd
+	buf[handshakeLen-codecsLen] = byte(len(h.Codecs))
+	copy(buf[handshakeLen:], h.Codecs)
+	copy(buf[handshakeLen+len(h.Codecs):], h.Metadata)
+	return buf
+}
+
+func DecodeHeader(b []byte) (*Header, error) {
+	if len(b) < handshakeLen {
+		return nil, ErrInvalidHeader
+	}
+	end := handshakeLen + int(b[handshakeLen-codecsLen])
+	if end > len(b) {
+		return nil, ErrInvalidHeader
+	}
+	return &Header{
+		Timestamp: time.Unix(int64(packetEndian.Uint64(b)), 0),
+		Nonce:     b[timestampLen : timestampLen+NonceLen],
+		Cmd:       b[timestampLen+NonceLen],
+		Codecs:    b[handshakeLen:end],
+		Metadata:  string(b[end:]),
+	}, nil
+}
+
+// IsLegacyHeader 旧版客户端的握手只有 metadata 字符串, 以可见字符开头;
+// 新版握手以时间戳开头, 首字节必然为0
+func IsLegacyHeader(b []byte) bool {
+	return len(b) > 0 && b[0] != 0
+}
+
+// WriteStreamHeader 多路复用的流以长度前缀的 metadata 开头
+//
+// * +--------+----------------+
+// * |  len   |    metadata    |
+// * +--------+----------------+
+// * |   2    |    variable    |
+// * +--------+----------------+
+func WriteStreamHeader(w io.Writer, metadata string) error {
+	buf := make([]byte, streamLen+len(metadata))
+	packetEndian.PutUint16(buf, uint16(len(metadata)))
+	copy(buf[streamLen:], metadata)
+	_, err := w.Write(buf)
+	return err
+}
+
+func ReadStreamHeader(r io.Reader) (string, error) {
+	buf := make([]byte, streamLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	buf = make([]byte, packetEndian.Uint16(buf))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
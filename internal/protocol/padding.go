@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"strings"
+)
+
+// 数据帧的填充方案, 只影响发送方, 两端可以使用不同的方案
+const (
+	PaddingNone   = "none"   // 不填充, 按最大长度拆分
+	PaddingRandom = "random" // 随机填充并按随机长度拆分, 默认
+	PaddingFull   = "full"   // 在 random 的基础上把小的数据帧填充至接近MTU
+)
+
+// maxChunk 单个数据帧承载的最大明文长度
+const maxChunk = 16 << 10
+
+// Padding 填充位于加密的帧体内, 长度同样加密, 对外只可见加密后的帧长度
+type Padding struct {
+	MaxPad   int // 每帧随机填充 [0, MaxPad] 字节
+	MinFrame int // 帧体小于该长度时填充至该长度以上
+	MinChunk int // 写入的数据按 [MinChunk, MaxChunk] 的随机长度拆分为多个帧
+	MaxChunk int
+}
+
+var (
+	DefaultPadding = paddings[PaddingRandom]
+
+	paddings = map[string]*Padding{
+		PaddingNone:   {MinChunk: maxChunk, MaxChunk: maxChunk},
+		PaddingRandom: {MaxPad: 255, MinChunk: 4 << 10, MaxChunk: maxChunk},
+		PaddingFull:   {MaxPad: 255, MinFrame: 1024, MinChunk: 1 << 10, MaxChunk: 8 << 10},
+	}
+)
+
+// ParsePadding 按名称返回填充方案, 为空时返回默认方案
+func ParsePadding(name string) (*Padding, error) {
+	if name == "" {
+		return DefaultPadding, nil
+	}
+	p, ok := paddings[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported padding %s", name)
+	}
+	return p, nil
+}
+
+// chunk 下一个数据帧承载的明文长度
+func (p *Padding) chunk(n int) int {
+	size := p.MaxChunk
+	if p.MaxChunk > p.MinChunk {
+		size = p.MinChunk + mrand.Intn(p.MaxChunk-p.MinChunk+1)
+	}
+	if n < size {
+		return n
+	}
+	return size
+}
+
+// size 长度为n的帧体需要填充的字节数
+func (p *Padding) size(n int) int {
+	var pad int
+	if n < p.MinFrame {
+		pad = p.MinFrame - n
+	}
+	if p.MaxPad > 0 {
+		pad += mrand.Intn(p.MaxPad + 1)
+	}
+	return pad
+}
@@ -1,14 +1,17 @@
 package protocol
 
 import (
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
-	"math/rand"
+	mrand "math/rand"
 
 	"github.com/sirupsen/logrus"
-	"github.com/xmapst/lightsocks/internal/cipher"
+	C "github.com/xmapst/lightsocks/internal/cipher"
 	"github.com/xmapst/lightsocks/internal/compress"
+	"go.uber.org/atomic"
 )
 
 type Packet struct {
@@ -21,85 +24,501 @@ const (
 	randLen    = uint32(2)
 	headerLen  = int(payloadLen + randLen)
 	maxByte    = 1 << 24
+	lengthLen  = 2 // 加密的帧体长度
+	padLen     = 2 // 帧体内的填充长度
+	codecLen   = 1 // 帧体内的压缩算法ID
+	// maxOverhead AEAD 的最大认证标签长度
+	maxOverhead = 16
+	// maxPayload 单个数据帧解压后的最大长度
+	maxPayload = 1 << 16
 )
 
 var (
-	packetEndian        = binary.BigEndian
-	ErrIncompletePacket = errors.New("incomplete packet")
-	ErrTooLargePacket   = errors.New("too large packet")
+	packetEndian      = binary.BigEndian
+	ErrTooLargePacket = errors.New("too large packet")
+	ErrInvalidPacket  = errors.New("invalid packet")
+	// ErrCodecNotAllowed 数据帧使用了未协商的压缩算法
+	ErrCodecNotAllowed = errors.New("codec not allowed")
 )
 
 // Protocol format:
 //
-// * 0                 4      2
-// * +-----------------+------+
-// * |    body len     | rand |
-// * +------+--------+--------+
-// * |                        |
-// * +                        +
-// * |        body bytes      |
-// * +                        +
-// * |         ... ...        |
-// * +-------------------------
+// 每个方向的数据流以随机盐值开头, 通过 HKDF(token, salt) 派生会话密钥,
+// 之后每个数据帧的长度及帧体分别使用递增的 nonce 进行 AEAD 加密
+// 服务端配置了多个客户端凭据时, 盐值之后紧跟混淆后的token标识, 见 cipher.WithID
+// 帧体内为填充长度, 压缩算法ID, 压缩后的数据及填充, 填充方案见 Padding
+// 压缩算法在握手时协商: 客户端在握手头提议, 服务端回复的第一个数据帧为选择的算法ID,
+// 之后双方只接受该算法及ID 0 的数据帧, 压缩率差的数据帧以ID 0 发送原始数据,
+// 见 Writer.WriteCodec 及 Reader.ExpectCodec
+//
+// * +--------------------------------+
+// * |      salt (per direction)      |
+// * +--------------------------------+
+// * |     AEAD sealed body len       |
+// * +--------------------------------+
+// * |       AEAD sealed body         |
+// * |  +-----+-------+------+-----+  |
+// * |  | pad | codec | data | pad |  |
+// * |  | len |  id   |      |bytes|  |
+// * |  +-----+-------+------+-----+  |
+// * +--------------------------------+
+// * |            ... ...             |
+// * +--------------------------------+
+//
+// legacy 加密方式保持旧版的格式, 帧头为明文的帧体长度(4)及随机数(2)
+
+// MinHandshake 客户端握手第一次写入的最小长度, 盐值及第一个数据帧的长度
+// 客户端一次写入盐值及握手头, 第一段数据不足该长度的不是lightsocks客户端
+func MinHandshake(c C.Cipher) int {
+	if C.IsLegacy(c) {
+		return headerLen
+	}
+	return c.SaltSize() + lengthLen + maxOverhead
+}
 
 func random(i int) int {
 	if i <= 0 {
-		return rand.Intn(99) + 1
+		return mrand.Intn(99) + 1
 	} else {
-		return i % (rand.Intn(99) + 1)
+		return i % (mrand.Intn(99) + 1)
+	}
+}
+
+// 自适应压缩, 连续 poorFrames 个数据帧压缩率超过 poorRatio 时
+// 之后的 probeFrames 个数据帧不再压缩, 然后重新尝试
+const (
+	poorRatio   = 0.9
+	poorFrames  = 8
+	probeFrames = 256
+)
+
+// Writer 加密写入数据帧, 首次写入时发送盐值
+type Writer struct {
+	w       io.Writer
+	cipher  C.Cipher
+	legacy  bool
+	padding *Padding
+	codec   compress.Codec
+	stats   *compress.Stats
+	poor    int // 连续压缩率差的帧数
+	skip    int // 剩余不压缩的帧数
+	aead    cipher.AEAD
+	nonce   []byte
+	// adopted 读取方向收到的协商结果, 下次写入时生效
+	adopted *atomic.Pointer[compress.Codec]
+}
+
+func NewWriter(w io.Writer, c C.Cipher) *Writer {
+	writer := &Writer{
+		w:       w,
+		cipher:  c,
+		legacy:  C.IsLegacy(c),
+		padding: DefaultPadding,
+		adopted: atomic.NewPointer[compress.Codec](nil),
+	}
+	writer.SetCodec(compress.DefaultCodecs[0])
+	return writer
+}
+
+// SetPadding 设置填充方案, nil 表示不填充
+func (w *Writer) SetPadding(p *Padding) {
+	if p == nil {
+		p = paddings[PaddingNone]
+	}
+	w.padding = p
+}
+
+// SetCodec 设置发送数据帧的压缩算法, nil 表示不压缩, 需在首次写入前调用
+// legacy 加密方式固定使用旧版格式, 不统计
+func (w *Writer) SetCodec(c compress.Codec) {
+	if c == nil {
+		c = compress.ByID(0)
+	}
+	w.codec = c
+	w.poor, w.skip = 0, 0
+	if w.legacy {
+		return
+	}
+	if w.stats == nil {
+		w.stats = compress.NewStats(c)
+	} else {
+		w.stats.SetCodec(c)
+	}
+}
+
+// Adopt 使用服务端选择的压缩算法, 可以与写入并发调用, 下次写入时生效
+func (w *Writer) Adopt(c compress.Codec) {
+	w.adopted.Store(&c)
+}
+
+// WriteCodec 服务端回复选择的压缩算法, 回复不压缩, 之后的数据帧使用该算法
+// legacy 加密方式没有协商, 不回复
+func (w *Writer) WriteCodec(c compress.Codec) error {
+	if w.legacy {
+		return nil
+	}
+	if c == nil {
+		c = compress.ByID(0)
+	}
+	w.SetCodec(nil)
+	if _, err := w.WritePacket([]byte{c.ID()}); err != nil {
+		return err
+	}
+	w.SetCodec(c)
+	return nil
+}
+
+// Stats 发送方向的压缩统计, legacy 加密方式时为nil
+func (w *Writer) Stats() *compress.Stats {
+	return w.stats
+}
+
+func (w *Writer) init() ([]byte, error) {
+	salt, err := newSalt(w.cipher)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := w.cipher.NewAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	w.aead = aead
+	w.nonce = make([]byte, aead.NonceSize())
+	return salt, nil
+}
+
+func newSalt(c C.Cipher) ([]byte, error) {
+	if g, ok := c.(C.SaltGenerator); ok {
+		return g.NewSalt()
+	}
+	salt := make([]byte, c.SaltSize())
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// WritePacket 把bin按填充方案拆分为多个数据帧, 压缩加密后一次写入
+// 数据帧在缓冲池的缓冲区内原地压缩加密, 不分配内存
+func (w *Writer) WritePacket(bin []byte) (int, error) {
+	var salt []byte
+	if w.aead == nil {
+		var err error
+		salt, err = w.init()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if w.legacy {
+		return w.writeLegacy(salt, bin)
+	}
+	if c := w.adopted.Swap(nil); c != nil {
+		w.SetCodec(*c)
+	}
+	bufp := getBuffer()
+	defer putBuffer(bufp)
+	buffer := append((*bufp)[:0], salt...)
+	for remain := bin; len(remain) > 0; {
+		n := w.padding.chunk(len(remain))
+		buffer = w.appendFrame(buffer, remain[:n])
+		remain = remain[n:]
+	}
+	// 保留扩容后的缓冲区
+	*bufp = buffer[:cap(buffer)]
+	if _, err := w.w.Write(buffer); err != nil {
+		return 0, err
+	}
+	return len(bin), nil
+}
+
+// appendFrame 把一个数据帧追加到dst
+//
+// * | sealed len | len tag | pad len | codec id | data | pad bytes | body tag |
+func (w *Writer) appendFrame(dst, chunk []byte) []byte {
+	overhead := w.aead.Overhead()
+	maxPad := w.padding.MinFrame + w.padding.MaxPad
+	dst = grow(dst, lengthLen+padLen+codecLen+w.codec.MaxEncodedLen(len(chunk))+maxPad+2*overhead)
+	start := len(dst)
+	bodyStart := start + lengthLen + overhead
+	dataStart := bodyStart + padLen + codecLen
+	frame := dst[:cap(dst)]
+
+	// 压缩到帧体内, 不压缩或压缩后没有变小时发送原始数据
+	var zipBin []byte
+	codec := w.compressor()
+	if codec != nil {
+		zipBin = codec.Encode(frame[dataStart:], chunk)
+		w.adapt(len(chunk), len(zipBin))
+	}
+	if zipBin == nil {
+		codec = compress.ByID(0)
+		zipBin = frame[dataStart : dataStart+len(chunk)]
+		copy(zipBin, chunk)
+	}
+	w.stats.Add(len(chunk), len(zipBin))
+	frame[dataStart-codecLen] = codec.ID()
+	dataEnd := dataStart + len(zipBin)
+	pad := w.padding.size(padLen + codecLen + len(zipBin))
+	// 缓冲区来自缓冲池, 填充需清零, 避免发送其它连接的数据
+	padding := frame[dataEnd : dataEnd+pad]
+	for i := range padding {
+		padding[i] = 0
+	}
+	body := frame[bodyStart : dataEnd+pad]
+	packetEndian.PutUint16(body, uint16(pad))
+
+	// 原地加密长度及帧体
+	length := frame[start : start+lengthLen]
+	packetEndian.PutUint16(length, uint16(len(body)+overhead))
+	w.aead.Seal(length[:0], w.nonce, length, nil)
+	C.Increment(w.nonce)
+	w.aead.Seal(body[:0], w.nonce, body, nil)
+	C.Increment(w.nonce)
+	return frame[:dataEnd+pad+overhead]
+}
+
+// compressor 本帧使用的压缩算法, 不压缩时返回nil
+func (w *Writer) compressor() compress.Codec {
+	if w.codec.ID() == 0 {
+		return nil
+	}
+	if w.skip > 0 {
+		w.skip--
+		return nil
+	}
+	return w.codec
+}
+
+// adapt 根据本帧的压缩率决定是否暂停压缩, out 为0时表示不可压缩
+func (w *Writer) adapt(in, out int) {
+	if out > 0 && float64(out) <= poorRatio*float64(in) {
+		w.poor = 0
+		w.stats.SetActive(true)
+		return
+	}
+	w.poor++
+	if w.poor >= poorFrames {
+		// 重新尝试的帧压缩率仍然差时立即再次暂停
+		w.poor = poorFrames - 1
+		w.skip = probeFrames
+		w.stats.SetActive(false)
 	}
 }
 
-func Encode(key, bin []byte) ([]byte, error) {
+// writeLegacy 旧版格式, 每次写入为一个数据帧
+func (w *Writer) writeLegacy(salt, bin []byte) (int, error) {
 	randNu := random(len(bin))
 	// 压缩
 	zipBin, err := compress.Zip(bin)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	// 加密
-	encryptBuff := cipher.Encrypt(zipBin, key)
 
-	msgLen := headerLen + len(encryptBuff)
-	buffer := make([]byte, uint32(msgLen))
+	buffer := make([]byte, len(salt)+headerLen, len(salt)+headerLen+len(zipBin)+w.aead.Overhead())
+	copy(buffer, salt)
+	// 加密
+	buffer = w.aead.Seal(buffer, w.nonce, zipBin, nil)
+	C.Increment(w.nonce)
 
 	// 添加头部信息
-	packetEndian.PutUint32(buffer, uint32(len(encryptBuff)))
-	packetEndian.PutUint16(buffer[payloadLen:], uint16(randNu))
+	header := buffer[len(salt) : len(salt)+headerLen]
+	packetEndian.PutUint32(header, uint32(len(buffer)-len(salt)-headerLen))
+	packetEndian.PutUint16(header[payloadLen:], uint16(randNu))
+
+	if _, err = w.w.Write(buffer); err != nil {
+		return 0, err
+	}
+	return len(bin), nil
+}
+
+// Reader 读取并解密数据帧, 首次读取时读取盐值
+type Reader struct {
+	r      io.Reader
+	cipher C.Cipher
+	legacy bool
+	aead   cipher.AEAD
+	nonce  []byte
+	sealed [lengthLen + maxOverhead]byte
+	packet Packet
+	// payload 上次返回的数据所在的缓冲区, 下次读取时放回缓冲池
+	payload *[]byte
+	// allowed 接受的压缩算法, nil 时接受全部算法, ID 0 总是接受
+	allowed []compress.Codec
+	// proposed 客户端提议的算法, 非nil时第一个数据帧为服务端的回复
+	proposed []compress.Codec
+	adopt    func(compress.Codec)
+}
+
+func NewReader(r io.Reader, c C.Cipher) *Reader {
+	return &Reader{r: r, cipher: c, legacy: C.IsLegacy(c)}
+}
 
-	// 拷贝数据
-	copy(buffer[headerLen:msgLen], encryptBuff)
-	return buffer[:msgLen], nil
+// SetAllowed 只接受使用c压缩的数据帧, 其它算法的数据帧返回 ErrCodecNotAllowed
+func (r *Reader) SetAllowed(c compress.Codec) {
+	r.allowed = []compress.Codec{c}
 }
 
-func UnPack(key, buf []byte) (*Packet, error) {
-	if len(buf) < headerLen {
-		return nil, ErrIncompletePacket
+// ExpectCodec 客户端读取服务端回复的压缩算法, 必须为 proposed 之一或不压缩,
+// 之后只接受该算法并通过 adopt 通知发送方向, legacy 加密方式不回复
+func (r *Reader) ExpectCodec(proposed []compress.Codec, adopt func(compress.Codec)) {
+	r.proposed = proposed
+	r.adopt = adopt
+}
+
+func (r *Reader) init() error {
+	salt := make([]byte, r.cipher.SaltSize())
+	if _, err := io.ReadFull(r.r, salt); err != nil {
+		return err
 	}
-	bodyLen := packetEndian.Uint32(buf[:payloadLen])
-	randNu := packetEndian.Uint16(buf[payloadLen:headerLen])
-	msgLen := headerLen + int(bodyLen)
-	if len(buf) < msgLen {
-		return nil, ErrIncompletePacket
+	aead, err := r.cipher.NewAEAD(salt)
+	if err != nil {
+		return err
+	}
+	r.aead = aead
+	r.nonce = make([]byte, aead.NonceSize())
+	return nil
+}
+
+// ReadPacket 读取一个完整的数据帧并解密解压, 跳过只有填充的数据帧
+// 返回的 Packet 及 Payload 在下次调用 ReadPacket 前有效
+func (r *Reader) ReadPacket() (*Packet, error) {
+	if r.aead == nil {
+		if err := r.init(); err != nil {
+			return nil, err
+		}
+	}
+	if r.legacy {
+		return r.readLegacy()
+	}
+	// 等待下一个数据帧前归还缓冲区, 空闲的连接不占用缓冲区
+	r.release()
+	if r.proposed != nil {
+		if err := r.readCodec(); err != nil {
+			return nil, err
+		}
+	}
+	return r.readPacket()
+}
+
+// readCodec 读取服务端的协商回复
+func (r *Reader) readCodec() error {
+	packet, err := r.readPacket()
+	if err != nil {
+		return err
+	}
+	if len(packet.Payload) != 1 {
+		return ErrInvalidPacket
+	}
+	codec := compress.ByID(packet.Payload[0])
+	r.release()
+	if codec == nil {
+		return ErrCodecNotAllowed
+	}
+	if codec.ID() != 0 && !contains(r.proposed, codec) {
+		return ErrCodecNotAllowed
+	}
+	r.proposed = nil
+	r.SetAllowed(codec)
+	if r.adopt != nil {
+		r.adopt(codec)
+	}
+	return nil
+}
+
+func (r *Reader) readPacket() (*Packet, error) {
+	for {
+		// 解密长度
+		sealed := r.sealed[:]
+		if overhead := r.aead.Overhead(); overhead <= maxOverhead {
+			sealed = sealed[:lengthLen+overhead]
+		} else {
+			sealed = make([]byte, lengthLen+overhead)
+		}
+		if _, err := io.ReadFull(r.r, sealed); err != nil {
+			return nil, err
+		}
+		length, err := r.aead.Open(sealed[:0], r.nonce, sealed, nil)
+		if err != nil {
+			return nil, err
+		}
+		C.Increment(r.nonce)
+		// 解密帧体
+		bufp := getBuffer()
+		payload, err := r.readBody(*bufp, int(packetEndian.Uint16(length)))
+		putBuffer(bufp)
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil {
+			return payload, nil
+		}
+	}
+}
+
+// readBody 读取帧体并解压, 只有填充时返回nil
+func (r *Reader) readBody(buf []byte, n int) (*Packet, error) {
+	buf = buf[:n]
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return nil, err
+	}
+	body, err := r.aead.Open(buf[:0], r.nonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	C.Increment(r.nonce)
+	if len(body) < padLen+codecLen {
+		return nil, ErrInvalidPacket
+	}
+	pad := int(packetEndian.Uint16(body))
+	if padLen+codecLen+pad > len(body) {
+		return nil, ErrInvalidPacket
+	}
+	codec := compress.ByID(body[padLen])
+	if codec == nil {
+		return nil, ErrInvalidPacket
+	}
+	if codec.ID() != 0 && r.allowed != nil && !contains(r.allowed, codec) {
+		return nil, ErrCodecNotAllowed
+	}
+	data := body[padLen+codecLen : len(body)-pad]
+	if len(data) == 0 {
+		return nil, nil
 	}
-	// 解密
-	decryptBuf := cipher.Decrypt(buf[headerLen:msgLen], key)
 	// 解压
-	unzipBuf, err := compress.Unzip(decryptBuf)
+	payloadp := getBuffer()
+	payload, err := codec.Decode(*payloadp, data, maxPayload)
 	if err != nil {
+		putBuffer(payloadp)
 		logrus.Errorln(err.Error())
 		return nil, err
 	}
-	packet := &Packet{
-		RandNu:  int(randNu),
-		Payload: unzipBuf,
+	r.payload = payloadp
+	r.packet.RandNu = pad
+	r.packet.Payload = payload
+	return &r.packet, nil
+}
+
+func contains(codecs []compress.Codec, c compress.Codec) bool {
+	for _, v := range codecs {
+		if v.ID() == c.ID() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reader) release() {
+	if r.payload != nil {
+		putBuffer(r.payload)
+		r.payload = nil
+		r.packet.Payload = nil
 	}
-	return packet, nil
 }
 
-func ReadFull(key []byte, r io.Reader) (*Packet, error) {
+// readLegacy 读取旧版格式的数据帧
+func (r *Reader) readLegacy() (*Packet, error) {
 	preBuff := make([]byte, headerLen)
-	_, err := io.ReadFull(r, preBuff)
+	_, err := io.ReadFull(r.r, preBuff)
 	if err != nil {
 		return nil, err
 	}
@@ -109,12 +528,16 @@ func ReadFull(key []byte, r io.Reader) (*Packet, error) {
 		return nil, ErrTooLargePacket
 	}
 	buf := make([]byte, bodyLen)
-	_, err = io.ReadFull(r, buf)
+	_, err = io.ReadFull(r.r, buf)
 	if err != nil {
 		return nil, err
 	}
 	// 解密
-	decryptBuf := cipher.Decrypt(buf, key)
+	decryptBuf, err := r.aead.Open(buf[:0], r.nonce, buf, nil)
+	if err != nil {
+		return nil, err
+	}
+	C.Increment(r.nonce)
 	// 解压
 	unzipBuf, err := compress.Unzip(decryptBuf)
 	if err != nil {
@@ -0,0 +1,217 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	C "github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/compress"
+)
+
+var benchSizes = []int{512, 4 << 10, 16 << 10}
+
+func benchPayload(size int) []byte {
+	// 一半随机数据一半重复数据, 接近实际流量的压缩率
+	b := make([]byte, size)
+	_, _ = rand.Read(b[:size/2])
+	return b
+}
+
+// benchCiphers legacy 为旧版的帧格式, 每帧分配缓冲区并整帧压缩, 作为对比
+var benchCiphers = []struct {
+	name   string
+	method string
+}{
+	{"legacy", C.Legacy},
+	{"pooled", C.AES256GCM},
+}
+
+func benchCipher(b *testing.B, method string) C.Cipher {
+	c, err := C.New(method, "benchmark")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func BenchmarkWritePacket(b *testing.B) {
+	for _, bc := range benchCiphers {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, size), func(b *testing.B) {
+				payload := benchPayload(size)
+				w := NewWriter(io.Discard, benchCipher(b, bc.method))
+				w.SetPadding(nil)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := w.WritePacket(payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkReadPacket(b *testing.B) {
+	const frames = 256
+	for _, bc := range benchCiphers {
+		for _, size := range benchSizes {
+			b.Run(fmt.Sprintf("%s/%d", bc.name, size), func(b *testing.B) {
+				c := benchCipher(b, bc.method)
+				payload := benchPayload(size)
+				// 预先生成数据流, 读完后重新开始
+				stream := new(bytes.Buffer)
+				w := NewWriter(stream, c)
+				w.SetPadding(nil)
+				for i := 0; i < frames; i++ {
+					if _, err := w.WritePacket(payload); err != nil {
+						b.Fatal(err)
+					}
+				}
+				src := bytes.NewReader(stream.Bytes())
+				r := NewReader(src, c)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if i%frames == 0 && i > 0 {
+						r.release()
+						src.Reset(stream.Bytes())
+						r = NewReader(src, c)
+					}
+					if _, err := r.ReadPacket(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func testCipher(t *testing.T) C.Cipher {
+	c, err := C.New(C.AES256GCM, "negotiate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// negotiate 模拟一次握手, 返回客户端及服务端的读写方向
+func negotiate(t *testing.T, client, server []compress.Codec) (*Writer, *Reader, *Writer, *Reader) {
+	c := testCipher(t)
+	up, down := new(bytes.Buffer), new(bytes.Buffer)
+	cw, cr := NewWriter(up, c), NewReader(down, c)
+	sw, sr := NewWriter(down, c), NewReader(up, c)
+	// 不拆分数据帧, 一次写入对应一次读取
+	cw.SetPadding(nil)
+	sw.SetPadding(nil)
+	cw.SetCodec(nil)
+	cr.ExpectCodec(client, cw.Adopt)
+
+	header, err := NewHeader(CmdConnect, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range client {
+		header.Codecs = append(header.Codecs, codec.ID())
+	}
+	if _, err = cw.WritePacket(header.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := sr.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err = DecodeHeader(packet.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := compress.Choose(header.Codecs, server)
+	sr.SetAllowed(codec)
+	if err = sw.WriteCodec(codec); err != nil {
+		t.Fatal(err)
+	}
+	return cw, cr, sw, sr
+}
+
+func TestCodecNegotiation(t *testing.T) {
+	// 客户端首选的 zstd 服务端不允许, 双方都应使用 snappy
+	client := []compress.Codec{compress.ByName(compress.Zstd), compress.ByName(compress.Snappy)}
+	server := []compress.Codec{compress.ByName(compress.LZ4), compress.ByName(compress.Snappy)}
+	cw, cr, sw, sr := negotiate(t, client, server)
+
+	payload := bytes.Repeat([]byte("lightsocks "), 512)
+	if _, err := sw.WritePacket(payload); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := cr.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Payload, payload) {
+		t.Fatal("downstream payload mismatch")
+	}
+	if _, err = cw.WritePacket(payload); err != nil {
+		t.Fatal(err)
+	}
+	if name := cw.Stats().Codec().Name(); name != compress.Snappy {
+		t.Fatalf("client codec %s, want %s", name, compress.Snappy)
+	}
+	packet, err = sr.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(packet.Payload, payload) {
+		t.Fatal("upstream payload mismatch")
+	}
+	if ratio := cw.Stats().Ratio(); ratio >= 1 {
+		t.Fatalf("client did not compress, ratio %f", ratio)
+	}
+}
+
+func TestCodecNotAllowed(t *testing.T) {
+	client := []compress.Codec{compress.ByName(compress.Zstd), compress.ByName(compress.Snappy)}
+	server := []compress.Codec{compress.ByName(compress.Snappy)}
+	cw, cr, sw, sr := negotiate(t, client, server)
+	if _, err := sw.WritePacket([]byte("reply")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cw.WritePacket([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.ReadPacket(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不按协商结果发送的数据帧被拒绝
+	cw.SetCodec(compress.ByName(compress.Zstd))
+	if _, err := cw.WritePacket(bytes.Repeat([]byte("lightsocks "), 512)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sr.ReadPacket(); !errors.Is(err, ErrCodecNotAllowed) {
+		t.Fatalf("got %v, want %v", err, ErrCodecNotAllowed)
+	}
+}
+
+func TestCodecReplyNotProposed(t *testing.T) {
+	// 服务端回复客户端没有提议的算法时客户端拒绝
+	c := testCipher(t)
+	down := new(bytes.Buffer)
+	sw, cr := NewWriter(down, c), NewReader(down, c)
+	cr.ExpectCodec([]compress.Codec{compress.ByName(compress.Snappy)}, nil)
+	if err := sw.WriteCodec(compress.ByName(compress.LZ4)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cr.ReadPacket(); !errors.Is(err, ErrCodecNotAllowed) {
+		t.Fatalf("got %v, want %v", err, ErrCodecNotAllowed)
+	}
+}
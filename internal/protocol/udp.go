@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+const maxUDPPacket = 1<<16 - 1
+
+var ErrInvalidAddr = errors.New("invalid address")
+
+// EncodeAddr 按 socks5 地址格式编码 host:port
+//
+// * +------+----------+----------+
+// * | ATYP | DST.ADDR | DST.PORT |
+// * +------+----------+----------+
+// * |  1   | Variable |    2     |
+// * +------+----------+----------+
+func EncodeAddr(addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidAddr
+	}
+	var buf []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append([]byte{constant.ATypeIPv4}, ip4...)
+		} else {
+			buf = append([]byte{constant.ATypeIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, ErrInvalidAddr
+		}
+		buf = append([]byte{constant.ATypeDomainName, byte(len(host))}, host...)
+	}
+	return packetEndian.AppendUint16(buf, uint16(portNum)), nil
+}
+
+// ReadAddr 读取 socks5 格式的地址, 返回 host:port
+func ReadAddr(r io.Reader) (string, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case constant.ATypeIPv4, constant.ATypeIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == constant.ATypeIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case constant.ATypeDomainName:
+		if _, err := io.ReadFull(r, atyp); err != nil {
+			return "", err
+		}
+		domain := make([]byte, atyp[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", ErrInvalidAddr
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(packetEndian.Uint16(port)))), nil
+}
+
+// WriteUDPPacket 在流上传输的 UDP 数据包
+//
+// * +------+----------+----------+--------+----------+
+// * | ATYP | DST.ADDR | DST.PORT | LENGTH |   DATA   |
+// * +------+----------+----------+--------+----------+
+// * |  1   | Variable |    2     |   2    | Variable |
+// * +------+----------+----------+--------+----------+
+func WriteUDPPacket(w io.Writer, addr string, data []byte) error {
+	if len(data) > maxUDPPacket {
+		return ErrTooLargePacket
+	}
+	buf, err := EncodeAddr(addr)
+	if err != nil {
+		return err
+	}
+	buf = packetEndian.AppendUint16(buf, uint16(len(data)))
+	buf = append(buf, data...)
+	_, err = w.Write(buf)
+	return err
+}
+
+func ReadUDPPacket(r io.Reader) (string, []byte, error) {
+	addr, err := ReadAddr(r)
+	if err != nil {
+		return "", nil, err
+	}
+	length := make([]byte, 2)
+	if _, err = io.ReadFull(r, length); err != nil {
+		return "", nil, err
+	}
+	data := make([]byte, packetEndian.Uint16(length))
+	if _, err = io.ReadFull(r, data); err != nil {
+		return "", nil, err
+	}
+	return addr, data, nil
+}
@@ -0,0 +1,81 @@
+package redir
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// Listener iptables REDIRECT 透明代理, 从连接中读取原始目标地址
+type Listener struct {
+	listener net.Listener
+	addr     string
+}
+
+func (l *Listener) Address() string {
+	return l.addr
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func New(addr string, tcpIn chan<- *constant.TCPContext) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	rl := &Listener{
+		listener: l,
+		addr:     addr,
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if strings.Contains(err.Error(), net.ErrClosed.Error()) {
+					break
+				}
+				continue
+			}
+			go handleRedir(c, tcpIn)
+		}
+	}()
+	return rl, nil
+}
+
+func handleRedir(conn net.Conn, tcpIn chan<- *constant.TCPContext) {
+	id, _ := uuid.NewV4()
+	target, err := parserPacket(conn)
+	if err != nil {
+		logrus.Errorln(id, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	client, err := constant.UnmarshalIP(conn.RemoteAddr().String())
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	source, err := constant.UnmarshalIP(conn.LocalAddr().String())
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.(*net.TCPConn).SetKeepAlive(true)
+	tcpIn <- &constant.TCPContext{
+		SrcConn: conn,
+		Metadata: &constant.Metadata{
+			ID:      id,
+			NetWork: constant.TCP,
+			Type:    constant.REDIR,
+			Client:  client,
+			Source:  source,
+			Target:  target,
+			Inbound: "redir",
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package redir
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst linux/netfilter_ipv6/ip6_tables.h
+const ip6tSoOriginalDst = 80
+
+// parserPacket 通过 SO_ORIGINAL_DST 获取被重定向前的目标地址
+func parserPacket(conn net.Conn) (*constant.IP, error) {
+	c, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("only work with TCP connection")
+	}
+
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	var port int
+	var innerErr error
+	err = rc.Control(func(fd uintptr) {
+		if c.LocalAddr().(*net.TCPAddr).IP.To4() != nil {
+			ip, port, innerErr = getOrigDst4(fd)
+		} else {
+			ip, port, innerErr = getOrigDst6(fd)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if innerErr != nil {
+		return nil, innerErr
+	}
+	return constant.UnmarshalIP(net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+}
+
+// getOrigDst4 returns the original destination of an IPv4 connection,
+// the kernel fills a sockaddr_in into the 16 bytes ipv6_mreq buffer.
+func getOrigDst4(fd uintptr) (net.IP, int, error) {
+	raw, err := unix.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, 0, err
+	}
+	addr := raw.Multiaddr
+	ip := net.IPv4(addr[4], addr[5], addr[6], addr[7])
+	port := int(addr[2])<<8 | int(addr[3])
+	return ip, port, nil
+}
+
+// getOrigDst6 returns the original destination of an IPv6 connection
+func getOrigDst6(fd uintptr) (net.IP, int, error) {
+	raw, err := unix.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+	if err != nil {
+		return nil, 0, err
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, raw.Addr.Addr[:])
+	// sin6_port 为网络字节序
+	b := (*[2]byte)(unsafe.Pointer(&raw.Addr.Port))
+	port := int(b[0])<<8 | int(b[1])
+	return ip, port, nil
+}
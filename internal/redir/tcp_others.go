@@ -0,0 +1,14 @@
+//go:build !linux
+
+package redir
+
+import (
+	"errors"
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+func parserPacket(conn net.Conn) (*constant.IP, error) {
+	return nil, errors.New("redir is only supported on linux")
+}
@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/fakeip"
 	"github.com/xmapst/lightsocks/internal/trie"
 )
 
@@ -23,6 +25,9 @@ var (
 
 	// DefaultDNSTimeout defined the default dns request timeout
 	DefaultDNSTimeout = time.Second * 5
+
+	// DefaultFakeIPPool 开启fake-ip时的虚假ip池, 未开启时为nil
+	DefaultFakeIPPool *fakeip.Pool
 )
 
 var (
@@ -167,3 +172,36 @@ func ResolveIP(host string) (net.IP, error) {
 	}
 	return ips[rand.Intn(len(ips))], nil
 }
+
+// ResolveUDPAddr 解析 host:port 形式的UDP地址, 域名使用 ResolveIP 解析
+func ResolveUDPAddr(addr string) (*net.UDPAddr, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := ResolveIP(host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ip, Port: int(portNum)}, nil
+}
+
+// IsFakeIP 是否为虚假ip池中的地址
+func IsFakeIP(ip net.IP) bool {
+	if pool := DefaultFakeIPPool; pool != nil {
+		return pool.Exist(ip)
+	}
+	return false
+}
+
+// FindHostByIP 返回虚假ip对应的域名
+func FindHostByIP(ip net.IP) (string, bool) {
+	if pool := DefaultFakeIPPool; pool != nil {
+		return pool.LookBack(ip)
+	}
+	return "", false
+}
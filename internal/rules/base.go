@@ -0,0 +1,74 @@
+package rules
+
+import (
+	"errors"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// Built-in adapters a rule can route to, PROXY falls back to DIRECT when not defined
+const (
+	Direct = "DIRECT"
+	Proxy  = "PROXY"
+	Reject = "REJECT"
+)
+
+const noResolve = "no-resolve"
+
+var (
+	errPayload = errors.New("payload error")
+	errAdapter = errors.New("adapter error")
+)
+
+type RuleType int
+
+const (
+	Domain RuleType = iota
+	DomainSuffix
+	DomainKeyword
+	IPCIDR
+	SrcIPCIDR
+	DstPort
+	InType
+	Match
+)
+
+func (rt RuleType) String() string {
+	switch rt {
+	case Domain:
+		return "Domain"
+	case DomainSuffix:
+		return "DomainSuffix"
+	case DomainKeyword:
+		return "DomainKeyword"
+	case IPCIDR:
+		return "IPCIDR"
+	case SrcIPCIDR:
+		return "SrcIPCIDR"
+	case DstPort:
+		return "DstPort"
+	case InType:
+		return "InType"
+	case Match:
+		return "Match"
+	default:
+		return "Unknown"
+	}
+}
+
+type Rule interface {
+	RuleType() RuleType
+	Match(metadata *constant.Metadata) bool
+	Adapter() string
+	Payload() string
+	ShouldResolveIP() bool
+}
+
+func HasNoResolve(params []string) bool {
+	for _, p := range params {
+		if p == noResolve {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package rules
+
+import (
+	"strings"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/trie"
+)
+
+type domain struct {
+	domain  string
+	adapter string
+}
+
+func (d *domain) RuleType() RuleType {
+	return Domain
+}
+
+func (d *domain) Match(metadata *constant.Metadata) bool {
+	return strings.ToLower(metadata.Target.Addr) == d.domain
+}
+
+func (d *domain) Adapter() string {
+	return d.adapter
+}
+
+func (d *domain) Payload() string {
+	return d.domain
+}
+
+func (d *domain) ShouldResolveIP() bool {
+	return false
+}
+
+func NewDomain(payload string, adapter string) *domain {
+	return &domain{
+		domain:  strings.ToLower(payload),
+		adapter: adapter,
+	}
+}
+
+type domainSuffix struct {
+	suffix  string
+	tree    *trie.DomainTrie
+	adapter string
+}
+
+func (ds *domainSuffix) RuleType() RuleType {
+	return DomainSuffix
+}
+
+func (ds *domainSuffix) Match(metadata *constant.Metadata) bool {
+	return ds.tree.Search(strings.ToLower(metadata.Target.Addr)) != nil
+}
+
+func (ds *domainSuffix) Adapter() string {
+	return ds.adapter
+}
+
+func (ds *domainSuffix) Payload() string {
+	return ds.suffix
+}
+
+func (ds *domainSuffix) ShouldResolveIP() bool {
+	return false
+}
+
+func NewDomainSuffix(payload string, adapter string) (*domainSuffix, error) {
+	suffix := strings.ToLower(strings.TrimPrefix(payload, "."))
+	tree := trie.New()
+	// +.example.com matches example.com and all of its subdomains
+	if err := tree.Insert("+."+suffix, struct{}{}); err != nil {
+		return nil, err
+	}
+	return &domainSuffix{
+		suffix:  suffix,
+		tree:    tree,
+		adapter: adapter,
+	}, nil
+}
+
+type domainKeyword struct {
+	keyword string
+	adapter string
+}
+
+func (dk *domainKeyword) RuleType() RuleType {
+	return DomainKeyword
+}
+
+func (dk *domainKeyword) Match(metadata *constant.Metadata) bool {
+	return strings.Contains(strings.ToLower(metadata.Target.Addr), dk.keyword)
+}
+
+func (dk *domainKeyword) Adapter() string {
+	return dk.adapter
+}
+
+func (dk *domainKeyword) Payload() string {
+	return dk.keyword
+}
+
+func (dk *domainKeyword) ShouldResolveIP() bool {
+	return false
+}
+
+func NewDomainKeyword(payload string, adapter string) *domainKeyword {
+	return &domainKeyword{
+		keyword: strings.ToLower(payload),
+		adapter: adapter,
+	}
+}
@@ -0,0 +1,35 @@
+package rules
+
+import (
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+type match struct {
+	adapter string
+}
+
+func (f *match) RuleType() RuleType {
+	return Match
+}
+
+func (f *match) Match(_ *constant.Metadata) bool {
+	return true
+}
+
+func (f *match) Adapter() string {
+	return f.adapter
+}
+
+func (f *match) Payload() string {
+	return ""
+}
+
+func (f *match) ShouldResolveIP() bool {
+	return false
+}
+
+func NewMatch(adapter string) *match {
+	return &match{
+		adapter: adapter,
+	}
+}
@@ -0,0 +1,55 @@
+package rules
+
+import (
+	"strings"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+type inType struct {
+	types   []constant.Type
+	payload string
+	adapter string
+}
+
+func (i *inType) RuleType() RuleType {
+	return InType
+}
+
+func (i *inType) Match(metadata *constant.Metadata) bool {
+	for _, tp := range i.types {
+		if metadata.Type == tp {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *inType) Adapter() string {
+	return i.adapter
+}
+
+func (i *inType) Payload() string {
+	return i.payload
+}
+
+func (i *inType) ShouldResolveIP() bool {
+	return false
+}
+
+// NewInType support multiple types split by '/', e.g. socks4/socks5
+func NewInType(payload string, adapter string) (*inType, error) {
+	var types []constant.Type
+	for _, s := range strings.Split(payload, "/") {
+		tp := constant.UnmarshalType(strings.TrimSpace(s))
+		if tp == constant.Unknown {
+			return nil, errPayload
+		}
+		types = append(types, tp)
+	}
+	return &inType{
+		types:   types,
+		payload: payload,
+		adapter: adapter,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package rules
+
+import (
+	"net"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+type ipCIDR struct {
+	ipnet       *net.IPNet
+	adapter     string
+	isSourceIP  bool
+	noResolveIP bool
+}
+
+func (i *ipCIDR) RuleType() RuleType {
+	if i.isSourceIP {
+		return SrcIPCIDR
+	}
+	return IPCIDR
+}
+
+func (i *ipCIDR) Match(metadata *constant.Metadata) bool {
+	var ip net.IP
+	if i.isSourceIP {
+		if metadata.Client != nil {
+			ip = net.ParseIP(metadata.Client.Addr)
+		}
+	} else {
+		ip = metadata.DstIP
+		if ip == nil {
+			ip = net.ParseIP(metadata.Target.Addr)
+		}
+	}
+	return ip != nil && i.ipnet.Contains(ip)
+}
+
+func (i *ipCIDR) Adapter() string {
+	return i.adapter
+}
+
+func (i *ipCIDR) Payload() string {
+	return i.ipnet.String()
+}
+
+func (i *ipCIDR) ShouldResolveIP() bool {
+	return !i.isSourceIP && !i.noResolveIP
+}
+
+func NewIPCIDR(payload string, adapter string, isSourceIP, noResolveIP bool) (*ipCIDR, error) {
+	_, ipnet, err := net.ParseCIDR(payload)
+	if err != nil {
+		return nil, errPayload
+	}
+	return &ipCIDR{
+		ipnet:       ipnet,
+		adapter:     adapter,
+		isSourceIP:  isSourceIP,
+		noResolveIP: noResolveIP,
+	}, nil
+}
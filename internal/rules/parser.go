@@ -0,0 +1,63 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseRule parse a rule line, format: TYPE,PAYLOAD,ADAPTER[,PARAMS...]
+// e.g. DOMAIN-SUFFIX,google.com,PROXY or IP-CIDR,10.0.0.0/8,DIRECT,no-resolve
+// ADAPTER is DIRECT, REJECT, PROXY or the name of an outbound or group
+func ParseRule(line string) (Rule, error) {
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	var tp, payload, adapter string
+	var params []string
+	switch l := len(parts); {
+	case l == 2:
+		tp, adapter = parts[0], parts[1]
+	case l >= 3:
+		tp, payload, adapter, params = parts[0], parts[1], parts[2], parts[3:]
+	default:
+		return nil, fmt.Errorf("rule %s: %w", line, errPayload)
+	}
+
+	// 内置出口不区分大小写, 其他为 Outbounds 及 Groups 中的名称
+	switch strings.ToUpper(adapter) {
+	case Direct, Proxy, Reject:
+		adapter = strings.ToUpper(adapter)
+	case "":
+		return nil, fmt.Errorf("rule %s: %w", line, errAdapter)
+	}
+
+	var (
+		parsed Rule
+		err    error
+	)
+	switch strings.ToUpper(tp) {
+	case "DOMAIN":
+		parsed = NewDomain(payload, adapter)
+	case "DOMAIN-SUFFIX":
+		parsed, err = NewDomainSuffix(payload, adapter)
+	case "DOMAIN-KEYWORD":
+		parsed = NewDomainKeyword(payload, adapter)
+	case "IP-CIDR", "IP-CIDR6":
+		parsed, err = NewIPCIDR(payload, adapter, false, HasNoResolve(params))
+	case "SRC-IP-CIDR":
+		parsed, err = NewIPCIDR(payload, adapter, true, true)
+	case "DST-PORT":
+		parsed, err = NewPort(payload, adapter)
+	case "IN-TYPE":
+		parsed, err = NewInType(payload, adapter)
+	case "MATCH":
+		parsed = NewMatch(adapter)
+	default:
+		return nil, fmt.Errorf("unsupported rule type %s", tp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule %s: %w", line, err)
+	}
+	return parsed, nil
+}
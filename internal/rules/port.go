@@ -0,0 +1,57 @@
+package rules
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+type port struct {
+	port    string
+	start   int64
+	end     int64
+	adapter string
+}
+
+func (p *port) RuleType() RuleType {
+	return DstPort
+}
+
+func (p *port) Match(metadata *constant.Metadata) bool {
+	return metadata.Target.Port >= p.start && metadata.Target.Port <= p.end
+}
+
+func (p *port) Adapter() string {
+	return p.adapter
+}
+
+func (p *port) Payload() string {
+	return p.port
+}
+
+func (p *port) ShouldResolveIP() bool {
+	return false
+}
+
+// NewPort support single port(443) and port range(8000-9000)
+func NewPort(payload string, adapter string) (*port, error) {
+	startStr, endStr, found := strings.Cut(payload, "-")
+	start, err := strconv.ParseUint(startStr, 10, 16)
+	if err != nil {
+		return nil, errPayload
+	}
+	end := start
+	if found {
+		end, err = strconv.ParseUint(endStr, 10, 16)
+		if err != nil || end < start {
+			return nil, errPayload
+		}
+	}
+	return &port{
+		port:    payload,
+		start:   int64(start),
+		end:     int64(end),
+		adapter: adapter,
+	}, nil
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
 )
 
@@ -18,6 +19,7 @@ type Proxy struct {
 	wg     *sync.WaitGroup
 	conn   net.Conn
 	server *constant.Server
+	Auth   auth.Authenticator
 }
 
 func (p *Proxy) srcAddr() string {
@@ -78,7 +80,12 @@ func (p *Proxy) handshake() (addr string, err error) {
 		return "", ErrRequestUnknownCode
 	}
 	user := p.readUntilNull(buf[7:])
-	// TODO: VerifyUser
+	// socks4 only carries a user-id, so it can only match a user without password
+	if p.Auth != nil && !p.Auth.Verify(user, "") {
+		_, _ = p.conn.Write([]byte{0x00, RequestIdentdMismatched, 0x00, 0x00, 0, 0, 0, 0})
+		logrus.Errorln(p.id, p.srcAddr(), user, ErrRequestIdentdMismatched)
+		return "", ErrRequestIdentdMismatched
+	}
 	logrus.Debugln(p.id, p.srcAddr(), user)
 
 	// get port
@@ -138,14 +145,18 @@ func (p *Proxy) processRequest(header string, tcpIn chan<- *constant.TCPContext)
 			Client:  client,
 			Source:  source,
 			Target:  target,
+			Inbound: p.server.Tag,
 		},
-		PreFn: func() {
-			_, err = p.conn.Write([]byte{0x00, 0x5A, 0x00, 0x00, 0, 0, 0, 0})
+		PreFn: func(net.Addr) {
+			_, err = p.conn.Write([]byte{0x00, RequestGranted, 0x00, 0x00, 0, 0, 0, 0})
 			if err != nil {
 				logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
 				return
 			}
 		},
+		FailFn: func(error) {
+			_, _ = p.conn.Write([]byte{0x00, RequestRejected, 0x00, 0x00, 0, 0, 0, 0})
+		},
 		PostFn: func() {
 			p.wg.Done()
 		},
@@ -1,5 +1,10 @@
 package socks5
 
+import (
+	"errors"
+	"time"
+)
+
 const Version = 5
 
 type Command = uint8
@@ -15,3 +20,42 @@ var cmdMap = map[Command]string{
 	CmdBind:    "BIND",
 	CmdUdp:     "UDP",
 }
+
+type AuthMethod = uint8
+
+const (
+	AuthNone         AuthMethod = 0x00
+	AuthPassword     AuthMethod = 0x02
+	AuthNoAcceptable AuthMethod = 0xff
+)
+
+// RFC 1929 username/password sub-negotiation
+const (
+	authVersion = 0x01
+	authSuccess = 0x00
+	authFailure = 0x01
+)
+
+// Reply 应答码, RFC 1928 6
+type Reply = uint8
+
+const (
+	RepSucceeded           Reply = 0x00
+	RepGeneralFailure      Reply = 0x01
+	RepNotAllowed          Reply = 0x02
+	RepNetworkUnreachable  Reply = 0x03
+	RepHostUnreachable     Reply = 0x04
+	RepConnectionRefused   Reply = 0x05
+	RepTTLExpired          Reply = 0x06
+	RepCommandNotSupported Reply = 0x07
+	RepAddressNotSupported Reply = 0x08
+)
+
+// bindTimeout 未配置超时时 BIND 等待对端连接的时间
+const bindTimeout = 2 * time.Minute
+
+var (
+	ErrCommandNotSupported = errors.New("command not supported")
+	ErrAddressNotSupported = errors.New("address type not supported")
+	ErrUnexpectedPeer      = errors.New("unexpected bind peer")
+)
@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,10 +10,19 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/auth"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"github.com/xmapst/lightsocks/internal/udp"
 )
 
 type Proxy struct {
@@ -19,11 +30,17 @@ type Proxy struct {
 	wg     *sync.WaitGroup
 	conn   net.Conn
 	server *constant.Server
-	Udp    string
+	Udp    *udp.Server
+	// Bind 为nil时不支持 BIND
+	Bind BindFn
+	Auth auth.Authenticator
 }
 
 type DialFunc func(network, addr string) (net.Conn, error)
 
+// BindFn 按路由规则检查 BIND 请求, 返回经过的代理组及出口和匹配的限制
+type BindFn func(metadata *constant.Metadata) (chains []string, limit *limiter.Rule, err error)
+
 func (p *Proxy) srcAddr() string {
 	return p.conn.RemoteAddr().String()
 }
@@ -67,200 +84,262 @@ func (p *Proxy) Handle(tcpIn chan<- *constant.TCPContext) error {
 }
 
 func (p *Proxy) handshake() error {
-	var buf = make([]byte, 4096)
-	var n int
-	// read auth methods
-	if n < 2 {
-		n1, err := io.ReadAtLeast(p.conn, buf, 1)
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-			return err
-		}
-		n += n1
-	}
-	l := int(buf[1])
-	if n != (l + 2) {
-		// read remains data
-		n1, err := io.ReadFull(p.conn, buf[n:l+2+1])
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-			return err
-		}
-		n += n1
+	// read version and auth methods
+	var header = make([]byte, 2)
+	_, err := io.ReadFull(p.conn, header)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
+	}
+	if header[0] != Version {
+		logrus.Errorln(p.id, p.srcAddr(), "error version", header[0])
+		return errors.New("error version")
+	}
+	var methods = make([]byte, header[1])
+	_, err = io.ReadFull(p.conn, methods)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
 	}
 
 	// Default: no auth required
-	_, _ = p.conn.Write([]byte{0x05, 0x00})
-	return nil
+	if p.Auth == nil {
+		_, err = p.conn.Write([]byte{Version, AuthNone})
+		return err
+	}
 
-	// TODO: VerifyUser
-	// hasPassAuth := false
-	// var passAuth byte = 0x02
-	//
-	// check auth method
 	// only password(0x02) supported
-	// for i := 2; i < n; i++ {
-	//	if buf[i] == passAuth {
-	//		hasPassAuth = true
-	//		break
-	//	}
-	// }
-	//
-	// if !hasPassAuth {
-	//	_, _ = p.conn.Write([]byte{0x05, 0xff})
-	//	log.Errorln(p.id, p.srcAddr(), "no supported auth method")
-	//	return errors.New("no supported auth method")
-	// }
-	//
-	// return p.passwordAuth()
+	if !bytes.Contains(methods, []byte{AuthPassword}) {
+		_, _ = p.conn.Write([]byte{Version, AuthNoAcceptable})
+		logrus.Errorln(p.id, p.srcAddr(), "no supported auth method")
+		return errors.New("no supported auth method")
+	}
+	return p.passwordAuth()
 }
 
 func (p *Proxy) passwordAuth() error {
-	buf := make([]byte, 32)
-
 	// username/password required
-	_, _ = p.conn.Write([]byte{0x05, 0x02})
-	n, err := io.ReadAtLeast(p.conn, buf, 2)
+	_, err := p.conn.Write([]byte{Version, AuthPassword})
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
+	}
+
+	// read auth version and username length
+	var header = make([]byte, 2)
+	_, err = io.ReadFull(p.conn, header)
 	if err != nil {
 		logrus.Errorln(p.id, p.srcAddr(), err)
 		return err
 	}
 	// check auth version
-	if buf[0] != 0x01 {
+	if header[0] != authVersion {
 		logrus.Errorln(p.id, p.srcAddr(), "unsupported auth version")
 		return errors.New("unsupported auth version")
 	}
 
-	usernameLen := int(buf[1])
-	p0 := 2
-	p1 := p0 + usernameLen
-	for n < p1 {
-		var n1 int
-		n1, err = p.conn.Read(buf[n:])
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-			return err
-		}
-		n += n1
+	// username and password length
+	var user = make([]byte, int(header[1])+1)
+	_, err = io.ReadFull(p.conn, user)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
 	}
-	user := string(buf[p0:p1])
-	logrus.Infoln(p.id, p.srcAddr(), user)
-	passwordLen := int(buf[p1])
-
-	p3 := p1 + 1
-	p4 := p3 + passwordLen
-
-	for n < p4 {
-		var n1 int
-		n1, err = p.conn.Read(buf[n:])
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-			return err
-		}
-		n += n1
+	var password = make([]byte, int(user[len(user)-1]))
+	_, err = io.ReadFull(p.conn, password)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
 	}
+	username := string(user[:len(user)-1])
 
-	password := buf[p3:p4]
-	// TODO: VerifyUser
-	logrus.Debugln(p.id, p.srcAddr(), user, string(password))
-
-	_, _ = p.conn.Write([]byte{0x01, 0x01})
-	logrus.Errorln(p.id, p.srcAddr(), "access denied")
-	return errors.New("access denied")
+	if !p.Auth.Verify(username, string(password)) {
+		_, _ = p.conn.Write([]byte{authVersion, authFailure})
+		logrus.Errorln(p.id, p.srcAddr(), username, "access denied")
+		return errors.New("access denied")
+	}
+	logrus.Debugln(p.id, p.srcAddr(), username, "authenticated")
+	_, err = p.conn.Write([]byte{authVersion, authSuccess})
+	return err
 }
 
 func (p *Proxy) processRequest(tcpIn chan<- *constant.TCPContext) error {
-	buf := make([]byte, 258)
-
 	// read header
-	n, err := io.ReadAtLeast(p.conn, buf, 10)
+	var header = make([]byte, 3)
+	_, err := io.ReadFull(p.conn, header)
 	if err != nil {
 		logrus.Errorln(p.id, p.srcAddr(), err)
 		return err
 	}
-
-	if buf[0] != Version {
-		logrus.Errorln(p.id, p.srcAddr(), "error version", buf[0])
+	if header[0] != Version {
+		logrus.Errorln(p.id, p.srcAddr(), "error version", header[0])
 		return errors.New("error version")
 	}
 
-	hlen := 0   // target address length
-	host := ""  // target address
-	msglen := 0 // header length
+	// target address
+	targetAddr, err := p.readAddr()
+	if err != nil {
+		if errors.Is(err, ErrAddressNotSupported) {
+			_ = p.reply(RepAddressNotSupported, nil)
+		}
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
+	}
+	logrus.Debugln(p.id, p.srcAddr(), cmdMap[header[1]], targetAddr)
+	switch header[1] {
+	case CmdUdp:
+		return p.handleUdpCmd(targetAddr)
+	case CmdConnect:
+		return p.handleConnectCmd(targetAddr, tcpIn)
+	case CmdBind:
+		return p.handleBindCmd(targetAddr)
+	default:
+		_ = p.reply(RepCommandNotSupported, nil)
+		logrus.Errorln(p.id, p.srcAddr(), ErrCommandNotSupported, header[1])
+		return ErrCommandNotSupported
+	}
+}
 
-	switch buf[3] {
+// readAddr 读取 ATYP|ADDR|PORT, 返回 host:port
+func (p *Proxy) readAddr() (string, error) {
+	var buf = make([]byte, 1+1+255+2)
+	_, err := io.ReadFull(p.conn, buf[:1])
+	if err != nil {
+		return "", err
+	}
+	var hlen int // target address length
+	switch buf[0] {
 	case constant.ATypeIPv4:
-		hlen = 4
-	case constant.ATypeDomainName:
-		hlen = int(buf[4]) + 1
+		hlen = net.IPv4len
 	case constant.ATypeIPv6:
-		hlen = 16
-	}
-
-	msglen = 6 + hlen
-
-	if n < msglen {
-		// read remains header
-		_, err = io.ReadFull(p.conn, buf[n:msglen])
-		if err != nil {
-			logrus.Errorln(p.id, p.srcAddr(), err)
-			return err
+		hlen = net.IPv6len
+	case constant.ATypeDomainName:
+		if _, err = io.ReadFull(p.conn, buf[1:2]); err != nil {
+			return "", err
 		}
+		hlen = 1 + int(buf[1])
+	default:
+		return "", ErrAddressNotSupported
 	}
-
-	// get target address
-	addr := buf[4 : 4+hlen]
-	if buf[3] == constant.ATypeDomainName {
+	// 域名已读取长度字节
+	read := 1
+	if buf[0] == constant.ATypeDomainName {
+		read = 2
+	}
+	_, err = io.ReadFull(p.conn, buf[read:1+hlen+2])
+	if err != nil {
+		return "", err
+	}
+	addr := buf[1 : 1+hlen]
+	port := binary.BigEndian.Uint16(buf[1+hlen:])
+	var host string
+	if buf[0] == constant.ATypeDomainName {
 		host = string(addr[1:])
 	} else {
 		host = net.IP(addr).String()
 	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
 
-	// get target port
-	port := binary.BigEndian.Uint16(buf[msglen-2 : msglen])
+// reply 应答, addr 为nil时返回 0.0.0.0:0
+func (p *Proxy) reply(rep Reply, addr net.Addr) error {
+	buf := append([]byte{Version, rep, 0x00}, encodeAddr(addr)...)
+	_, err := p.conn.Write(buf)
+	if err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
+	}
+	return err
+}
 
-	// target address
-	targetAddr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
-	// command support connect
-	switch buf[1] {
-	case CmdUdp:
-		return p.handleUdpCmd()
-	case CmdConnect, CmdBind:
-		return p.handleConnectCmd(targetAddr, tcpIn)
+// encodeAddr 按地址类型编码为 ATYP|ADDR|PORT
+func encodeAddr(addr net.Addr) []byte {
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case nil:
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
 	default:
-		return errors.New("command not supported")
+		// 隧道或多路复用的连接
+		if host, p, err := net.SplitHostPort(a.String()); err == nil {
+			ip = net.ParseIP(host)
+			port, _ = strconv.Atoi(p)
+		}
 	}
+	buf := make([]byte, 0, 1+net.IPv6len+2)
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(append(buf, constant.ATypeIPv4), ip4...)
+	} else if ip != nil {
+		buf = append(append(buf, constant.ATypeIPv6), ip.To16()...)
+	} else {
+		buf = append(append(buf, constant.ATypeIPv4), net.IPv4zero.To4()...)
+	}
+	return binary.BigEndian.AppendUint16(buf, uint16(port))
 }
 
-func (p *Proxy) handleConnectCmd(targetAddr string, tcpIn chan<- *constant.TCPContext) error {
+// replyCode 把连接目标的错误映射为应答码
+func replyCode(err error) Reply {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, constant.ErrRejected), errors.Is(err, limiter.ErrQuotaExceeded):
+		return RepNotAllowed
+	case errors.Is(err, constant.ErrNotSupported):
+		return RepCommandNotSupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, dialer.ErrResolve), errors.Is(err, resolver.ErrIPNotFound), errors.As(err, &dnsErr):
+		return RepHostUnreachable
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return RepTTLExpired
+	default:
+		return RepGeneralFailure
+	}
+}
+
+func (p *Proxy) metadata(targetAddr string) (*constant.Metadata, error) {
 	client, err := constant.UnmarshalIP(p.srcAddr())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	source, err := constant.UnmarshalIP(p.conn.LocalAddr().String())
 	if err != nil {
-		return err
+		return nil, err
 	}
 	target, err := constant.UnmarshalIP(targetAddr)
 	if err != nil {
+		return nil, err
+	}
+	return &constant.Metadata{
+		ID:      p.id,
+		NetWork: constant.TCP,
+		Type:    constant.SOCKS5,
+		Client:  client,
+		Source:  source,
+		Target:  target,
+		Inbound: p.server.Tag,
+	}, nil
+}
+
+// handleConnectCmd 连接目标后再应答, 失败时返回对应的错误码
+func (p *Proxy) handleConnectCmd(targetAddr string, tcpIn chan<- *constant.TCPContext) error {
+	metadata, err := p.metadata(targetAddr)
+	if err != nil {
+		_ = p.reply(RepGeneralFailure, nil)
 		return err
 	}
 	tcpIn <- &constant.TCPContext{
-		SrcConn: p.conn,
-		Metadata: &constant.Metadata{
-			ID:      p.id,
-			NetWork: constant.TCP,
-			Type:    constant.SOCKS5,
-			Client:  client,
-			Source:  source,
-			Target:  target,
+		SrcConn:  p.conn,
+		Metadata: metadata,
+		PreFn: func(bound net.Addr) {
+			_ = p.reply(RepSucceeded, bound)
 		},
-		PreFn: func() {
-			_, err = p.conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x01, 0x01})
-			if err != nil {
-				logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
-				return
-			}
+		FailFn: func(err error) {
+			_ = p.reply(replyCode(err), nil)
 		},
 		PostFn: func() {
 			p.wg.Done()
@@ -269,48 +348,115 @@ func (p *Proxy) handleConnectCmd(targetAddr string, tcpIn chan<- *constant.TCPCo
 	return nil
 }
 
-func (p *Proxy) handleUdpCmd() error {
-	host, port, err := net.SplitHostPort(p.Udp)
+// handleBindCmd 在入口的地址上监听, 第一次应答返回监听地址, 对端连接后第二次应答返回对端地址, 之后双向转发
+// 对端的连接由入口直接接受, 只有规则匹配到直连时才监听, 客户端模式默认经由代理, 应答不支持
+func (p *Proxy) handleBindCmd(targetAddr string) error {
+	if p.Bind == nil {
+		_ = p.reply(RepCommandNotSupported, nil)
+		logrus.Errorln(p.id, p.srcAddr(), ErrCommandNotSupported, CmdBind)
+		return ErrCommandNotSupported
+	}
+	metadata, err := p.metadata(targetAddr)
 	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
+		_ = p.reply(RepGeneralFailure, nil)
 		return err
 	}
-	_port, err := strconv.Atoi(port)
+	chains, limit, err := p.Bind(metadata)
 	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
+		_ = p.reply(replyCode(err), nil)
+		logrus.Errorln(p.id, p.srcAddr(), cmdMap[CmdBind], targetAddr, err)
 		return err
 	}
-	udpAddr, err := net.ResolveIPAddr("ip", host)
+	host, _, err := net.SplitHostPort(p.conn.LocalAddr().String())
 	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), err)
+		_ = p.reply(RepGeneralFailure, nil)
 		return err
 	}
-	hostByte := udpAddr.IP.To4()
-	portByte := make([]byte, 2)
-	binary.BigEndian.PutUint16(portByte, uint16(_port))
-	buf := append([]byte{Version, 0x00, 0x00, 0x01}, hostByte...)
-	buf = append(buf, portByte...)
-	_, err = p.conn.Write(buf)
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP(host)})
 	if err != nil {
-		logrus.Errorln(p.id, p.srcAddr(), "write response error", err)
+		_ = p.reply(replyCode(err), nil)
+		return err
+	}
+	defer func() {
+		_ = ln.Close()
+	}()
+	if err = p.reply(RepSucceeded, ln.Addr()); err != nil {
 		return err
 	}
 
-	forward := func(src net.Conn) {
-		defer func(src net.Conn) {
-			_ = src.Close()
-		}(src)
-		for {
-			_, err = io.ReadFull(src, make([]byte, 100))
-			if err != nil {
-				if err != io.EOF {
-					logrus.Errorln(p.id, p.srcAddr(), err)
-				}
-				break
-			}
-		}
+	timeout := p.server.Timeout
+	if timeout <= 0 {
+		timeout = bindTimeout
+	}
+	_ = ln.SetDeadline(time.Now().Add(timeout))
+	_ = p.conn.SetDeadline(time.Time{})
+	// 等待期间控制连接关闭时停止等待, 客户端在第二次应答前不会发送数据
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = p.conn.Read(make([]byte, 1))
+		_ = ln.Close()
+	}()
+	peer, err := ln.AcceptTCP()
+	_ = p.conn.SetReadDeadline(time.Now())
+	<-done
+	_ = p.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = p.reply(replyCode(err), nil)
+		return err
+	}
+	// DST.ADDR 为预期的对端地址, 不为空时只接受该地址的连接
+	expected, _, _ := net.SplitHostPort(targetAddr)
+	if ip := net.ParseIP(expected); ip != nil && !ip.IsUnspecified() && !ip.Equal(peer.RemoteAddr().(*net.TCPAddr).IP) {
+		_ = peer.Close()
+		_ = p.reply(RepNotAllowed, nil)
+		return fmt.Errorf("%w: %s", ErrUnexpectedPeer, peer.RemoteAddr())
+	}
+	if err = p.reply(RepSucceeded, peer.RemoteAddr()); err != nil {
+		_ = peer.Close()
+		return err
+	}
+
+	metadata, err = p.metadata(peer.RemoteAddr().String())
+	if err != nil {
+		_ = peer.Close()
+		return err
+	}
+	relay := &N.Relay{
+		Src:      p.conn,
+		Dest:     statistic.NewTCPTracker(peer, metadata, chains...),
+		Metadata: metadata,
+		Limit:    limit,
+	}
+	relay.Start(constant.Direct)
+	p.wg.Done()
+	return nil
+}
+
+func (p *Proxy) handleUdpCmd(targetAddr string) error {
+	if p.Udp == nil {
+		_ = p.reply(RepCommandNotSupported, nil)
+		logrus.Errorln(p.id, p.srcAddr(), ErrCommandNotSupported, CmdUdp)
+		return ErrCommandNotSupported
+	}
+	// 每个关联使用独立的端口, 随控制连接关闭
+	relay, err := p.Udp.Associate(p.conn, targetAddr)
+	if err != nil {
+		_ = p.reply(replyCode(err), nil)
+		logrus.Errorln(p.id, p.srcAddr(), err)
+		return err
+	}
+	defer relay.Close()
+	if err = p.reply(RepSucceeded, relay.LocalAddr()); err != nil {
+		return err
 	}
 
-	forward(p.conn)
+	// UDP 关联期间控制连接保持, 清除握手超时
+	_ = p.conn.SetDeadline(time.Time{})
+	if _, err = io.Copy(io.Discard, p.conn); err != nil {
+		logrus.Errorln(p.id, p.srcAddr(), err)
+	}
+	p.wg.Done()
+	_ = p.conn.Close()
 	return nil
 }
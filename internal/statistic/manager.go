@@ -68,6 +68,17 @@ func (m *Manager) Snapshot() *Snapshot {
 	}
 }
 
+// CloseAll 关闭全部统计中的连接, 返回关闭的数量
+func (m *Manager) CloseAll() int {
+	var n int
+	m.connections.Range(func(key, value any) bool {
+		_ = value.(tracker).Close()
+		n++
+		return true
+	})
+	return n
+}
+
 func (m *Manager) ResetStatistic() {
 	m.uploadTemp.Store(0)
 	m.uploadBlip.Store(0)
@@ -1,10 +1,12 @@
 package statistic
 
 import (
+	"io"
 	"net"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/xmapst/lightsocks/internal/compress"
 	"github.com/xmapst/lightsocks/internal/constant"
 	"go.uber.org/atomic"
 )
@@ -20,9 +22,12 @@ type tracker interface {
 type trackerInfo struct {
 	UUID          uuid.UUID          `json:"ID"`
 	Metadata      *constant.Metadata `json:"Metadata"`
+	Chains        []string           `json:"Chains"`
 	UploadTotal   *atomic.Int64      `json:"Upload"`
 	DownloadTotal *atomic.Int64      `json:"Download"`
 	Start         time.Time          `json:"Start"`
+	// Compression 隧道连接发送方向的压缩算法及压缩率
+	Compression *compress.Stats `json:"Compression,omitempty"`
 }
 
 type TcpTracker struct {
@@ -49,18 +54,36 @@ func (tt *TcpTracker) ID() string {
 
 func (tt *TcpTracker) Read(b []byte) (int, error) {
 	n, err := tt.Conn.Read(b)
-	download := int64(n)
-	tt.manager.PushDownloaded(download)
-	tt.DownloadTotal.Add(download)
+	tt.pushDownloaded(n)
 	return n, err
 }
 
 func (tt *TcpTracker) Write(b []byte) (int, error) {
 	n, err := tt.Conn.Write(b)
+	tt.pushUploaded(n)
+	return n, err
+}
+
+// ReadFrom 转发到底层连接的 io.ReaderFrom, 隧道连接可以合并写入, 按读取的字节数统计上传
+func (tt *TcpTracker) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(tt.Conn, &countReader{Reader: r, push: tt.pushUploaded})
+}
+
+// WriteTo 转发到底层连接的 io.WriterTo, 按写入的字节数统计下载
+func (tt *TcpTracker) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(&countWriter{Writer: w, push: tt.pushDownloaded}, tt.Conn)
+}
+
+func (tt *TcpTracker) pushUploaded(n int) {
 	upload := int64(n)
 	tt.manager.PushUploaded(upload)
 	tt.UploadTotal.Add(upload)
-	return n, err
+}
+
+func (tt *TcpTracker) pushDownloaded(n int) {
+	download := int64(n)
+	tt.manager.PushDownloaded(download)
+	tt.DownloadTotal.Add(download)
 }
 
 func (tt *TcpTracker) Close() error {
@@ -68,7 +91,28 @@ func (tt *TcpTracker) Close() error {
 	return tt.Conn.Close()
 }
 
-func NewTCPTracker(conn net.Conn, metadata *constant.Metadata) *TcpTracker {
+// NewTCPTracker chains 为连接经过的代理组及出口
+func NewTCPTracker(conn net.Conn, metadata *constant.Metadata, chains ...string) *TcpTracker {
+	return newTCPTracker(conn, compression(conn), metadata, chains)
+}
+
+// NewRelayTracker 跟踪转发的目标连接, 目标不是隧道时使用来源隧道的压缩统计
+func NewRelayTracker(src, dest net.Conn, metadata *constant.Metadata, chains ...string) *TcpTracker {
+	stats := compression(dest)
+	if stats == nil {
+		stats = compression(src)
+	}
+	return newTCPTracker(dest, stats, metadata, chains)
+}
+
+func compression(conn net.Conn) *compress.Stats {
+	if r, ok := conn.(compress.Reporter); ok {
+		return r.Compression()
+	}
+	return nil
+}
+
+func newTCPTracker(conn net.Conn, stats *compress.Stats, metadata *constant.Metadata, chains []string) *TcpTracker {
 	t := &TcpTracker{
 		Conn:    conn,
 		manager: DefaultManager,
@@ -76,9 +120,110 @@ func NewTCPTracker(conn net.Conn, metadata *constant.Metadata) *TcpTracker {
 			UUID:          metadata.ID,
 			Start:         time.Now(),
 			Metadata:      metadata,
+			Chains:        chains,
+			UploadTotal:   atomic.NewInt64(0),
+			DownloadTotal: atomic.NewInt64(0),
+			Compression:   stats,
+		},
+	}
+	DefaultManager.Join(t)
+	return t
+}
+
+// countReader 统计读取的字节数
+type countReader struct {
+	io.Reader
+	push func(n int)
+}
+
+func (c *countReader) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	c.push(n)
+	return n, err
+}
+
+// countWriter 统计写入的字节数
+type countWriter struct {
+	io.Writer
+	push func(n int)
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.Writer.Write(b)
+	c.push(n)
+	return n, err
+}
+
+// UDPTracker 统计一个 UDP 关联双向的数据包及字节数, Close 关闭该关联
+type UDPTracker struct {
+	*trackerInfo
+	UploadPackets   *atomic.Int64 `json:"UploadPackets"`
+	DownloadPackets *atomic.Int64 `json:"DownloadPackets"`
+	manager         *Manager
+	closeFn         func()
+	closed          *atomic.Bool
+}
+
+func (ut *UDPTracker) MetadataX() *constant.Metadata {
+	return ut.Metadata
+}
+
+func (ut *UDPTracker) UploadTotalX() int64 {
+	return ut.UploadTotal.Load()
+}
+
+func (ut *UDPTracker) DownloadTotalX() int64 {
+	return ut.DownloadTotal.Load()
+}
+
+func (ut *UDPTracker) ID() string {
+	return ut.UUID.String()
+}
+
+// PushUploaded 客户端发往目标的一个数据包
+func (ut *UDPTracker) PushUploaded(n int) {
+	upload := int64(n)
+	ut.manager.PushUploaded(upload)
+	ut.UploadTotal.Add(upload)
+	ut.UploadPackets.Inc()
+}
+
+// PushDownloaded 目标发回客户端的一个数据包
+func (ut *UDPTracker) PushDownloaded(n int) {
+	download := int64(n)
+	ut.manager.PushDownloaded(download)
+	ut.DownloadTotal.Add(download)
+	ut.DownloadPackets.Inc()
+}
+
+// Close 只在第一次调用时执行 closeFn, closeFn 中可以再次调用 Close
+func (ut *UDPTracker) Close() error {
+	if !ut.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	ut.manager.Leave(ut)
+	if ut.closeFn != nil {
+		ut.closeFn()
+	}
+	return nil
+}
+
+// NewUDPTracker closeFn 关闭关联, chains 为关联经过的代理组及出口
+func NewUDPTracker(metadata *constant.Metadata, closeFn func(), chains ...string) *UDPTracker {
+	t := &UDPTracker{
+		manager: DefaultManager,
+		trackerInfo: &trackerInfo{
+			UUID:          metadata.ID,
+			Start:         time.Now(),
+			Metadata:      metadata,
+			Chains:        chains,
 			UploadTotal:   atomic.NewInt64(0),
 			DownloadTotal: atomic.NewInt64(0),
 		},
+		UploadPackets:   atomic.NewInt64(0),
+		DownloadPackets: atomic.NewInt64(0),
+		closeFn:         closeFn,
+		closed:          atomic.NewBool(false),
 	}
 	DefaultManager.Join(t)
 	return t
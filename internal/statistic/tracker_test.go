@@ -0,0 +1,103 @@
+package statistic
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xmapst/lightsocks/internal/cipher"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	N "github.com/xmapst/lightsocks/internal/net"
+)
+
+// slowConn 记录写入的数据及次数, 每次写入等待一段时间, 模拟较慢的上行
+type slowConn struct {
+	net.Conn
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (c *slowConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	return c.buf.Write(b)
+}
+
+// readConn 从缓冲区读取已写入的数据
+type readConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// chunkReader 每次读取返回一小段数据, 不实现 io.WriterTo, 与客户端连接相同
+type chunkReader struct {
+	chunks [][]byte
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestTrackerCoalesce(t *testing.T) {
+	ciph, err := cipher.New(cipher.AES256GCM, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := limiter.New("test", []constant.Limit{{Source: "0.0.0.0/0", Upload: "100MB"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, limited := range []bool{false, true} {
+		const chunks = 64
+		src := new(chunkReader)
+		var want []byte
+		for i := 0; i < chunks; i++ {
+			chunk := bytes.Repeat([]byte{byte(i)}, 100)
+			src.chunks = append(src.chunks, chunk)
+			want = append(want, chunk...)
+		}
+
+		// 客户端出口连接经过统计及限速的包装, 上传仍由 SecureTCPConn.ReadFrom 合并写入
+		conn := new(slowConn)
+		tracker := NewTCPTracker(N.NewSecureTCPConn(conn, ciph), &constant.Metadata{})
+		var dest net.Conn = tracker
+		if limited {
+			dest = rules[0].Conn(tracker)
+		}
+		n, err := io.Copy(dest, src)
+		tracker.manager.Leave(tracker)
+		if err != nil || n != int64(len(want)) {
+			t.Fatalf("limited %v: copy %d bytes, %v", limited, n, err)
+		}
+		if conn.writes >= chunks {
+			t.Fatalf("limited %v: %d writes for %d chunks, not coalesced", limited, conn.writes, chunks)
+		}
+		if up := tracker.UploadTotal.Load(); up != int64(len(want)) {
+			t.Fatalf("limited %v: upload %d, want %d", limited, up, len(want))
+		}
+
+		got, err := io.ReadAll(N.NewSecureTCPConn(&readConn{r: &conn.buf}, ciph))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("limited %v: data mismatch", limited)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setsockopt(rc syscall.RawConn, addr string) error {
+	return errors.New("tproxy is only supported on linux")
+}
@@ -0,0 +1,98 @@
+package tproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+)
+
+// Listener iptables TPROXY 透明代理, 连接的本地地址即原始目标地址
+type Listener struct {
+	listener net.Listener
+	addr     string
+}
+
+func (l *Listener) Address() string {
+	return l.addr
+}
+
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+func New(addr string, tcpIn chan<- *constant.TCPContext) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tl := l.(*net.TCPListener)
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	err = setsockopt(rc, addr)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	rl := &Listener{
+		listener: l,
+		addr:     addr,
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				if strings.Contains(err.Error(), net.ErrClosed.Error()) {
+					break
+				}
+				continue
+			}
+			go handleTProxy(c, l.Addr(), tcpIn)
+		}
+	}()
+	return rl, nil
+}
+
+func handleTProxy(conn net.Conn, laddr net.Addr, tcpIn chan<- *constant.TCPContext) {
+	id, _ := uuid.NewV4()
+	client, err := constant.UnmarshalIP(conn.RemoteAddr().String())
+	if err != nil {
+		logrus.Errorln(id, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	source, err := constant.UnmarshalIP(laddr.String())
+	if err != nil {
+		logrus.Errorln(id, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	// 透明代理下连接的本地地址就是客户端访问的目标
+	target, err := constant.UnmarshalIP(conn.LocalAddr().String())
+	if err != nil {
+		logrus.Errorln(id, conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.(*net.TCPConn).SetKeepAlive(true)
+	tcpIn <- &constant.TCPContext{
+		SrcConn: conn,
+		Metadata: &constant.Metadata{
+			ID:      id,
+			NetWork: constant.TCP,
+			Type:    constant.TPROXY,
+			Client:  client,
+			Source:  source,
+			Target:  target,
+			Inbound: "tproxy",
+		},
+	}
+}
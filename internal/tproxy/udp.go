@@ -0,0 +1,306 @@
+package tproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"github.com/xmapst/lightsocks/internal/udp"
+	"go.uber.org/atomic"
+)
+
+const udpTimeout = 100 * time.Second
+
+var errFakeIPNotFound = errors.New("fake ip mapping not found")
+
+// UDPListener TPROXY 透明代理的 UDP 部分, 每个 源地址-原始目标 对应一个关联
+type UDPListener struct {
+	packetConn *net.UDPConn
+	addr       string
+	tunnel     udp.TunnelFn
+	options    []dialer.Option
+	mu         sync.Mutex
+	sessions   map[string]*session
+}
+
+type session struct {
+	reply      *net.UDPConn   // 绑定原始目标地址, 回包给客户端
+	conn       net.Conn       // 经由出口转发
+	pc         net.PacketConn // 直连
+	target     string
+	targetAddr *net.UDPAddr
+	fakeIP     net.IP // 目标为虚假ip时还原前的地址
+	fakeHost   string // 虚假ip还原后的域名
+	tracker    *statistic.UDPTracker
+	limit      *limiter.Packet
+	mu         sync.Mutex
+	lastActive *atomic.Time
+}
+
+func (l *UDPListener) Address() string {
+	return l.addr
+}
+
+// Close 停止接收数据包并关闭全部关联
+func (l *UDPListener) Close() error {
+	err := l.packetConn.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, s := range l.sessions {
+		delete(l.sessions, k)
+		s.close()
+	}
+	return err
+}
+
+// NewUDP tunnel 返回nil连接时直连, options 用于直连时的出口网卡及fwmark
+func NewUDP(addr string, tunnel udp.TunnelFn, options ...dialer.Option) (*UDPListener, error) {
+	l, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn := l.(*net.UDPConn)
+	rc, err := udpConn.SyscallConn()
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	err = setsockopt(rc, addr)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	ul := &UDPListener{
+		packetConn: udpConn,
+		addr:       addr,
+		tunnel:     tunnel,
+		options:    options,
+		sessions:   make(map[string]*session),
+	}
+	go func() {
+		oob := make([]byte, 1024)
+		for {
+			buf := make([]byte, 1<<16)
+			n, oobn, _, lAddr, err := udpConn.ReadMsgUDP(buf, oob)
+			if err != nil {
+				if strings.Contains(err.Error(), net.ErrClosed.Error()) {
+					break
+				}
+				continue
+			}
+
+			rAddr, err := getOrigDst(oob, oobn)
+			if err != nil {
+				continue
+			}
+			go ul.handlePacket(lAddr, rAddr, buf[:n])
+		}
+	}()
+	return ul, nil
+}
+
+func (l *UDPListener) handlePacket(srcAddr, dstAddr *net.UDPAddr, data []byte) {
+	key := srcAddr.String() + "-" + dstAddr.String()
+	l.mu.Lock()
+	s, ok := l.sessions[key]
+	if ok && s.stale() {
+		// 虚假ip已回收或分配给其他域名, 重新建立会话
+		delete(l.sessions, key)
+		s.close()
+		ok = false
+	}
+	if !ok {
+		var err error
+		s, err = l.newSession(srcAddr, dstAddr)
+		if err != nil {
+			l.mu.Unlock()
+			logrus.Errorln(srcAddr, "-->", dstAddr, err)
+			return
+		}
+		l.sessions[key] = s
+		go l.handleRead(key, s)
+	}
+	l.mu.Unlock()
+
+	if err := s.write(data); err != nil {
+		logrus.Warningln(srcAddr, "-->", dstAddr, err)
+		l.closeSession(key, s)
+	}
+}
+
+func (l *UDPListener) newSession(srcAddr, dstAddr *net.UDPAddr) (*session, error) {
+	target := dstAddr.String()
+	var fakeIP net.IP
+	var fakeHost string
+	if resolver.IsFakeIP(dstAddr.IP) {
+		// 虚假ip还原为域名, 回包仍使用原始目标地址
+		var ok bool
+		fakeIP = dstAddr.IP
+		fakeHost, ok = resolver.FindHostByIP(dstAddr.IP)
+		if !ok {
+			return nil, errFakeIPNotFound
+		}
+		target = net.JoinHostPort(fakeHost, strconv.Itoa(dstAddr.Port))
+	}
+	metadata, err := l.newMetadata(srcAddr, target)
+	if err != nil {
+		return nil, err
+	}
+	// 流量配额用完时拒绝新的关联
+	limit := limiter.Match(metadata)
+	if limit != nil && limit.Exceeded() {
+		return nil, limiter.ErrQuotaExceeded
+	}
+	conn, chains, err := l.tunnel(metadata)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		conn:       conn,
+		target:     target,
+		fakeIP:     fakeIP,
+		fakeHost:   fakeHost,
+		lastActive: atomic.NewTime(time.Now()),
+	}
+	if conn == nil {
+		s.targetAddr, err = resolver.ResolveUDPAddr(target)
+		if err == nil {
+			s.pc, err = dialer.ListenPacket(context.Background(), "udp", "", l.options...)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.reply, err = dialUDP("udp", dstAddr, srcAddr)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	s.tracker = statistic.NewUDPTracker(metadata, s.close, chains...)
+	s.limit = limit.Packet(s.close)
+	logrus.Debugln(metadata.ID, metadata.Identity(), "-->", metadata.Client, "-->", metadata.Source, "-->", metadata.Target, "associate")
+	return s, nil
+}
+
+func (l *UDPListener) newMetadata(srcAddr *net.UDPAddr, target string) (*constant.Metadata, error) {
+	dst, err := constant.UnmarshalIP(target)
+	if err != nil {
+		return nil, err
+	}
+	source, err := constant.UnmarshalIP(l.packetConn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	return &constant.Metadata{
+		ID:      id,
+		NetWork: constant.UDP,
+		Type:    constant.TPROXY,
+		Client:  &constant.IP{Addr: srcAddr.IP.String(), Port: int64(srcAddr.Port)},
+		Source:  source,
+		Target:  dst,
+		Inbound: "tproxy",
+	}, nil
+}
+
+// handleRead 远端的回包经由绑定原始目标地址的连接发回客户端
+func (l *UDPListener) handleRead(key string, s *session) {
+	defer l.closeSession(key, s)
+	buf := make([]byte, 1<<16)
+	for {
+		var data []byte
+		var err error
+		if s.conn != nil {
+			_ = s.conn.SetReadDeadline(time.Now().Add(udpTimeout))
+			_, data, err = protocol.ReadUDPPacket(s.conn)
+		} else {
+			var n int
+			_ = s.pc.SetReadDeadline(time.Now().Add(udpTimeout))
+			n, _, err = s.pc.ReadFrom(buf)
+			data = buf[:n]
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(s.lastActive.Load()) < udpTimeout {
+				continue
+			}
+			return
+		}
+		s.lastActive.Store(time.Now())
+		s.limit.Download(len(data))
+		s.tracker.PushDownloaded(len(data))
+		if _, err = s.reply.Write(data); err != nil {
+			logrus.Warningln(key, err)
+		}
+	}
+}
+
+func (l *UDPListener) closeSession(key string, s *session) {
+	l.mu.Lock()
+	if l.sessions[key] == s {
+		delete(l.sessions, key)
+	}
+	l.mu.Unlock()
+	s.close()
+}
+
+func (s *session) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive.Store(time.Now())
+	s.limit.Upload(len(data))
+	var err error
+	if s.conn != nil {
+		err = protocol.WriteUDPPacket(s.conn, s.target, data)
+	} else {
+		_, err = s.pc.WriteTo(data, s.targetAddr)
+	}
+	if err == nil {
+		s.tracker.PushUploaded(len(data))
+	}
+	return err
+}
+
+// close 关闭关联, 也可以由 /api/connections 通过 tracker 关闭
+// stale 虚假ip的映射已变化, 同时刷新映射避免活动的会话被淘汰
+func (s *session) stale() bool {
+	if s.fakeIP == nil {
+		return false
+	}
+	host, ok := resolver.FindHostByIP(s.fakeIP)
+	return !ok || host != s.fakeHost
+}
+
+func (s *session) close() {
+	if s.tracker != nil {
+		_ = s.tracker.Close()
+	}
+	_ = s.limit.Close()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	if s.pc != nil {
+		_ = s.pc.Close()
+	}
+	if s.reply != nil {
+		_ = s.reply.Close()
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package tproxy
+
+import (
+	"errors"
+	"net"
+)
+
+func getOrigDst(oob []byte, oobn int) (*net.UDPAddr, error) {
+	return nil, errors.New("tproxy is only supported on linux")
+}
+
+func dialUDP(network string, lAddr *net.UDPAddr, rAddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("tproxy is only supported on linux")
+}
@@ -2,103 +2,141 @@ package tunnel
 
 import (
 	"context"
+	"errors"
 	"net"
 	"runtime"
+	"strings"
 	"time"
 
-	"github.com/refraction-networking/utls"
 	"github.com/sirupsen/logrus"
 	"github.com/smallnest/chanx"
 	"github.com/xmapst/lightsocks/internal/config"
 	"github.com/xmapst/lightsocks/internal/constant"
-	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
 	N "github.com/xmapst/lightsocks/internal/net"
+	"github.com/xmapst/lightsocks/internal/outbound"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/rules"
 	"github.com/xmapst/lightsocks/internal/statistic"
+	"go.uber.org/atomic"
 )
 
+var errFakeIPNotFound = errors.New("fake ip mapping not found")
+
 var (
 	TCPIn         = chanx.NewUnboundedChan[*constant.TCPContext](10000)
 	DefaultWorker = 4
+	// 正在处理的连接数
+	active = atomic.NewInt64(0)
 )
 
-func Start(server *constant.Server) {
-	go process(server)
+// Start ctx 结束后不再处理新的连接, 进行中的连接由 Drain 等待
+func Start(ctx context.Context) {
+	go process(ctx)
 }
 
 // processTCP starts a loop to handle tcp packet
-func processTCP(server *constant.Server) {
+func processTCP(ctx context.Context) {
 	for conn := range TCPIn.Out {
-		go handleTCPConn(conn, server)
+		if ctx.Err() != nil {
+			// 已开始关闭, 入口握手完成的连接直接关闭
+			_ = conn.SrcConn.Close()
+			if conn.PostFn != nil {
+				conn.PostFn()
+			}
+			continue
+		}
+		active.Inc()
+		go handleTCPConn(conn)
+	}
+}
+
+// Drain 等待进行中的连接结束, ctx 结束时强制关闭仍在统计中的连接
+func Drain(ctx context.Context) {
+	tick := time.NewTicker(time.Millisecond * 100)
+	defer tick.Stop()
+	for active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			n := statistic.DefaultManager.CloseAll()
+			logrus.Warningln(active.Load(), "connections not finished, force closed", n)
+			return
+		case <-tick.C:
+		}
 	}
 }
 
-func process(server *constant.Server) {
+func process(ctx context.Context) {
 	if num := runtime.GOMAXPROCS(0); num > DefaultWorker {
 		DefaultWorker = num
 	}
 	DefaultWorker *= DefaultWorker
 	for i := 0; i < DefaultWorker; i++ {
-		go processTCP(server)
+		go processTCP(ctx)
 	}
 }
 
-func handleTCPConn(ctx *constant.TCPContext, server *constant.Server) {
+func handleTCPConn(ctx *constant.TCPContext) {
+	defer active.Dec()
 	defer func(conn net.Conn) {
 		_ = conn.Close()
 	}(ctx.SrcConn)
+	// 清除入口握手阶段设置的超时
+	_ = ctx.SrcConn.SetDeadline(time.Time{})
 
-	// connect to the target
-	var target = ctx.Metadata.Target
-	if config.RunMode == config.ClientMode && server.Enable() {
-		target = &constant.IP{
-			Addr: server.Host,
-			Port: server.Port,
+	if err := preHandleMetadata(ctx.Metadata); err != nil {
+		logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err.Error())
+		fail(ctx, err)
+		return
+	}
+
+	proxy, rule := match(ctx.Metadata)
+	// 代理组按策略解析到具体的出口
+	proxy, chains := outbound.Resolve(proxy, ctx.Metadata)
+	if rule != nil {
+		logrus.Debugln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Target, "match", rule.RuleType(), rule.Payload(), "using", strings.Join(chains, " --> "))
+	}
+	if proxy.Type() == outbound.Reject {
+		// 先通知入口, 之后关闭连接
+		fail(ctx, constant.ErrRejected)
+		relay := &N.Relay{
+			Src:      ctx.SrcConn,
+			Metadata: ctx.Metadata,
 		}
+		relay.Start(constant.Block)
+		return
 	}
 
-	var destConn net.Conn
-	var err error
-	destConn, err = dialer.DialContext(
-		context.Background(), "tcp", target.String(),
-		dialer.WithTimeout(server.Timeout), dialer.WithInterface(server.Interface),
-		dialer.WithRoutingMark(server.RoutingMark),
-	)
-	if err != nil {
-		logrus.Errorln(ctx.Metadata.ID, "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err.Error())
+	// 流量配额用完时拒绝新的连接
+	limit := limiter.Match(ctx.Metadata)
+	if limit != nil && limit.Exceeded() {
+		logrus.Warningln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, limiter.ErrQuotaExceeded)
+		fail(ctx, limiter.ErrQuotaExceeded)
 		return
 	}
-	if server.TLS.Enable && config.RunMode == config.ClientMode {
-		helloID := tls.ClientHelloID{}
-		switch server.TLS.Fingerprint {
-		case "firefox":
-			helloID = tls.HelloFirefox_Auto
-		case "chrome":
-			helloID = tls.HelloChrome_Auto
-		case "ios":
-			helloID = tls.HelloIOS_Auto
-		default:
-			helloID = tls.HelloFirefox_Auto
-		}
-		tlsConn := tls.UClient(destConn, server.TLSConf, helloID)
-		err = tlsConn.Handshake()
-		if err != nil {
-			logrus.Errorln(ctx.Metadata.ID, "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err.Error())
-			return
-		}
-		destConn = tlsConn
+
+	if ctx.Metadata.NetWork == constant.UDP {
+		handleUDPConn(ctx, proxy, chains, limit)
+		return
+	}
+
+	// connect to the target
+	destConn, err := proxy.DialContext(context.Background(), ctx.Metadata)
+	if err != nil {
+		logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err.Error())
+		fail(ctx, err)
+		return
 	}
 	// 连接管理
-	destConn = statistic.NewTCPTracker(destConn, ctx.Metadata)
+	destConn = statistic.NewRelayTracker(ctx.SrcConn, destConn, ctx.Metadata, chains...)
 	defer func(destConn net.Conn) {
 		_ = destConn.Close()
 	}(destConn)
 
-	// 激活4层会话保持
-	tcpKeepAlive(destConn)
-
 	// 发送http代理头信息
 	err = sedHttpHeader(ctx, destConn)
 	if err != nil {
+		fail(ctx, err)
 		return
 	}
 
@@ -106,7 +144,7 @@ func handleTCPConn(ctx *constant.TCPContext, server *constant.Server) {
 		// 通道开启前, 预处理, 例如:
 		// 1. socks代理需要发送连接成功信息给客户端
 		// 2. http代理需要发送代理头给客户端
-		ctx.PreFn()
+		ctx.PreFn(destConn.LocalAddr())
 	}
 
 	defer func() {
@@ -116,56 +154,111 @@ func handleTCPConn(ctx *constant.TCPContext, server *constant.Server) {
 		}
 	}()
 
-	var src, dest, _type = ctx.SrcConn, destConn, constant.Direct
-	if config.RunMode != config.DirectMode {
+	var _type = constant.Direct
+	if _, ok := ctx.SrcConn.(*N.SecureTCPConn); ok {
+		// lightsocks 入口非多路复用的连接需要解密
 		_type = constant.Proxy
-		if config.RunMode == config.ClientMode {
-			src, dest = destConn, ctx.SrcConn
-		}
 	}
 	relay := &N.Relay{
-		Src:      src,
-		Dest:     dest,
+		Src:      ctx.SrcConn,
+		Dest:     destConn,
 		Metadata: ctx.Metadata,
-		Token:    []byte(config.Token),
+		Cipher:   config.Cipher,
+		Limit:    limit,
 	}
 	relay.Start(_type)
 }
 
-func tcpKeepAlive(c net.Conn) {
-	if tcp, ok := c.(*net.TCPConn); ok {
-		_ = tcp.SetKeepAlive(true)
-		_ = tcp.SetKeepAlivePeriod(30 * time.Second)
+// Bind 按路由规则检查 socks5 BIND 请求, 对端的连接由入口直接接受, 只支持直连的出口
+func Bind(metadata *constant.Metadata) ([]string, *limiter.Rule, error) {
+	if err := preHandleMetadata(metadata); err != nil {
+		return nil, nil, err
 	}
+	proxy, rule := match(metadata)
+	proxy, chains := outbound.Resolve(proxy, metadata)
+	if rule != nil {
+		logrus.Debugln(metadata.ID, metadata.Identity(), "-->", metadata.Target, "match", rule.RuleType(), rule.Payload(), "using", strings.Join(chains, " --> "))
+	}
+	switch proxy.Type() {
+	case outbound.Direct:
+	case outbound.Reject:
+		return nil, nil, constant.ErrRejected
+	default:
+		return nil, nil, constant.ErrNotSupported
+	}
+	// 流量配额用完时拒绝新的连接
+	limit := limiter.Match(metadata)
+	if limit != nil && limit.Exceeded() {
+		return nil, nil, limiter.ErrQuotaExceeded
+	}
+	return chains, limit, nil
 }
 
-func sedHttpHeader(ctx *constant.TCPContext, destConn net.Conn) (err error) {
-	if config.RunMode == config.ClientMode {
-		// 客户端模式需要提前写入被代理地址信息到远端服务器
-		destSecConn := &N.SecureTCPConn{ReadWriteCloser: destConn}
-		_, err = destSecConn.EncodeWrite([]byte(config.Token), []byte(ctx.Metadata.String()))
-		if err != nil {
-			logrus.Errorln(ctx.Metadata.ID, "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err)
-			return
+// preHandleMetadata 目标为虚假ip时还原为域名, 交由出口解析真实地址
+func preHandleMetadata(metadata *constant.Metadata) error {
+	ip := net.ParseIP(metadata.Target.Addr)
+	if ip == nil || !resolver.IsFakeIP(ip) {
+		return nil
+	}
+	host, ok := resolver.FindHostByIP(ip)
+	if !ok {
+		return errFakeIPNotFound
+	}
+	metadata.Target.Addr = host
+	metadata.DstIP = nil
+	return nil
+}
+
+// match 按顺序匹配路由规则, 未命中时客户端模式走代理, 其他模式直连
+func match(metadata *constant.Metadata) (outbound.Proxy, rules.Rule) {
+	// 同一连接使用同一份配置, 不受匹配过程中重新加载的影响
+	mode, parsedRules, proxies := config.Snapshot()
+	var resolved bool
+	for _, rule := range parsedRules {
+		if !resolved && rule.ShouldResolveIP() && metadata.DstIP == nil {
+			resolved = true
+			if net.ParseIP(metadata.Target.Addr) == nil {
+				ip, err := resolver.ResolveIP(metadata.Target.Addr)
+				if err == nil {
+					metadata.DstIP = ip
+				}
+			}
 		}
+		if rule.Match(metadata) {
+			return lookup(proxies, rule.Adapter()), rule
+		}
+	}
+	if mode == config.ClientMode {
+		return lookup(proxies, rules.Proxy), nil
 	}
+	return lookup(proxies, rules.Direct), nil
+}
+
+// lookup 按名称查找出口, PROXY 未定义时直连
+func lookup(proxies map[string]outbound.Proxy, name string) outbound.Proxy {
+	if proxy, ok := proxies[name]; ok {
+		return proxy
+	}
+	return proxies[rules.Direct]
+}
+
+// fail 连接目标失败时通知入口并结束
+func fail(ctx *constant.TCPContext, err error) {
+	if ctx.FailFn != nil {
+		ctx.FailFn(err)
+	}
+	if ctx.PostFn != nil {
+		ctx.PostFn()
+	}
+}
+
+func sedHttpHeader(ctx *constant.TCPContext, destConn net.Conn) (err error) {
 	if ctx.Line != "" {
-		switch config.RunMode {
-		case config.ClientMode:
-			// 客户端模式使用加密方式写入远端服务器
-			destSecConn := &N.SecureTCPConn{ReadWriteCloser: destConn}
-			// redirect http proxy
-			_, err = destSecConn.EncodeWrite([]byte(config.Token), []byte(ctx.Line))
-			if err != nil {
-				logrus.Errorln(ctx.Metadata.ID, "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err)
-				return
-			}
-		default:
-			_, err = destConn.Write([]byte(ctx.Line))
-			if err != nil {
-				logrus.Errorln(ctx.Metadata.ID, "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err)
-				return
-			}
+		// redirect http proxy, 经由lightsocks出口时会加密写入远端服务器
+		_, err = destConn.Write([]byte(ctx.Line))
+		if err != nil {
+			logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err)
+			return
 		}
 	}
 	return
@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/config"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	"github.com/xmapst/lightsocks/internal/outbound"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/statistic"
+)
+
+const udpTimeout = 100 * time.Second
+
+// DialUDP 按路由规则为 UDP 关联选择出口, 直连时返回nil
+// 关联由入口的 statistic.UDPTracker 统计
+func DialUDP(metadata *constant.Metadata) (net.Conn, []string, error) {
+	proxy, _ := match(metadata)
+	proxy, chains := outbound.Resolve(proxy, metadata)
+	switch proxy.Type() {
+	case outbound.Direct:
+		return nil, chains, nil
+	case outbound.Reject:
+		return nil, nil, outbound.ErrReject
+	}
+	conn, err := proxy.DialUDP(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, chains, nil
+}
+
+// handleUDPConn 服务端转发客户端通过流传输的 UDP 数据包, 规则匹配到其他出口时经由该出口转发
+// limit 为客户端的限速及流量配额, 与TCP相同按数据包计算
+func handleUDPConn(ctx *constant.TCPContext, proxy outbound.Proxy, chains []string, limit *limiter.Rule) {
+	defer func() {
+		if ctx.PostFn != nil {
+			ctx.PostFn()
+		}
+	}()
+	remote, err := dialUDPRemote(proxy, ctx.Metadata)
+	if err != nil {
+		logrus.Errorln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, err)
+		return
+	}
+	src := ctx.SrcConn
+	t := statistic.NewUDPTracker(ctx.Metadata, func() {
+		_ = remote.Close()
+		_ = src.Close()
+	}, chains...)
+	l := limit.Packet(func() {
+		_ = t.Close()
+	})
+	defer func() {
+		_ = l.Close()
+		_ = t.Close()
+	}()
+
+	start := time.Now()
+	logrus.Infoln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, "access")
+	defer func() {
+		logrus.Infoln(ctx.Metadata.ID, ctx.Metadata.Identity(), "-->", ctx.Metadata.Client, "-->", ctx.Metadata.Source, "-->", ctx.Metadata.Target, "finish", time.Since(start))
+	}()
+
+	// remote --> client
+	go func() {
+		buf := make([]byte, 1<<16)
+		for {
+			_ = remote.SetReadDeadline(time.Now().Add(udpTimeout))
+			addr, data, err := remote.readPacket(buf)
+			if err != nil {
+				break
+			}
+			l.Download(len(data))
+			if err = protocol.WriteUDPPacket(src, addr, data); err != nil {
+				break
+			}
+			t.PushDownloaded(len(data))
+		}
+		_ = src.SetReadDeadline(time.Now())
+	}()
+
+	// client --> remote
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(udpTimeout))
+		addr, data, err := protocol.ReadUDPPacket(src)
+		if err != nil {
+			break
+		}
+		l.Upload(len(data))
+		if err = remote.writePacket(addr, data); err != nil {
+			logrus.Warnln(ctx.Metadata.ID, "-->", addr, err)
+			continue
+		}
+		t.PushUploaded(len(data))
+	}
+	_ = remote.SetReadDeadline(time.Now())
+}
+
+// udpRemote 服务端 UDP 关联的远端, 直连或经由出口
+type udpRemote interface {
+	readPacket(buf []byte) (string, []byte, error)
+	writePacket(addr string, data []byte) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+func dialUDPRemote(proxy outbound.Proxy, metadata *constant.Metadata) (udpRemote, error) {
+	if proxy.Type() != outbound.Direct {
+		conn, err := proxy.DialUDP(metadata)
+		if err != nil {
+			return nil, err
+		}
+		return &tunnelRemote{conn}, nil
+	}
+	// 每次读取当前配置, 重新加载后新的关联使用新的出口设置
+	server := config.App.Outbound
+	pc, err := dialer.ListenPacket(
+		context.Background(), "udp", "",
+		dialer.WithInterface(server.Interface), dialer.WithRoutingMark(server.RoutingMark),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &directRemote{pc}, nil
+}
+
+type directRemote struct {
+	net.PacketConn
+}
+
+func (d *directRemote) readPacket(buf []byte) (string, []byte, error) {
+	n, from, err := d.ReadFrom(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	return from.String(), buf[:n], nil
+}
+
+func (d *directRemote) writePacket(addr string, data []byte) error {
+	udpAddr, err := resolver.ResolveUDPAddr(addr)
+	if err != nil {
+		return err
+	}
+	_, err = d.WriteTo(data, udpAddr)
+	return err
+}
+
+// tunnelRemote 经由出口的转发通道, 数据包格式与客户端相同
+type tunnelRemote struct {
+	net.Conn
+}
+
+func (t *tunnelRemote) readPacket([]byte) (string, []byte, error) {
+	return protocol.ReadUDPPacket(t.Conn)
+}
+
+func (t *tunnelRemote) writePacket(addr string, data []byte) error {
+	return protocol.WriteUDPPacket(t.Conn, addr, data)
+}
@@ -0,0 +1,47 @@
+package udp
+
+import "time"
+
+// fragTimeout 分片重组的超时时间, RFC 1928 要求不小于5秒
+const fragTimeout = 5 * time.Second
+
+// reassembler 重组一个关联中的分片, FRAG 的低7位为分片序号, 最高位表示最后一个分片
+// 只在关联的读取协程中使用
+type reassembler struct {
+	addr     string
+	header   []byte
+	data     []byte
+	last     byte // 已接收的最大序号, 0表示没有进行中的重组
+	deadline time.Time
+}
+
+// add 加入一个分片, 收到最后一个分片时返回完整的数据包
+// 序号不连续, 目标地址变化或超时时丢弃已接收的分片
+func (r *reassembler) add(frag byte, addr string, header, data []byte) (string, []byte, []byte, bool) {
+	pos, end := frag&0x7f, frag&0x80 != 0
+	if r.last != 0 && (pos != r.last+1 || addr != r.addr || time.Now().After(r.deadline)) {
+		r.reset()
+	}
+	if pos != r.last+1 || len(r.data)+len(data) > maxDatagram {
+		r.reset()
+		return "", nil, nil, false
+	}
+	if r.last == 0 {
+		r.addr = addr
+		r.header = append(r.header[:0], header...)
+		r.deadline = time.Now().Add(fragTimeout)
+	}
+	r.data = append(r.data, data...)
+	r.last = pos
+	if !end {
+		return "", nil, nil, false
+	}
+	addr, header, data = r.addr, r.header, r.data
+	// 返回的数据由调用方持有
+	r.addr, r.header, r.data, r.last = "", nil, nil, 0
+	return addr, header, data, true
+}
+
+func (r *reassembler) reset() {
+	r.addr, r.data, r.last = "", r.data[:0], 0
+}
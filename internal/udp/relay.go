@@ -0,0 +1,351 @@
+package udp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	"github.com/xmapst/lightsocks/internal/protocol"
+	"github.com/xmapst/lightsocks/internal/resolver"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"go.uber.org/atomic"
+)
+
+// Relay 一个 UDP ASSOCIATE 的转发端口, 每个目标地址对应一个会话
+// 全部会话的流量计入关联的统计及限制
+type Relay struct {
+	server     *Server
+	ctrl       net.Conn // 控制连接
+	conn       *net.UDPConn
+	clientIP   net.IP
+	clientPort int // 客户端声明的发送端口, 0为不限制
+	client     atomic.Pointer[net.UDPAddr]
+	mu         sync.Mutex
+	sessions   map[string]*session
+	tracker    *statistic.UDPTracker
+	limit      *limiter.Packet
+	closed     *atomic.Bool
+}
+
+// session 发往同一目标的数据包, conn为nil时直连
+type session struct {
+	conn       net.Conn       // 经由出口转发
+	pc         net.PacketConn // 直连
+	target     string
+	targetAddr *net.UDPAddr
+	header     []byte // 回包使用的头部, 与客户端发送的目标地址一致
+	fakeIP     net.IP // 目标为虚假ip时还原前的地址
+	fakeHost   string // 虚假ip还原后的域名
+	mu         sync.Mutex
+	lastActive *atomic.Time
+}
+
+// LocalAddr 回复客户端的转发地址
+func (r *Relay) LocalAddr() net.Addr {
+	return r.conn.LocalAddr()
+}
+
+// Close 关闭转发端口, 控制连接及全部会话, 也可以由 /api/connections 通过 tracker 关闭
+func (r *Relay) Close() error {
+	if !r.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	r.server.remove(r)
+	_ = r.tracker.Close()
+	_ = r.limit.Close()
+	_ = r.conn.Close()
+	_ = r.ctrl.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, s := range r.sessions {
+		delete(r.sessions, k)
+		s.close()
+	}
+	return nil
+}
+
+/**
+  +----+------+------+----------+----------+----------+
+   |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+   +----+------+------+----------+----------+----------+
+   | 2  |  1   |  1   | Variable |    2     | Variable |
+   +----+------+------+----------+----------+----------+
+*/
+
+func (r *Relay) serve() {
+	defer r.Close()
+	var frags reassembler
+	buf := make([]byte, maxDatagram)
+	for {
+		n, srcAddr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !r.accept(srcAddr) {
+			continue
+		}
+		frag, addr, header, data, err := parsePacket(buf[:n])
+		if err != nil {
+			logrus.Warningln(srcAddr, "-->", r.conn.LocalAddr(), err)
+			continue
+		}
+		if frag != 0 {
+			var ok bool
+			addr, header, data, ok = frags.add(frag, addr, header, data)
+			if !ok {
+				continue
+			}
+		} else if frags.last != 0 {
+			// 序号为0的数据包同样是更小的序号, RFC 1928 要求重新开始重组
+			frags.reset()
+		}
+		r.handlePacket(srcAddr, addr, header, data)
+	}
+}
+
+// accept 只接受控制连接的客户端ip, 第一个数据包的端口作为之后的客户端地址
+func (r *Relay) accept(srcAddr *net.UDPAddr) bool {
+	if !srcAddr.IP.Equal(r.clientIP) {
+		return false
+	}
+	if client := r.client.Load(); client != nil {
+		return client.Port == srcAddr.Port
+	}
+	if r.clientPort != 0 && r.clientPort != srcAddr.Port {
+		return false
+	}
+	r.client.Store(srcAddr)
+	return true
+}
+
+// parsePacket 解析数据包头部, 返回的头部已将 FRAG 置0, 用于回包
+func parsePacket(packet []byte) (byte, string, []byte, []byte, error) {
+	if len(packet) < 4 || packet[0] != 0x00 || packet[1] != 0x00 {
+		return 0, "", nil, nil, ErrInvalidPacket
+	}
+	reader := bytes.NewReader(packet[3:])
+	addr, err := protocol.ReadAddr(reader)
+	if err != nil {
+		return 0, "", nil, nil, err
+	}
+	index := len(packet) - reader.Len()
+	header := make([]byte, index)
+	copy(header, packet[:index])
+	header[2] = 0x00
+	return packet[2], addr, header, packet[index:], nil
+}
+
+func (r *Relay) handlePacket(srcAddr *net.UDPAddr, addr string, header, data []byte) {
+	r.mu.Lock()
+	s, ok := r.sessions[addr]
+	if ok && s.stale() {
+		// 虚假ip已回收或分配给其他域名, 重新建立会话
+		delete(r.sessions, addr)
+		s.close()
+		ok = false
+	}
+	r.mu.Unlock()
+	if ok {
+		r.write(srcAddr, addr, s, data)
+		return
+	}
+	// 新建会话需要解析及连接目标, 不阻塞关联的读取及发往其他目标的数据包
+	data = append([]byte(nil), data...)
+	go r.dialSession(srcAddr, addr, header, data)
+}
+
+// dialSession 新建会话后写入第一个数据包, 期间其他数据包已建立会话时关闭新建的会话
+func (r *Relay) dialSession(srcAddr *net.UDPAddr, addr string, header, data []byte) {
+	s, err := r.newSession(srcAddr, addr, header)
+	if err != nil {
+		logrus.Errorln(srcAddr, "-->", addr, err)
+		return
+	}
+	r.mu.Lock()
+	if r.closed.Load() {
+		r.mu.Unlock()
+		s.close()
+		return
+	}
+	if exist, ok := r.sessions[addr]; ok {
+		r.mu.Unlock()
+		s.close()
+		s = exist
+	} else {
+		r.sessions[addr] = s
+		r.mu.Unlock()
+		go r.handleRead(addr, s)
+	}
+	r.write(srcAddr, addr, s, data)
+}
+
+func (r *Relay) write(srcAddr *net.UDPAddr, addr string, s *session, data []byte) {
+	r.limit.Upload(len(data))
+	if err := s.write(data); err != nil {
+		logrus.Warningln(srcAddr, "-->", addr, err)
+		r.closeSession(addr, s)
+		return
+	}
+	r.tracker.PushUploaded(len(data))
+}
+
+func (r *Relay) newSession(srcAddr *net.UDPAddr, addr string, header []byte) (*session, error) {
+	target := addr
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	var fakeIP net.IP
+	var fakeHost string
+	if ip := net.ParseIP(host); ip != nil && resolver.IsFakeIP(ip) {
+		// 虚假ip还原为域名, 回包仍使用原始头部
+		var ok bool
+		fakeIP = ip
+		fakeHost, ok = resolver.FindHostByIP(ip)
+		if !ok {
+			return nil, errFakeIPNotFound
+		}
+		target = net.JoinHostPort(fakeHost, port)
+	}
+	metadata, err := r.newMetadata(srcAddr, target)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	var chains []string
+	if r.server.Tunnel != nil {
+		conn, chains, err = r.server.Tunnel(metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &session{
+		conn:       conn,
+		target:     target,
+		header:     header,
+		fakeIP:     fakeIP,
+		fakeHost:   fakeHost,
+		lastActive: atomic.NewTime(time.Now()),
+	}
+	if conn == nil {
+		s.targetAddr, err = resolver.ResolveUDPAddr(target)
+		if err == nil {
+			var options []dialer.Option
+			if r.server.Options != nil {
+				options = r.server.Options()
+			}
+			s.pc, err = dialer.ListenPacket(context.Background(), "udp", "", options...)
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+	}
+	logrus.Debugln(metadata.ID, metadata.Identity(), "-->", metadata.Client, "-->", metadata.Source, "-->", metadata.Target, "associate", strings.Join(chains, " --> "))
+	return s, nil
+}
+
+func (r *Relay) newMetadata(srcAddr *net.UDPAddr, target string) (*constant.Metadata, error) {
+	dst, err := constant.UnmarshalIP(target)
+	if err != nil {
+		return nil, err
+	}
+	source, err := constant.UnmarshalIP(r.conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	return &constant.Metadata{
+		ID:      id,
+		NetWork: constant.UDP,
+		Type:    constant.SOCKS5,
+		Client:  &constant.IP{Addr: srcAddr.IP.String(), Port: int64(srcAddr.Port)},
+		Source:  source,
+		Target:  dst,
+		Inbound: r.server.Tag,
+	}, nil
+}
+
+// handleRead 远端的回包加上原始头部发回客户端
+func (r *Relay) handleRead(key string, s *session) {
+	defer r.closeSession(key, s)
+	buf := make([]byte, maxDatagram)
+	for {
+		var data []byte
+		var err error
+		if s.conn != nil {
+			_ = s.conn.SetReadDeadline(time.Now().Add(udpTimeout))
+			_, data, err = protocol.ReadUDPPacket(s.conn)
+		} else {
+			var n int
+			_ = s.pc.SetReadDeadline(time.Now().Add(udpTimeout))
+			n, _, err = s.pc.ReadFrom(buf)
+			data = buf[:n]
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() &&
+				time.Since(s.lastActive.Load()) < udpTimeout {
+				continue
+			}
+			return
+		}
+		s.lastActive.Store(time.Now())
+		r.limit.Download(len(data))
+		r.tracker.PushDownloaded(len(data))
+		packet := make([]byte, 0, len(s.header)+len(data))
+		packet = append(packet, s.header...)
+		packet = append(packet, data...)
+		if _, err = r.conn.WriteToUDP(packet, r.client.Load()); err != nil {
+			logrus.Warningln(key, err)
+		}
+	}
+}
+
+func (r *Relay) closeSession(key string, s *session) {
+	r.mu.Lock()
+	if r.sessions[key] == s {
+		delete(r.sessions, key)
+	}
+	r.mu.Unlock()
+	s.close()
+}
+
+func (s *session) write(data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive.Store(time.Now())
+	if s.conn != nil {
+		return protocol.WriteUDPPacket(s.conn, s.target, data)
+	}
+	_, err := s.pc.WriteTo(data, s.targetAddr)
+	return err
+}
+
+// stale 虚假ip的映射已变化, 同时刷新映射避免活动的会话被淘汰
+func (s *session) stale() bool {
+	if s.fakeIP == nil {
+		return false
+	}
+	host, ok := resolver.FindHostByIP(s.fakeIP)
+	return !ok || host != s.fakeHost
+}
+
+func (s *session) close() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	if s.pc != nil {
+		_ = s.pc.Close()
+	}
+}
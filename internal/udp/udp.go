@@ -1,259 +1,157 @@
 package udp
 
 import (
-	"encoding/binary"
+	"errors"
 	"net"
-	"strconv"
-	"strings"
+	"sync"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"github.com/gofrs/uuid"
 	"github.com/xmapst/lightsocks/internal/constant"
+	"github.com/xmapst/lightsocks/internal/dialer"
+	"github.com/xmapst/lightsocks/internal/limiter"
+	"github.com/xmapst/lightsocks/internal/statistic"
+	"go.uber.org/atomic"
 )
 
-type Udp struct {
-	conn      *net.UDPConn
-	srcUdpMap SrcUdpMap
-}
+const (
+	udpTimeout = 100 * time.Second
+	// maxDatagram UDP 数据包的最大长度
+	maxDatagram = 1<<16 - 1
+)
 
-func New(addr string) (*Udp, error) {
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		logrus.Errorln(err)
-		return nil, err
-	}
-	udp, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		logrus.Errorln(err)
-		return nil, err
-	}
-	return &Udp{
-		conn: udp,
-	}, nil
-}
+var (
+	ErrServerClosed   = errors.New("udp server closed")
+	ErrInvalidPacket  = errors.New("invalid udp packet")
+	errFakeIPNotFound = errors.New("fake ip mapping not found")
+)
 
-func (u *Udp) ListenAndServe() {
-	go u.timeout()
-	for {
-		var data = make([]byte, 8192)
-		n, srcAddr, err := u.conn.ReadFromUDP(data)
-		if err != nil {
-			if strings.Contains(err.Error(), net.ErrClosed.Error()) {
-				break
-			}
-			logrus.Errorln("READ error", err)
-			continue
-		}
-		if n <= 0 {
-			continue
-		}
-		logrus.Infof("[%v]:", srcAddr)
-		go u.handleUdpPacket(srcAddr, data[:n])
-	}
-}
+// TunnelFn 为一个 UDP 关联建立到服务端的转发通道, 返回nil连接时直接发送
+// chains 为关联经过的代理组及出口
+type TunnelFn func(metadata *constant.Metadata) (conn net.Conn, chains []string, err error)
 
-func (u *Udp) LocalAddr() string {
-	return u.conn.LocalAddr().String()
+// Server socks5 的 UDP 转发, 每个 UDP ASSOCIATE 分配独立的端口, 随控制连接关闭
+type Server struct {
+	// Tag 所属入口的标签
+	Tag string
+	// Tunnel 不为空时, 数据包经由服务端转发
+	Tunnel TunnelFn
+	// Options 直连时的出口网卡及fwmark, 每个会话读取一次, 重新加载后新的会话使用新的设置
+	Options func() []dialer.Option
+	mu      sync.Mutex
+	relays  map[*Relay]struct{}
+	closed  bool
 }
 
-func (u *Udp) timeout() {
-	tick := time.Tick(time.Second * 100)
-	for {
-		select {
-		case <-tick:
-			u.srcUdpMap.timeout()
-		}
+func New(tag string, tunnel TunnelFn) *Server {
+	return &Server{
+		Tag:    tag,
+		Tunnel: tunnel,
+		relays: make(map[*Relay]struct{}),
 	}
-
 }
 
-/**
-  +----+------+------+----------+----------+----------+
-   |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
-   +----+------+------+----------+----------+----------+
-   | 2  |  1   |  1   | Variable |    2     | Variable |
-   +----+------+------+----------+----------+----------+
-
-  The fields in the UDP request header are:
-
-       o  RSV  Reserved X'0000'
-       o  FRAG    Current fragment number
-       o  ATYP    address type of following addresses:
-          o  IP V4 address: X'01'
-          o  DOMAINNAME: X'03'
-          o  IP V6 address: X'04'
-       o  DST.ADDR       desired destination address
-       o  DST.PORT       desired destination port
-       o  DATA     user data
-*/
-
-func (u *Udp) handleUdpPacket(srcAddr *net.UDPAddr, message []byte) {
-	logrus.Infoln(srcAddr.String() + " send udp package!")
-	length := len(message)
-	index := 3
-	if length < index {
-		logrus.Errorln("error package")
-		return
-	}
-	if message[0] != 0x00 && message[1] != 0x00 {
-		logrus.Errorln("rev failed not 0x0000")
-		return
-	}
-	if message[2] != 0x00 {
-		logrus.Errorln("FRAG  not support")
-		return
-	}
-	atype := message[3]
-	index = 4
-	var addr = ""
-	if atype == constant.ATypeIPv4 {
-		index += 4
-		addr = net.IP(message[index-4 : index]).String()
-	} else if atype == constant.ATypeDomainName {
-		addrLen := int(message[index])
-		index += 1
-		addr = string(message[index : index+addrLen])
-		index += addrLen
-	} else if atype == constant.ATypeIPv6 {
-		addr = net.IP(message[index : index+16]).String()
-		index += 16
+// Associate 在控制连接的本地地址上分配转发端口, 只接受控制连接的客户端ip发送的数据包
+// expected 为客户端在请求中声明的发送地址, 端口不为0时只接受该端口
+func (s *Server) Associate(ctrl net.Conn, expected string) (*Relay, error) {
+	local, err := net.ResolveUDPAddr("udp", ctrl.LocalAddr().String())
+	if err != nil {
+		return nil, err
 	}
-	port := binary.BigEndian.Uint16(message[index : index+2])
-	index += 2
-	data := message[index:]
-	originHeader := message[0:index]
-	u.handleUdpPacket2(srcAddr, addr, port, data, originHeader)
-
-}
-
-func (u *Udp) handleUdpPacket2(srcAddr *net.UDPAddr, dstAddr string, port uint16, message []byte, originHeader []byte) {
-	srcUdpInfo := u.srcUdpMap.get(srcAddr)
-	laddr := srcUdpInfo.localAddr
-	var destAddr *net.UDPAddr
-	ua := dstAddr + ":" + strconv.Itoa(int(port))
-	remoteConn := srcUdpInfo.getRemoteConn(ua)
-	if remoteConn == nil {
-		destAddr, _ = net.ResolveUDPAddr("udp", ua)
-		udpCon, err := net.DialUDP("udp", laddr, destAddr)
-		if err != nil {
-			logrus.Warningln("error connect " + dstAddr)
-			return
-		}
-		remoteConn = udpCon
-		srcUdpInfo.addRemoteConn(ua, remoteConn)
-		if laddr == nil {
-			srcUdpInfo.setLocalAddr(udpCon.LocalAddr().(*net.UDPAddr))
-		}
-		go u.handleRemoteRead(srcAddr, udpCon, originHeader, ua, srcUdpInfo)
+	client, err := net.ResolveUDPAddr("udp", ctrl.RemoteAddr().String())
+	if err != nil {
+		return nil, err
 	}
-	_, err := remoteConn.Write(message)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
 	if err != nil {
-		srcUdpInfo.deleteRemoteConn(ua)
-		return
+		return nil, err
 	}
-	srcUdpInfo.active()
-}
-
-func (u *Udp) handleRemoteRead(srcAddr *net.UDPAddr, udpCon *net.UDPConn,
-	originHeader []byte, key string, info *SrcUdpInfo) {
-	var b [65507]byte
-	for {
-		err := udpCon.SetReadDeadline(time.Now().Add(time.Second * 100))
-		if err != nil {
-			logrus.Warningln(err)
-		}
-		n, err := udpCon.Read(b[:])
-		if err != nil {
-			logrus.Warningln("udp read error==========", err)
-			break
-		}
-		info.active()
-		buf := append(originHeader, b[:n]...)
-		_, err = u.conn.WriteToUDP(buf, srcAddr)
-		if err != nil {
-			logrus.Warningln(err)
-		}
+	metadata, err := s.newMetadata(ctrl, conn, expected)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
-
-	info.deleteRemoteConn(key)
-
-}
-
-type SrcUdpMap struct {
-	associated map[string]*SrcUdpInfo // src string->src addr
-}
-
-func (u *SrcUdpMap) get(srcAddr *net.UDPAddr) *SrcUdpInfo {
-	src := srcAddr.String()
-	if u.associated[src] != nil {
-		return u.associated[src]
+	// 流量配额用完时拒绝新的关联
+	limit := limiter.Match(metadata)
+	if limit != nil && limit.Exceeded() {
+		_ = conn.Close()
+		return nil, limiter.ErrQuotaExceeded
+	}
+	r := &Relay{
+		server:   s,
+		ctrl:     ctrl,
+		conn:     conn,
+		clientIP: client.IP,
+		sessions: make(map[string]*session),
+		closed:   atomic.NewBool(false),
+	}
+	if addr, err := net.ResolveUDPAddr("udp", expected); err == nil {
+		r.clientPort = addr.Port
+	}
+	r.tracker = statistic.NewUDPTracker(metadata, func() {
+		_ = r.Close()
+	})
+	r.limit = limit.Packet(func() {
+		_ = r.Close()
+	})
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = r.Close()
+		return nil, ErrServerClosed
+	}
+	s.relays[r] = struct{}{}
+	s.mu.Unlock()
+
+	go r.serve()
+	return r, nil
+}
+
+// newMetadata 关联的连接信息, 目标为客户端声明的发送地址
+func (s *Server) newMetadata(ctrl net.Conn, conn *net.UDPConn, expected string) (*constant.Metadata, error) {
+	client, err := constant.UnmarshalIP(ctrl.RemoteAddr().String())
+	if err != nil {
+		return nil, err
 	}
-	r := &SrcUdpInfo{
-		srcAddr:        srcAddr,
-		lastActiveTime: time.Now(),
-		localDestCon:   make(map[string]*net.UDPConn),
+	source, err := constant.UnmarshalIP(conn.LocalAddr().String())
+	if err != nil {
+		return nil, err
 	}
-	return r
-}
-
-func (u *SrcUdpMap) delete(srcAddr *net.UDPAddr) {
-	src := srcAddr.String()
-	delete(u.associated, src)
-}
-
-func (u *SrcUdpMap) timeout() {
-	for k, v := range u.associated {
-		if v.lastActiveTime.Add(time.Second * 100).Before(time.Now()) {
-			delete(u.associated, k)
-			v.Destroy()
-			logrus.Warningln("delete" + k)
-		}
+	target, err := constant.UnmarshalIP(expected)
+	if err != nil {
+		return nil, err
 	}
-}
-
-type SrcUdpInfo struct {
-	srcAddr        *net.UDPAddr
-	localAddr      *net.UDPAddr
-	lastActiveTime time.Time
-	localDestCon   map[string]*net.UDPConn //  dst -> conn
-}
-
-func (u *SrcUdpInfo) setLocalAddr(localAddr *net.UDPAddr) {
-	u.localAddr = localAddr
-	u.lastActiveTime = time.Now()
-
-}
-
-func (u *SrcUdpInfo) active() {
-	u.lastActiveTime = time.Now()
-}
-
-func (u *SrcUdpInfo) deleteRemoteConn(remoteAddr string) {
-	if c, ok := u.localDestCon[remoteAddr]; ok {
-		err := c.Close()
-		if err != nil {
-			logrus.Warningln(err)
-		}
-		delete(u.localDestCon, remoteAddr)
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
 	}
+	return &constant.Metadata{
+		ID:      id,
+		NetWork: constant.UDP,
+		Type:    constant.SOCKS5,
+		Client:  client,
+		Source:  source,
+		Target:  target,
+		Inbound: s.Tag,
+	}, nil
 }
 
-func (u *SrcUdpInfo) addRemoteConn(remoteAddr string, con *net.UDPConn) {
-	u.localDestCon[remoteAddr] = con
-}
-
-func (u *SrcUdpInfo) getRemoteConn(remoteAddr string) *net.UDPConn {
-	if c, ok := u.localDestCon[remoteAddr]; ok {
-		return c
+// Close 关闭全部关联, 之后不再接受新的关联
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	relays := s.relays
+	s.relays = make(map[*Relay]struct{})
+	s.mu.Unlock()
+	for r := range relays {
+		_ = r.Close()
 	}
 	return nil
 }
 
-func (u *SrcUdpInfo) Destroy() {
-	for _, v := range u.localDestCon {
-		err := v.Close()
-		if err != nil {
-			logrus.Warningln(err)
-		}
-	}
+func (s *Server) remove(r *Relay) {
+	s.mu.Lock()
+	delete(s.relays, r)
+	s.mu.Unlock()
 }